@@ -5,6 +5,7 @@ export const LoginForm: React.FC = () => (
         <form className="login-form central" action="/login" method="POST" autoComplete="off">
             <input name="name" type="text" placeholder="Username" autoFocus />
             <input name="pass" type="password" placeholder="Password" />
+            <input name="code" type="text" placeholder="2FA code (if enabled)" inputMode="numeric" />
             <input type="submit" value="Login" className="button" />
         </form>
     </div>
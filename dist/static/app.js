@@ -454,6 +454,7 @@
         React.createElement("form", { className: "login-form central", action: "/login", method: "POST", autoComplete: "off" },
             React.createElement("input", { name: "name", type: "text", placeholder: "Username", autoFocus: true }),
             React.createElement("input", { name: "pass", type: "password", placeholder: "Password" }),
+            React.createElement("input", { name: "code", type: "text", placeholder: "2FA code (if enabled)", inputMode: "numeric" }),
             React.createElement("input", { type: "submit", value: "Login", className: "button" })))); };
 
     var Home = function () {
@@ -23,6 +23,23 @@
                 .replace(/=/g, ''),
         },
     };
+    const base32 = {
+        decode: (s) => {
+            const alphabet = 'ABCDEFGHIJKLMNOPQRSTUVWXYZ234567';
+            const out = [];
+            let bits = 0;
+            let value = 0;
+            for (const c of s.toUpperCase().replace(/=+$/, '')) {
+                value = (value << 5) | alphabet.indexOf(c);
+                bits += 5;
+                if (bits >= 8) {
+                    out.push((value >>> (bits - 8)) & 0xff);
+                    bits -= 8;
+                }
+            }
+            return new Uint8Array(out);
+        },
+    };
     const parseCookie = (str) => str
         .split(';')
         .map(v => v.split('='))
@@ -36,16 +53,31 @@
         accounts: Array.from({ length: __ACCOUNTS_COUNT__ }, (_, i) => `__ACCOUNTS_URL__${i + 1}`),
         accountRotation: __ACCOUNT_ROTATION__,
         accountCandidates: __ACCOUNT_CANDIDATES__,
+        accountStrategy: '__ACCOUNT_STRATEGY__',
+        accountWeights: __ACCOUNT_WEIGHTS__,
+        accountDrives: __ACCOUNT_DRIVES__,
         userURL: async (user) => '__USERS_URL__' + buf2hex(await crypto.subtle.digest('SHA-256', str2buf(config.secret + user))),
         static: async (pathname) => '__STATIC_URL__' + pathname,
+        indexURL: async (drive) => '__INDEX_URL__' &&
+            '__INDEX_URL__' + buf2hex(await crypto.subtle.digest('SHA-256', str2buf(config.secret + ':index:' + drive))),
     };
 
+    // shared drives of files and folders, null outside shared drives, kept for
+    // the lifetime of the isolate
+    const driveCache = {};
+    let driveCacheSize = 0;
+    const DRIVE_CACHE_SIZE = 10000;
     class GoogleDrive {
         constructor(config) {
             this.config = config;
         }
+        // getUser returns undefined for users missing from the users Gist
         async getUser(user) {
-            return JSON.parse(buf2str(await this.decrypt('user', await (await fetch(await this.config.userURL(user))).arrayBuffer())));
+            const resp = await fetch(await this.config.userURL(user));
+            if (!resp.ok) {
+                return undefined;
+            }
+            return JSON.parse(buf2str(await this.decrypt('user', await resp.arrayBuffer())));
         }
         async download(account, id, range = '') {
             const url = new URL(`https://www.googleapis.com/drive/v3/files/${id}?alt=media`);
@@ -68,7 +100,7 @@
                 (async () => {
                     const url = new URL(`https://www.googleapis.com/drive/v3/files/${id}`);
                     url.searchParams.set('supportsAllDrives', 'true');
-                    url.searchParams.set('fields', 'id,name,kind,mimeType,size,modifiedTime,parents,md5Checksum');
+                    url.searchParams.set('fields', 'id,name,kind,mimeType,size,modifiedTime,parents,md5Checksum,driveId');
                     return (await fetch(url.toString(), {
                         headers: {
                             Authorization: `Bearer ${token}`,
@@ -91,6 +123,20 @@
             }
             return file;
         }
+        async parents(account, id) {
+            if (account == null) {
+                account = await this.pickAccount();
+            }
+            const url = new URL(`https://www.googleapis.com/drive/v3/files/${id}`);
+            url.searchParams.set('supportsAllDrives', 'true');
+            url.searchParams.set('fields', 'id,parents');
+            const file = await (await fetch(url.toString(), {
+                headers: {
+                    Authorization: `Bearer ${await this.accessToken(account)}`,
+                },
+            })).json();
+            return file.parents || [];
+        }
         async search(account, options) {
             let pageTokenMap = {};
             let { query, drives, encrypted_page_token } = options;
@@ -105,7 +151,7 @@
             const url = new URL('https://www.googleapis.com/drive/v3/files');
             url.searchParams.set('includeItemsFromAllDrives', 'true');
             url.searchParams.set('supportsAllDrives', 'true');
-            url.searchParams.set('fields', 'nextPageToken,files(id,name,mimeType,size,modifiedTime,parents)');
+            url.searchParams.set('fields', 'nextPageToken,files(id,name,mimeType,size,modifiedTime,parents,md5Checksum)');
             url.searchParams.set('pageSize', '100');
             const clauses = [];
             query
@@ -195,7 +241,7 @@
                 url.searchParams.set('includeItemsFromAllDrives', 'true');
                 url.searchParams.set('supportsAllDrives', 'true');
                 url.searchParams.set('q', `'${parent}' in parents and trashed = false`);
-                url.searchParams.set('fields', 'nextPageToken,files(id,name,mimeType,size,modifiedTime,parents)');
+                url.searchParams.set('fields', 'nextPageToken,files(id,name,mimeType,size,modifiedTime,parents,md5Checksum)');
                 url.searchParams.set('pageSize', '100');
                 if (orderBy) {
                     url.searchParams.set('orderBy', orderBy);
@@ -297,6 +343,30 @@
             }
             return new Response(JSON.stringify({ status: 'error', message: `unexpected API response status: ${response.status}` }));
         }
+        async mkdir(account, parent, name) {
+            if (account == null) {
+                account = await this.pickAccount();
+            }
+            const url = new URL('https://www.googleapis.com/drive/v3/files');
+            url.searchParams.set('supportsAllDrives', 'true');
+            url.searchParams.set('fields', 'id,name,mimeType,modifiedTime,parents,driveId');
+            const response = await fetch(url.toString(), {
+                method: 'POST',
+                headers: {
+                    Authorization: `Bearer ${await this.accessToken(account)}`,
+                    'Content-Type': 'application/json; charset=UTF-8',
+                },
+                body: JSON.stringify({
+                    name,
+                    parents: [parent],
+                    mimeType: 'application/vnd.google-apps.folder',
+                }),
+            });
+            return new Response(response.body, {
+                status: response.status,
+                headers: { 'Content-Type': 'application/json' },
+            });
+        }
         async secretKey(namespace) {
             const { config: { secret }, } = this;
             return crypto.subtle.importKey('raw', await crypto.subtle.digest('SHA-256', str2buf(secret + ':' + namespace)), 'AES-GCM', true, ['encrypt', 'decrypt']);
@@ -320,20 +390,71 @@
             const ciphertext = new Uint8Array(data.buffer, 12);
             return crypto.subtle.decrypt({ name: 'AES-GCM', iv }, await this.secretKey(namespace), ciphertext);
         }
-        async pickAccount() {
-            const { config: { secret, accounts, accountRotation, accountCandidates }, } = this;
-            const candidates = [];
-            if (accounts.length <= accountCandidates) {
-                candidates.push(...accounts);
+        usePoolOf(drives) {
+            let pool;
+            for (const drive of drives) {
+                const accounts = drive !== undefined ? this.config.accountDrives[drive] : undefined;
+                if (accounts) {
+                    pool = pool === undefined ? accounts : pool.filter((i) => accounts.indexOf(i) >= 0);
+                }
             }
-            else {
-                const seed = secret + Math.floor(Date.now() / 1000 / accountRotation).toString();
-                const rand = new Uint32Array(await crypto.subtle.digest('SHA-256', str2buf(seed)))[0];
-                for (let i = rand % accounts.length, j = 0; j < accountCandidates; i = (i + 1) % accounts.length, ++j) {
-                    candidates.push(accounts[i]);
+            this.accountPool = pool && pool.length > 0 ? pool : undefined;
+        }
+        // poolOf returns the indexes of the accounts serving drive, undefined when
+        // every account does
+        poolOf(drive) {
+            return drive !== undefined ? this.config.accountDrives[drive] : undefined;
+        }
+        // poolDriveOf returns the drive of a file or folder when accounts are pooled
+        // by drive, to pick accounts from its pool
+        async poolDriveOf(id) {
+            return Object.keys(this.config.accountDrives).length > 0 ? this.driveOf(id) : undefined;
+        }
+        // driveOf finds the shared drive of a file or folder, usually with a single
+        // request, remembering it for the next requests.
+        async driveOf(id) {
+            const { accountDrives } = this.config;
+            if (id in accountDrives) {
+                return id;
+            }
+            if (!(id in driveCache)) {
+                const url = new URL(`https://www.googleapis.com/drive/v3/files/${id}`);
+                url.searchParams.set('supportsAllDrives', 'true');
+                url.searchParams.set('fields', 'driveId');
+                // accounts outside the pool of the drive cannot see the file, so
+                // an account of each pool is asked in turn until one can
+                const pools = [this.accountPool];
+                for (const drive of Object.keys(accountDrives).sort()) {
+                    if (!pools.some((pool) => pool !== undefined && pool.join() === accountDrives[drive].join())) {
+                        pools.push(accountDrives[drive]);
+                    }
                 }
+                let response;
+                for (const pool of pools) {
+                    response = await fetch(url.toString(), {
+                        headers: {
+                            Authorization: `Bearer ${await this.accessToken(await this.pickAccount(pool))}`,
+                        },
+                    });
+                    if (response.status !== 404) {
+                        break;
+                    }
+                }
+                // failures are not remembered, as they may be transient
+                if (!response || !response.ok) {
+                    return undefined;
+                }
+                if (driveCacheSize >= DRIVE_CACHE_SIZE) {
+                    Object.keys(driveCache).forEach((key) => delete driveCache[key]);
+                    driveCacheSize = 0;
+                }
+                driveCache[id] = (await response.json()).driveId || null;
+                driveCacheSize++;
             }
-            const account = candidates[Math.floor(Math.random() * candidates.length)];
+            return driveCache[id] || undefined;
+        }
+        async pickAccount(pool = this.accountPool) {
+            const account = this.config.accounts[await this.pickAccountIndex(pool)];
             if (typeof account === 'string') {
                 const ciphertext = await (await fetch(account)).arrayBuffer();
                 const plaintext = buf2str(await this.decrypt('account', ciphertext));
@@ -343,6 +464,46 @@
                 return account;
             }
         }
+        async pickAccountIndex(pool) {
+            const { config: { secret, accounts, accountRotation, accountCandidates, accountStrategy, accountWeights }, } = this;
+            if (pool === undefined) {
+                pool = [];
+                for (let i = 0; i < accounts.length; ++i) {
+                    pool.push(i);
+                }
+            }
+            switch (accountStrategy) {
+                case 'shuffle':
+                    return pool[Math.floor(Math.random() * pool.length)];
+                case 'weighted': {
+                    const total = pool.reduce((sum, i) => sum + (accountWeights[i] || 0), 0);
+                    if (total > 0) {
+                        let r = Math.random() * total;
+                        for (const i of pool) {
+                            r -= accountWeights[i] || 0;
+                            if (r < 0) {
+                                return i;
+                            }
+                        }
+                    }
+                    return pool[Math.floor(Math.random() * pool.length)];
+                }
+            }
+            const candidates = [];
+            if (pool.length <= accountCandidates) {
+                candidates.push(...pool);
+            }
+            else {
+                const seed = accountStrategy === 'sticky' && this.userName !== undefined
+                    ? secret + ':sticky:' + this.userName
+                    : secret + Math.floor(Date.now() / 1000 / accountRotation).toString();
+                const rand = new Uint32Array(await crypto.subtle.digest('SHA-256', str2buf(seed)))[0];
+                for (let i = rand % pool.length, j = 0; j < accountCandidates; i = (i + 1) % pool.length, ++j) {
+                    candidates.push(pool[i]);
+                }
+            }
+            return candidates[Math.floor(Math.random() * candidates.length)];
+        }
         async accessToken(account) {
             if (account.expires == undefined || account.expires < Date.now()) {
                 let token;
@@ -432,6 +593,289 @@
         }
     }
 
+    const TOTP_DIGITS = 6;
+    const TOTP_PERIOD = 30;
+    const TOTP_SKEW = 1;
+    async function totpCode(secret, counter) {
+        const key = await crypto.subtle.importKey('raw', base32.decode(secret), { name: 'HMAC', hash: 'SHA-1' }, false, ['sign']);
+        const msg = new DataView(new ArrayBuffer(8));
+        msg.setUint32(0, Math.floor(counter / 0x100000000));
+        msg.setUint32(4, counter >>> 0);
+        const sum = new DataView(await crypto.subtle.sign('HMAC', key, msg.buffer));
+        const offset = sum.getUint8(sum.byteLength - 1) & 0xf;
+        const value = (sum.getUint32(offset) & 0x7fffffff) % 10 ** TOTP_DIGITS;
+        return value.toString().padStart(TOTP_DIGITS, '0');
+    }
+    // verifyTOTP checks a one-time code, allowing TOTP_SKEW steps of clock drift.
+    async function verifyTOTP(secret, code) {
+        const counter = Math.floor(Date.now() / 1000 / TOTP_PERIOD);
+        for (let i = -TOTP_SKEW; i <= TOTP_SKEW; ++i) {
+            if ((await totpCode(secret, counter + i)) === code) {
+                return true;
+            }
+        }
+        return false;
+    }
+    // the worker cannot write the users Gist, so the backup codes it accepts are
+    // remembered in the isolate and in the cache of the data center instead
+    const spentBackupCodes = new Set();
+    const SPENT_BACKUP_CODE_TTL = 365 * 24 * 3600;
+    function spentBackupCodeRequest(hash) {
+        return new Request('https://gdir.invalid/spent-backup-codes/' + hash);
+    }
+    // verifyBackupCode checks code against the hashed backup codes generated by gdir,
+    // accepting each code once.
+    async function verifyBackupCode(appSecret, hashes, code) {
+        const hash = buf2hex(await crypto.subtle.digest('SHA-256', str2buf(appSecret + ':totp-backup:' + code.trim().toLowerCase())));
+        if (hashes.indexOf(hash) < 0 || spentBackupCodes.has(hash)) {
+            return false;
+        }
+        spentBackupCodes.add(hash);
+        if (await caches.default.match(spentBackupCodeRequest(hash))) {
+            return false;
+        }
+        await caches.default.put(spentBackupCodeRequest(hash), new Response('', { headers: { 'Cache-Control': `max-age=${SPENT_BACKUP_CODE_TTL}` } }));
+        return true;
+    }
+
+    // give up walking parents beyond this depth
+    const MAX_FOLDER_DEPTH = 64;
+    // stop walking the parents of search results after this many lookups, to stay
+    // within the subrequest limit of workers
+    const MAX_SEARCH_LOOKUPS = 25;
+    // FolderACL restricts a user with a folders_allow_list to the subtrees of those
+    // folders, plus the drives in its drives_white_list, by walking up parents.
+    class FolderACL {
+        constructor(gd, user) {
+            this.gd = gd;
+            this.user = user;
+            this.cache = {};
+            this.accounts = {};
+            this.lookups = 0;
+        }
+        get enabled() {
+            return !!this.user && !!this.user.folders_allow_list && this.user.folders_allow_list.length > 0;
+        }
+        isRoot(id) {
+            if (!this.enabled) {
+                return false;
+            }
+            const { folders_allow_list, drives_white_list } = this.user;
+            return (folders_allow_list.indexOf(id) >= 0 ||
+                (drives_white_list != null && drives_white_list.indexOf(id) >= 0));
+        }
+        // allowed walks up the parents of id with an account of the pool of its
+        // drive, found from id unless parents are given.
+        async allowed(id, parents, depth = 0, drive) {
+            if (!this.enabled || this.isRoot(id)) {
+                return true;
+            }
+            if (depth >= MAX_FOLDER_DEPTH) {
+                return false;
+            }
+            if (!(id in this.cache)) {
+                this.cache[id] = (async () => {
+                    if (parents == null) {
+                        if (depth === 0) {
+                            drive = await this.gd.poolDriveOf(id);
+                        }
+                        this.lookups++;
+                        parents = await this.gd.parents(await this.pickAccount(drive), id);
+                    }
+                    for (const parent of parents) {
+                        if (await this.allowed(parent, undefined, depth + 1, drive)) {
+                            return true;
+                        }
+                    }
+                    return false;
+                })();
+            }
+            return this.cache[id];
+        }
+        // filter keeps the search results allowed to the user. It walks them one at
+        // a time, so that siblings find their parents cached, and drops the rest of
+        // the results once MAX_SEARCH_LOOKUPS parents were looked up.
+        async filter(files) {
+            if (!this.enabled) {
+                return files;
+            }
+            const allowed = [];
+            for (const file of files) {
+                if (this.lookups >= MAX_SEARCH_LOOKUPS) {
+                    break;
+                }
+                if (await this.allowed(file.id, file.parents || [])) {
+                    allowed.push(file);
+                }
+            }
+            return allowed;
+        }
+        // rootFolders returns the metadata of the allowed folders, detached from
+        // their parents so that the breadcrumbs stop there.
+        async rootFolders() {
+            if (!this.folders) {
+                this.folders = (async () => {
+                    const files = await Promise.all(this.user.folders_allow_list.map(async (id) => this.gd.file(await this.pickAccount(await this.gd.poolDriveOf(id)), id)));
+                    return files
+                        .filter((file) => file && !file.error)
+                        .map((file) => {
+                        delete file.parents;
+                        return file;
+                    });
+                })();
+            }
+            return this.folders;
+        }
+        // searchDrives returns the drives to search in: the drives_white_list and
+        // the shared drives of the allowed folders, as folders outside of shared
+        // drives are not served.
+        async searchDrives() {
+            const drives = [...(this.user.drives_white_list || [])];
+            for (const folder of await this.rootFolders()) {
+                if (folder.driveId && drives.indexOf(folder.driveId) < 0) {
+                    drives.push(folder.driveId);
+                }
+            }
+            return drives;
+        }
+        // pickAccount picks an account of the pool of drive, or of the current pool
+        // when the drive is unknown, once per request
+        pickAccount(drive) {
+            const key = drive || '';
+            if (!(key in this.accounts)) {
+                this.accounts[key] = this.gd.pickAccount(this.gd.poolOf(drive));
+            }
+            return this.accounts[key];
+        }
+    }
+
+    const FOLDER_MIME_TYPE = 'application/vnd.google-apps.folder';
+    // keep fetched index files this long, so that redeployed indexes show up
+    const INDEX_TTL = 5 * 60 * 1000;
+    const cache = {};
+    // SearchIndex searches the index built by "gdir index build", which lists the
+    // names and paths of the files of each shared drive.
+    class SearchIndex {
+        constructor(gd, indexURL) {
+            this.gd = gd;
+            this.indexURL = indexURL;
+        }
+        async enabled() {
+            return !!(await this.indexURL(''));
+        }
+        async fetch(drive) {
+            const url = await this.indexURL(drive);
+            const now = Date.now();
+            if (!cache[url] || cache[url].expires < now) {
+                cache[url] = {
+                    expires: now + INDEX_TTL,
+                    data: (async () => {
+                        const resp = await fetch(url);
+                        if (!resp.ok) {
+                            throw new Error(`index of ${drive || 'drives'} unavailable: ${resp.status}`);
+                        }
+                        const data = JSON.parse(new TextDecoder().decode(await this.gd.decrypt('index', await resp.arrayBuffer())));
+                        if (data.v !== 1) {
+                            throw new Error(`unsupported index version ${data.v}`);
+                        }
+                        return data;
+                    })(),
+                };
+                // failures are retried on the next request
+                cache[url].data.catch(() => delete cache[url]);
+            }
+            return cache[url].data;
+        }
+        async manifest() {
+            return this.fetch('');
+        }
+        async shard(drive) {
+            const shard = await this.fetch(drive);
+            if (!shard.folderNames) {
+                shard.folderNames = shard.folders.map((folder) => folder[1].toLowerCase());
+                shard.fileNames = shard.files.map((file) => file[1].toLowerCase());
+            }
+            return shard;
+        }
+        // search returns up to limit folders and files of drives with every term
+        // of query in their names, leaving out those the ACL does not allow.
+        async search(query, drives, acl, limit) {
+            const terms = query
+                .toLowerCase()
+                .split(/\s+/)
+                .filter((term) => term);
+            const matches = [];
+            if (terms.length === 0) {
+                return matches;
+            }
+            // shards are loaded one at a time, until enough matches are found
+            for (const drive of drives) {
+                if (matches.length >= limit) {
+                    break;
+                }
+                const shard = await this.shard(drive);
+                const paths = {};
+                const path = (i) => {
+                    if (!(i in paths)) {
+                        const names = [];
+                        // bounded by the number of folders, in case of cycles
+                        for (let j = i, n = 0; j >= 0 && j < shard.folders.length && n <= shard.folders.length; n++) {
+                            names.unshift(shard.folders[j][1]);
+                            j = shard.folders[j][2];
+                        }
+                        paths[i] = names.length > 0 ? '/' + names.join('/') : '';
+                    }
+                    return paths[i];
+                };
+                const allowed = (id, i) => {
+                    if (!acl.enabled || acl.isRoot(id)) {
+                        return true;
+                    }
+                    for (let n = 0; i >= 0 && i < shard.folders.length && n <= shard.folders.length; n++) {
+                        if (acl.isRoot(shard.folders[i][0])) {
+                            return true;
+                        }
+                        i = shard.folders[i][2];
+                    }
+                    return false;
+                };
+                const parents = (i) => (i >= 0 ? [shard.folders[i][0]] : []);
+                const match = (name) => terms.every((term) => name.indexOf(term) >= 0);
+                for (let i = 1; i < shard.folders.length && matches.length < limit; i++) {
+                    const [id, name, parent] = shard.folders[i];
+                    if (match(shard.folderNames[i]) && allowed(id, parent)) {
+                        matches.push({
+                            id,
+                            name,
+                            mimeType: FOLDER_MIME_TYPE,
+                            parents: parents(parent),
+                            driveId: shard.drive,
+                            path: path(i),
+                        });
+                    }
+                }
+                for (let i = 0; i < shard.files.length && matches.length < limit; i++) {
+                    const [id, name, folder, size, mimeType] = shard.files[i];
+                    if (match(shard.fileNames[i]) && allowed(id, folder)) {
+                        matches.push({
+                            id,
+                            name,
+                            mimeType: shard.mimeTypes[mimeType],
+                            size: String(size),
+                            parents: parents(folder),
+                            driveId: shard.drive,
+                            path: path(folder) + '/' + name,
+                        });
+                    }
+                }
+            }
+            return matches;
+        }
+    }
+
+    // lifetime of scoped tokens, by default and at most, in seconds
+    const SCOPED_TOKEN_TTL = 7 * 24 * 3600;
+    const SCOPED_TOKEN_MAX_TTL = 30 * 24 * 3600;
     async function handleRequest(request) {
         try {
             const gd = new GoogleDrive(config);
@@ -439,6 +883,8 @@
             const params = url.searchParams;
             const { method, headers } = request;
             let user;
+            // the folder or file a scoped token is restricted to
+            let scope;
             let form;
             let cookie = {};
             if (method === 'POST' && headers.has('Content-Type') && headers.get('Content-Type') !== '') {
@@ -450,27 +896,53 @@
             {
                 const t = getParam('t', form, params, cookie);
                 if (t) {
-                    user = JSON.parse(buf2str(await gd.decrypt('userToken', base64.RAWURL.decode(t))));
+                    if (t.startsWith('s.')) {
+                        // scoped tokens only download files under their scope until they expire
+                        const claims = JSON.parse(buf2str(await gd.decrypt('scopedToken', base64.RAWURL.decode(t.slice(2)))));
+                        if (claims &&
+                            typeof claims.scope === 'string' &&
+                            claims.exp > Date.now() / 1000 &&
+                            url.pathname.startsWith('/file/')) {
+                            user = claims;
+                            scope = claims.scope;
+                        }
+                    }
+                    else {
+                        user = JSON.parse(buf2str(await gd.decrypt('userToken', base64.RAWURL.decode(t))));
+                    }
                     if (!user || typeof user.name !== 'string' || typeof user.pass !== 'string') {
                         user = undefined;
                     }
                     else {
                         const userData = await gd.getUser(user.name);
-                        if (user.name !== userData.name || user.pass !== userData.pass) {
+                        if (!userData ||
+                            user.name !== userData.name ||
+                            user.pass !== userData.pass ||
+                            !activeUser(userData)) {
                             user = undefined;
                         }
                         else {
                             user = userData;
+                            gd.userName = user.name;
                         }
                     }
                 }
             }
+            const acl = new FolderACL(gd, user);
+            const scopeACL = user && scope !== undefined
+                ? new FolderACL(gd, { ...user, folders_allow_list: [scope], drives_white_list: [] })
+                : undefined;
             if (url.pathname === '/login') {
                 const name = getParam('name', form, params);
                 const pass = getParam('pass', form, params);
+                const code = getParam('code', form, params) || '';
                 if (name && name !== '') {
                     const user = await gd.getUser(name);
-                    if (user && user.name === name && user.pass === pass) {
+                    if (user &&
+                        user.name === name &&
+                        user.pass === pass &&
+                        activeUser(user) &&
+                        (await validCodeForUser(code, user))) {
                         const t = base64.RAWURL.encode(await gd.encrypt('userToken', JSON.stringify(user, ['name', 'pass'])));
                         return new Response(null, {
                             status: 307,
@@ -488,23 +960,38 @@
                     },
                 });
             }
-            if (url.pathname === '/api/list' && user) {
+            if (url.pathname === '/api/list' && user && hasCapability(user, 'list')) {
                 const parent = getParam('parent', form, params);
                 const orderBy = getParam('orderBy', form, params);
                 const pageToken = getParam('pageToken', form, params);
-                if (!parent || validDriveForUser(parent, user)) {
+                if (!parent || (validDriveForUser(parent, user) && (await acl.allowed(parent)))) {
+                    if (parent) {
+                        gd.usePoolOf([await gd.poolDriveOf(parent)]);
+                    }
                     const fileList = await gd.ls(null, parent, orderBy, pageToken);
                     if (fileList && fileList.drives != null) {
-                        fileList.drives = fileList.drives.filter((drive) => validDriveForUser(drive.id, user, !parent));
+                        fileList.drives = fileList.drives.filter((drive) => validDriveForUser(drive.id, user, !parent) &&
+                            (!!parent || !acl.enabled || acl.isRoot(drive.id)));
+                    }
+                    if (fileList && !parent && !pageToken && acl.enabled) {
+                        fileList.files = await acl.rootFolders();
                     }
                     return new Response(JSON.stringify(fileList), { headers: { 'Content-Type': 'application/json' } });
                 }
             }
-            if (url.pathname === '/api/search' && user) {
+            if (url.pathname === '/api/search' && user && hasCapability(user, 'search')) {
                 const query = getParam('q', form, params) || '';
                 const encrypted_page_token = getParam('pageToken', form, params);
                 const drives = [];
-                if (user.drives_black_list && user.drives_black_list.length > 0) {
+                if (acl.enabled) {
+                    drives.push(...(await acl.searchDrives()));
+                    if (drives.length === 0) {
+                        return new Response(JSON.stringify({ files: [] }), {
+                            headers: { 'Content-Type': 'application/json' },
+                        });
+                    }
+                }
+                else if (user.drives_black_list && user.drives_black_list.length > 0) {
                     ((await gd.ls()).drives || []).forEach((drive) => {
                         user.drives_black_list.indexOf(drive.id) < 0 && drives.push(drive.id);
                     });
@@ -512,43 +999,97 @@
                 else if (user.drives_white_list && user.drives_white_list.length > 0) {
                     drives.push(...user.drives_white_list);
                 }
+                gd.usePoolOf(drives);
                 const fileList = await gd.search(null, { query, drives, encrypted_page_token });
+                if (fileList && fileList.files) {
+                    fileList.files = await acl.filter(fileList.files);
+                }
                 return new Response(JSON.stringify(fileList), { headers: { 'Content-Type': 'application/json' } });
             }
-            if (url.pathname === '/api/file' && user) {
+            if (url.pathname === '/api/indexSearch' && user && hasCapability(user, 'search')) {
+                const index = new SearchIndex(gd, config.indexURL);
+                if (!(await index.enabled())) {
+                    return new Response('no search index deployed', { status: 503 });
+                }
+                const query = getParam('q', form, params) || '';
+                const limit = Math.min(Number(getParam('limit', form, params)) || 100, 1000);
+                let drives = (await index.manifest()).drives
+                    .map((drive) => drive.id)
+                    .filter((drive) => validDriveForUser(drive, user, !acl.enabled));
+                if (acl.enabled) {
+                    const searchDrives = await acl.searchDrives();
+                    drives = drives.filter((drive) => searchDrives.indexOf(drive) >= 0);
+                }
+                const files = await index.search(query, drives, acl, limit);
+                return new Response(JSON.stringify({ files }), { headers: { 'Content-Type': 'application/json' } });
+            }
+            if (url.pathname === '/api/file' && user && hasCapability(user, 'list')) {
                 const id = getParam('id', form, params);
-                if (!id || validDriveForUser(id, user)) {
+                if (!id || (validDriveForUser(id, user) && (await acl.allowed(id)))) {
+                    if (id) {
+                        gd.usePoolOf([await gd.poolDriveOf(id)]);
+                    }
                     const file = await gd.file(null, id);
                     if (file &&
                         (file.parents == null ||
                             file.parents.every((parent) => validDriveForUser(parent, user)))) {
+                        if (acl.isRoot(file.id)) {
+                            delete file.parents;
+                        }
                         return new Response(JSON.stringify(file), { headers: { 'Content-Type': 'application/json' } });
                     }
                 }
             }
-            if (url.pathname === '/api/copyFileInit' && user) {
+            if (url.pathname === '/api/copyFileInit' && user && hasCapability(user, 'copy')) {
                 const src = getParam('src', form, params);
                 const dst = getParam('dst', form, params);
-                if (src && dst) {
+                if (src &&
+                    dst &&
+                    (await acl.allowed(src)) &&
+                    (await validTargetForUser(gd, acl, dst, user)) &&
+                    (await acl.allowed(dst))) {
+                    gd.usePoolOf([await gd.poolDriveOf(src), await gd.poolDriveOf(dst)]);
                     return gd.copyFileInit(null, src, dst);
                 }
             }
-            if (url.pathname === '/api/copyFileExec' && user) {
+            if (url.pathname === '/api/copyFileExec' && user && hasCapability(user, 'copy')) {
                 const src = getParam('src', form, params);
                 const token = getParam('token', form, params);
-                if (src && token) {
+                if (src && token && (await acl.allowed(src))) {
+                    gd.usePoolOf([await gd.poolDriveOf(src)]);
                     return gd.copyFileExec(null, src, token);
                 }
             }
-            if (url.pathname === '/api/copyFileStat' && user) {
+            if (url.pathname === '/api/copyFileStat' && user && hasCapability(user, 'copy')) {
                 const token = getParam('token', form, params);
                 if (token) {
                     return gd.copyFileStat(null, token);
                 }
             }
-            if (url.pathname.startsWith('/file/') && user) {
+            if (url.pathname === '/api/mkdir' && user && hasCapability(user, 'copy')) {
+                const parent = getParam('parent', form, params);
+                const name = getParam('name', form, params);
+                if (parent && name && (await validTargetForUser(gd, acl, parent, user)) && (await acl.allowed(parent))) {
+                    gd.usePoolOf([await gd.poolDriveOf(parent)]);
+                    return gd.mkdir(null, parent, name);
+                }
+            }
+            if (url.pathname === '/api/scopedToken' && user && hasCapability(user, 'download')) {
+                const id = getParam('scope', form, params);
+                const ttl = Math.min(Number(getParam('ttl', form, params)) || SCOPED_TOKEN_TTL, SCOPED_TOKEN_MAX_TTL);
+                if (id && (await validTargetForUser(gd, acl, id, user)) && (await acl.allowed(id))) {
+                    const exp = Math.floor(Date.now() / 1000) + ttl;
+                    const token = 's.' +
+                        base64.RAWURL.encode(await gd.encrypt('scopedToken', JSON.stringify({ name: user.name, pass: user.pass, scope: id, exp })));
+                    return new Response(JSON.stringify({ token, expires: exp }), {
+                        headers: { 'Content-Type': 'application/json' },
+                    });
+                }
+            }
+            if (url.pathname.startsWith('/file/') && user && hasCapability(user, 'download')) {
                 const m = url.pathname.match(/^\/file\/([^\/]+)/);
-                if (m) {
+                if (m && (await acl.allowed(m[1])) && (!scopeACL || (await scopeACL.allowed(m[1])))) {
+                    gd.usePoolOf([await gd.poolDriveOf(m[1])]);
                     const fileID = m[1];
                     return gd.download(null, fileID, headers.get('Range') || undefined);
                 }
@@ -573,6 +1114,7 @@
                     headers.set('Content-Type', 'image/x-icon');
                 }
                 return new Response(response.body, {
+                    status: response.status,
                     headers,
                 });
             }
@@ -590,6 +1132,34 @@
         }
         return true;
     }
+    // validTargetForUser checks the drive of a file or folder against the drive lists
+    // of the user, unless folder-level access control restricts the user instead
+    async function validTargetForUser(gd, acl, id, user) {
+        return acl.enabled || validDriveForUser((await gd.driveOf(id)) || id, user, true);
+    }
+    // users without recorded capabilities keep the full access they had before
+    function hasCapability(user, capability) {
+        return !user.capabilities || user.capabilities.length === 0 || user.capabilities.indexOf(capability) >= 0;
+    }
+    function activeUser(user) {
+        if (user.disabled) {
+            return false;
+        }
+        if (user.expires_at && user.expires_at * 1000 <= Date.now()) {
+            return false;
+        }
+        return true;
+    }
+    async function validCodeForUser(code, user) {
+        if (!user.totp_secret) {
+            return true;
+        }
+        if (code === '') {
+            return false;
+        }
+        return ((await verifyTOTP(user.totp_secret, code)) ||
+            (await verifyBackupCode(config.secret, user.totp_backup_codes || [], code)));
+    }
     function getParam(key, form, params, cookie) {
         let val;
         if (form && form.has(key)) {
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func accountsCommand(args []string) error {
+	return runSubcommand("accounts", map[string]func([]string) error{
+		"add-user-oauth": accountsAddUserOAuth,
+		"audit":          accountsAudit,
+		"drives":         accountsDrives,
+		"grant":          accountsGrant,
+		"import-rclone":  accountsImportRclone,
+		"remove":         accountsRemove,
+		"tag":            accountsTag,
+	}, args)
+}
+
+func accountsTag(args []string) (err error) {
+	fs := newFlagSet("accounts tag", "[<account file> [tags]]")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	switch fs.NArg() {
+	case 0:
+		core.ListAccountTags()
+		return
+	case 1, 2:
+		return core.SetAccountTags(fs.Arg(0), core.ParseAccountTags(fs.Arg(1)))
+	}
+	fs.Usage()
+	return fmt.Errorf("expected an account file under accounts/ and a comma separated list of tags")
+}
+
+func accountsDrives(args []string) (err error) {
+	var drives []string
+
+	fs := newFlagSet("accounts drives", "[<account file> [drive IDs]]")
+	probe := fs.Bool("probe", false, "probe every account and record the drives it can reach")
+	all := fs.Bool("all", false, "with -probe, probe every drive visible to any account instead of the drives referenced by users")
+	parallel := fs.Int("j", 8, "number of accounts to probe in parallel")
+	noDeploy := fs.Bool("no-deploy", false, "do not redeploy the worker")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	switch {
+	case *probe:
+		var accounts []*core.Account
+		var result *core.AuditResult
+		if accounts, err = core.LoadAccounts(); err != nil {
+			return
+		}
+		if *all {
+			drives, err = core.VisibleDrives(accounts, *parallel)
+		} else {
+			drives, err = core.ReferencedDrives()
+		}
+		if err != nil {
+			return
+		}
+		if len(drives) == 0 {
+			return fmt.Errorf("no shared drives to probe")
+		}
+		if result, err = core.ProbeAccountDrives(accounts, drives, *parallel); err != nil {
+			return
+		}
+		result.Print()
+	case fs.NArg() == 0:
+		return core.PrintAccountDrives()
+	case fs.NArg() <= 2:
+		if drives, err = core.ParseDriveIDs(fs.Arg(1)); err != nil {
+			return
+		}
+		if err = core.SetAccountDrives(fs.Arg(0), drives); err != nil {
+			return
+		}
+	default:
+		fs.Usage()
+		return fmt.Errorf("expected an account file under accounts/ and a comma separated list of drive IDs")
+	}
+
+	if *noDeploy {
+		return
+	}
+	return deployWorker()
+}
+
+func accountsRemove(args []string) (err error) {
+	fs := newFlagSet("accounts remove", "<account file>")
+	noDeploy := fs.Bool("no-deploy", false, "do not deploy the accounts gist and the worker")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected an account file under accounts/")
+	}
+
+	if err = core.RemoveAccount(fs.Arg(0)); err != nil {
+		return
+	}
+	fmt.Printf("Removed account %s, the pool now has %d accounts.\n", fs.Arg(0), core.Config.AccountsCount)
+
+	if *noDeploy {
+		return
+	}
+	return deployAccounts()
+}
+
+func accountsAudit(args []string) (err error) {
+	var accounts []*core.Account
+	var drives []string
+
+	fs := newFlagSet("accounts audit", "")
+	all := fs.Bool("all", false, "audit every drive visible to any account instead of the drives referenced by users")
+	parallel := fs.Int("j", 8, "number of accounts to audit in parallel")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	if accounts, err = core.LoadAccounts(); err != nil {
+		return
+	}
+
+	if *all {
+		drives, err = core.VisibleDrives(accounts, *parallel)
+	} else {
+		drives, err = core.ReferencedDrives()
+	}
+	if err != nil {
+		return
+	}
+	if len(drives) == 0 {
+		return fmt.Errorf("no shared drives to audit")
+	}
+
+	core.AuditAccounts(accounts, drives, *parallel).Print()
+	return
+}
+
+func accountsGrant(args []string) (err error) {
+	var admin core.Account
+	var grantees []string
+	var result core.GrantResult
+
+	fs := newFlagSet("accounts grant", "")
+	drive := fs.String("drive", "", "ID of the shared drive to grant access to")
+	role := fs.String("role", "fileOrganizer", "role to grant, reader or fileOrganizer")
+	adminPath := fs.String("admin", "", "path to the JSON of an account managing the drive, either a user OAuth JSON or a service account")
+	group := fs.String("group", "", "grant to this group address instead of every service account in the pool")
+	dryRun := fs.Bool("dry-run", false, "only show what would be granted")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	if *drive == "" || *adminPath == "" {
+		fs.Usage()
+		return fmt.Errorf("both -drive and -admin are required")
+	}
+	if err = core.ValidateDriveRole(*role); err != nil {
+		return
+	}
+	if err = core.ReadAccountJSON(*adminPath, &admin); err != nil {
+		return
+	}
+
+	granteeType := "user"
+	if *group != "" {
+		granteeType = "group"
+		grantees = []string{*group}
+	} else {
+		var accounts, skipped []*core.Account
+		if accounts, err = core.LoadAccounts(); err != nil {
+			return
+		}
+		grantees, skipped = core.PoolEmails(accounts)
+		for _, account := range skipped {
+			fmt.Printf("Skipping %s, it has no client email.\n", account.Label())
+		}
+	}
+
+	fmt.Printf("Granting %s on %s to %d %ss as %s:\n", *role, *drive, len(grantees), granteeType, admin.Label())
+	if result, err = core.GrantDriveAccess(&admin, *drive, *role, granteeType, grantees, *dryRun); err != nil {
+		return
+	}
+
+	verb := "granted"
+	if *dryRun {
+		verb = "to grant"
+	}
+	fmt.Printf("%d %s, %d already present, %d failed.\n", len(result.Granted), verb, len(result.Skipped), len(result.Failed))
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("%d permissions could not be created", len(result.Failed))
+	}
+	return
+}
+
+func accountsAddUserOAuth(args []string) (err error) {
+	var account *core.Account
+	var b []byte
+	var name string
+
+	fs := newFlagSet("accounts add-user-oauth", "")
+	clientID := fs.String("client-id", "", "OAuth client ID of a desktop app")
+	clientSecret := fs.String("client-secret", "", "OAuth client secret of the desktop app")
+	port := fs.Int("port", 0, "loopback port to receive the consent redirect on (default any free port)")
+	timeout := fs.Duration("timeout", 5*time.Minute, "how long to wait for the consent")
+	file := fs.String("name", "", "name of the JSON file written to the accounts JSON directory (default user-<timestamp>.json)")
+	noDeploy := fs.Bool("no-deploy", false, "do not deploy the accounts gist and the worker")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	if *clientID == "" || *clientSecret == "" {
+		fs.Usage()
+		return fmt.Errorf("both -client-id and -client-secret are required")
+	}
+
+	if account, err = core.AuthorizeUserAccount(*clientID, *clientSecret, *port, *timeout); err != nil {
+		return
+	}
+	if b, err = json.MarshalIndent(account, "", "  "); err != nil {
+		return
+	}
+
+	if *file == "" {
+		*file = fmt.Sprintf("user-%d.json", time.Now().Unix())
+	}
+	if name, err = core.ImportAccountJSON(*file, b); err != nil {
+		return
+	}
+	fmt.Printf("Wrote %s to %s and encrypted it as account %s, the pool now has %d accounts.\n", *file, core.Config.AccountsJSONDir, name, core.Config.AccountsCount)
+
+	if *noDeploy {
+		return
+	}
+	return deployAccounts()
+}
+
+func accountsImportRclone(args []string) (err error) {
+	var remotes []*core.RcloneRemote
+	var seen map[string]string
+	var added int
+
+	fs := newFlagSet("accounts import-rclone", "<path to rclone.conf>")
+	dryRun := fs.Bool("dry-run", false, "only show which remotes would be imported")
+	noDeploy := fs.Bool("no-deploy", false, "do not deploy the accounts gist and the worker")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected the path to rclone.conf")
+	}
+
+	if remotes, err = core.ParseRcloneConfig(fs.Arg(0)); err != nil {
+		return
+	}
+	if seen, err = core.PoolKeys(); err != nil {
+		return
+	}
+
+	for _, remote := range remotes {
+		var name string
+		if remote.Options["type"] != "drive" {
+			continue
+		}
+		account, b, e := core.RcloneAccount(remote)
+		if e != nil {
+			fmt.Printf("Skipping remote %s: %v\n", remote.Name, e)
+			continue
+		}
+		if dup, ok := seen[account.Key()]; ok {
+			fmt.Printf("Skipping remote %s: same %s as %s\n", remote.Name, account.Type, dup)
+			continue
+		}
+		seen[account.Key()] = "remote " + remote.Name
+		if *dryRun {
+			fmt.Printf("Would import remote %s as %s %s\n", remote.Name, account.Type, account.Label())
+			added++
+			continue
+		}
+		if name, err = core.ImportAccountJSON("rclone-"+remote.Name+".json", b); err != nil {
+			return
+		}
+		fmt.Printf("Imported remote %s as account %s (%s)\n", remote.Name, name, account.Type)
+		added++
+	}
+
+	if *dryRun {
+		fmt.Printf("%d accounts would be imported.\n", added)
+		return
+	}
+	fmt.Printf("%d accounts imported, the pool now has %d accounts.\n", added, core.Config.AccountsCount)
+	if added == 0 || *noDeploy {
+		return
+	}
+	return deployAccounts()
+}
+
+// deployAccounts pushes the accounts gist and redeploys the worker, which
+// embeds the number of accounts.
+func deployAccounts() (err error) {
+	if err = core.DeployGist("accounts"); err != nil {
+		return
+	}
+	return deployWorker()
+}
+
+// deployWorker redeploys the worker after a change of its settings.
+func deployWorker() (err error) {
+	if err = core.InitCloudflareAPI(); err != nil {
+		return
+	}
+	if err = core.SelectCloudflareAccount(); err != nil {
+		return
+	}
+	if err = core.SetupCloudflareSubdomain(); err != nil {
+		return
+	}
+	return core.DeployWorker()
+}
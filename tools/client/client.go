@@ -0,0 +1,448 @@
+// Package client calls the API of a deployed gdir site, served either by the
+// Cloudflare worker or by gdir serve.
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FolderMimeType is the MIME type of Google Drive folders.
+const FolderMimeType = "application/vnd.google-apps.folder"
+
+// Client is a signed in session with a gdir site.
+type Client struct {
+	// URL is the base URL of the site, without trailing slash.
+	URL string
+	// Token is the login token, as the t cookie set by /login.
+	Token string
+	// HTTPClient sends the requests, http.DefaultClient when nil.
+	HTTPClient *http.Client
+}
+
+// File is a file, a folder or a shared drive as returned by the site.
+type File struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Kind         string    `json:"kind,omitempty"`
+	MimeType     string    `json:"mimeType,omitempty"`
+	Size         int64     `json:"size,string,omitempty"`
+	ModifiedTime time.Time `json:"modifiedTime,omitempty"`
+	Parents      []string  `json:"parents,omitempty"`
+	MD5Checksum  string    `json:"md5Checksum,omitempty"`
+	DriveID      string    `json:"driveId,omitempty"`
+	// Path is the path from the shared drive, set by IndexSearch, or from the
+	// exported folder, set by Export.
+	Path string `json:"path,omitempty"`
+}
+
+// IsFolder reports whether the file is a folder or a shared drive.
+func (f *File) IsFolder() bool {
+	return f.MimeType == FolderMimeType || f.Kind == "drive#drive"
+}
+
+// Drive is a shared drive listed at the root.
+type Drive struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Kind string `json:"kind,omitempty"`
+}
+
+// FileList is a page of files, or every page once collected by List and
+// Search.
+type FileList struct {
+	NextPageToken string  `json:"nextPageToken,omitempty"`
+	Files         []File  `json:"files,omitempty"`
+	Drives        []Drive `json:"drives,omitempty"`
+}
+
+// Range is an inclusive byte range of a download. End < 0 reads up to the
+// end of the file.
+type Range struct {
+	Start int64
+	End   int64
+}
+
+func (r Range) String() string {
+	if r.End < 0 {
+		return fmt.Sprintf("bytes=%d-", r.Start)
+	}
+	return fmt.Sprintf("bytes=%d-%d", r.Start, r.End)
+}
+
+// CopyJob is a server side copy started by CopyFileInit.
+type CopyJob struct {
+	File
+	Token string `json:"token"`
+}
+
+// Copy statuses reported by CopyFileStat.
+const (
+	CopyUploading = "uploading"
+	CopyUploaded  = "uploaded"
+	CopyExpired   = "expired"
+	CopyFailed    = "error"
+)
+
+// CopyStatus is the progress of a copy. File is set once uploaded.
+type CopyStatus struct {
+	File
+	Status   string `json:"status"`
+	Uploaded int64  `json:"uploaded,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// New returns a client of the site at siteURL, not signed in yet.
+func New(siteURL string) (c *Client, err error) {
+	var u *url.URL
+	if u, err = url.Parse(siteURL); err != nil {
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid site URL %q, expected http(s)://host", siteURL)
+	}
+	return &Client{URL: strings.TrimRight(u.Scheme+"://"+u.Host+u.Path, "/")}, nil
+}
+
+// NewWithToken returns a client of the site at siteURL signed in with token.
+func NewWithToken(siteURL string, token string) (c *Client, err error) {
+	if c, err = New(siteURL); err != nil {
+		return
+	}
+	c.Token = token
+	return
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Login signs in with name and password, and the two-factor code if the user
+// has one, keeping the issued token.
+func (c *Client) Login(name string, pass string, code string) (err error) {
+	form := url.Values{}
+	form.Set("name", name)
+	form.Set("pass", pass)
+	if code != "" {
+		form.Set("code", code)
+	}
+	hc := *c.httpClient()
+	hc.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	var resp *http.Response
+	if resp, err = hc.PostForm(c.URL+"/login", form); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode == http.StatusInternalServerError {
+		return &StatusError{Op: "login", StatusCode: resp.StatusCode}
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "t" && cookie.Value != "" && cookie.Value != "deleted" {
+			c.Token = cookie.Value
+			return
+		}
+	}
+	return ErrLoginFailed
+}
+
+// get sends a GET request signed in with the token.
+func (c *Client) get(path string, params url.Values, header http.Header) (resp *http.Response, err error) {
+	u := c.URL + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	var req *http.Request
+	if req, err = http.NewRequest("GET", u, nil); err != nil {
+		return
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if c.Token != "" {
+		req.AddCookie(&http.Cookie{Name: "t", Value: c.Token})
+	}
+	return c.httpClient().Do(req)
+}
+
+func isJSON(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// checkResponse turns the responses not coming from the API into errors. The
+// site falls back to its static pages when a request is denied. Older
+// workers answer some API calls without a JSON content type, so a body that
+// is JSON is accepted as well.
+func checkResponse(op string, resp *http.Response, body []byte) error {
+	if resp.StatusCode == http.StatusInternalServerError {
+		return &StatusError{Op: op, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+	if !isJSON(resp) && (body == nil || !json.Valid(body)) {
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 || resp.StatusCode == http.StatusNotFound {
+			return ErrDenied
+		}
+		return &StatusError{Op: op, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+	return nil
+}
+
+// call sends an API request and decodes the JSON response into out.
+func (c *Client) call(op string, path string, params url.Values, out interface{}) (err error) {
+	var resp *http.Response
+	if resp, err = c.get(path, params, nil); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var b []byte
+	if b, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	if err = checkResponse(op, resp, b); err != nil {
+		return
+	}
+	var apiErr struct {
+		Error *APIError `json:"error"`
+	}
+	if json.Unmarshal(b, &apiErr) == nil && apiErr.Error != nil {
+		apiErr.Error.Op = op
+		if apiErr.Error.Code == 0 {
+			apiErr.Error.Code = resp.StatusCode
+		}
+		return apiErr.Error
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &StatusError{Op: op, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+	}
+	if err = json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("%s: invalid response: %w", op, err)
+	}
+	return
+}
+
+// ListPage lists a page of the children of parent, or of the shared drives
+// and allowed folders when parent is empty. orderBy is passed to the Drive
+// API, the site's default order when empty.
+func (c *Client) ListPage(parent string, orderBy string, pageToken string) (list *FileList, err error) {
+	params := url.Values{}
+	if parent != "" {
+		params.Set("parent", parent)
+	}
+	if orderBy != "" {
+		params.Set("orderBy", orderBy)
+	}
+	if pageToken != "" {
+		params.Set("pageToken", pageToken)
+	}
+	list = new(FileList)
+	err = c.call("list", "/api/list", params, list)
+	return
+}
+
+// List lists every page of the children of parent, as ListPage.
+func (c *Client) List(parent string, orderBy string) (list *FileList, err error) {
+	list = new(FileList)
+	err = c.collect(list, func(pageToken string) (*FileList, error) {
+		return c.ListPage(parent, orderBy, pageToken)
+	})
+	return
+}
+
+// SearchPage searches a page of files by full text in the drives the user may
+// access.
+func (c *Client) SearchPage(query string, pageToken string) (list *FileList, err error) {
+	params := url.Values{}
+	params.Set("q", query)
+	if pageToken != "" {
+		params.Set("pageToken", pageToken)
+	}
+	list = new(FileList)
+	err = c.call("search", "/api/search", params, list)
+	return
+}
+
+// Search searches every page of files, as SearchPage.
+func (c *Client) Search(query string) (files []File, err error) {
+	list := new(FileList)
+	err = c.collect(list, func(pageToken string) (*FileList, error) {
+		return c.SearchPage(query, pageToken)
+	})
+	return list.Files, err
+}
+
+func (c *Client) collect(list *FileList, page func(pageToken string) (*FileList, error)) error {
+	pageToken := ""
+	for {
+		next, err := page(pageToken)
+		if err != nil {
+			return err
+		}
+		list.Files = append(list.Files, next.Files...)
+		list.Drives = append(list.Drives, next.Drives...)
+		if next.NextPageToken == "" {
+			return nil
+		}
+		pageToken = next.NextPageToken
+	}
+}
+
+// IndexSearch searches the names of the search index deployed with "gdir
+// index deploy", which is faster than Search and also returns paths, for up
+// to limit results.
+func (c *Client) IndexSearch(query string, limit int) (files []File, err error) {
+	params := url.Values{}
+	params.Set("q", query)
+	params.Set("limit", strconv.Itoa(limit))
+	var list FileList
+	if err = c.call("index search", "/api/indexSearch", params, &list); err != nil {
+		return
+	}
+	return list.Files, nil
+}
+
+// File returns the metadata of a file, a folder or a shared drive.
+func (c *Client) File(id string) (file *File, err error) {
+	params := url.Values{}
+	params.Set("id", id)
+	file = new(File)
+	err = c.call("file", "/api/file", params, file)
+	return
+}
+
+// Download returns the content of a file, or of the byte range r of it when r
+// is not nil.
+func (c *Client) Download(id string, r *Range) (body io.ReadCloser, err error) {
+	header := http.Header{}
+	if r != nil {
+		header.Set("Range", r.String())
+	}
+	var resp *http.Response
+	if resp, err = c.get("/file/"+url.PathEscape(id), nil, header); err != nil {
+		return
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK && (r == nil || r.Start == 0):
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusPartialContent && r != nil:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK:
+		// the whole file answers the range, leave it unread
+		resp.Body.Close()
+		return nil, &StatusError{Op: "download", StatusCode: resp.StatusCode, Message: "range " + r.String() + " ignored"}
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	var apiErr struct {
+		Error *APIError `json:"error"`
+	}
+	if isJSON(resp) && json.Unmarshal(b, &apiErr) == nil && apiErr.Error != nil {
+		apiErr.Error.Op = "download"
+		return nil, apiErr.Error
+	}
+	if err = checkResponse("download", resp, nil); err != nil {
+		return
+	}
+	return nil, &StatusError{Op: "download", StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+}
+
+// CopyFileInit starts a server side copy of the file src into the folder dst,
+// returning the upload token to pass to CopyFileExec and CopyFileStat.
+func (c *Client) CopyFileInit(src string, dst string) (job *CopyJob, err error) {
+	params := url.Values{}
+	params.Set("src", src)
+	params.Set("dst", dst)
+	job = new(CopyJob)
+	if err = c.call("copyFileInit", "/api/copyFileInit", params, job); err != nil {
+		return
+	}
+	if job.Token == "" {
+		return nil, &StatusError{Op: "copyFileInit", StatusCode: http.StatusOK, Message: "no upload token issued"}
+	}
+	return
+}
+
+// CopyFileExec uploads the content of src to the copy started with token,
+// returning the new file once done. A copy cut short, for example by the time
+// limits of the worker, goes on in the background; poll CopyFileStat. It
+// returns ErrCopyExpired when the upload session is gone, and the *APIError
+// when the source is.
+func (c *Client) CopyFileExec(src string, token string) (file *File, err error) {
+	params := url.Values{}
+	params.Set("src", src)
+	params.Set("token", token)
+	file = new(File)
+	if err = c.call("copyFileExec", "/api/copyFileExec", params, file); IsNotFound(err) {
+		// the upload session and the source both answer 404 when gone
+		if _, statErr := c.CopyFileStat(token); statErr == ErrCopyExpired {
+			return nil, ErrCopyExpired
+		}
+		return nil, err
+	}
+	return
+}
+
+// CopyFileStat returns the progress of the copy started with token. It
+// returns ErrCopyExpired once the upload session is gone, and a *CopyError
+// when the Drive API reports another problem.
+func (c *Client) CopyFileStat(token string) (status *CopyStatus, err error) {
+	params := url.Values{}
+	params.Set("token", token)
+	status = new(CopyStatus)
+	if err = c.call("copyFileStat", "/api/copyFileStat", params, status); err != nil {
+		return nil, err
+	}
+	switch status.Status {
+	case CopyExpired:
+		return nil, ErrCopyExpired
+	case CopyFailed:
+		return nil, &CopyError{Message: status.Message}
+	}
+	return
+}
+
+// Mkdir creates a folder named name in the folder parent.
+func (c *Client) Mkdir(parent string, name string) (folder *File, err error) {
+	params := url.Values{}
+	params.Set("parent", parent)
+	params.Set("name", name)
+	folder = new(File)
+	err = c.call("mkdir", "/api/mkdir", params, folder)
+	return
+}
+
+// ScopedToken returns a token downloading the files under the folder scope,
+// or the file scope itself, without signing in, until it expires. The site
+// picks its default lifetime when ttl is 0.
+func (c *Client) ScopedToken(scope string, ttl time.Duration) (token string, expires time.Time, err error) {
+	params := url.Values{}
+	params.Set("scope", scope)
+	if ttl > 0 {
+		params.Set("ttl", strconv.FormatInt(int64(ttl/time.Second), 10))
+	}
+	var result struct {
+		Token   string `json:"token"`
+		Expires int64  `json:"expires"`
+	}
+	if err = c.call("scoped token", "/api/scopedToken", params, &result); err != nil {
+		return
+	}
+	return result.Token, time.Unix(result.Expires, 0), nil
+}
+
+// FileURL returns the absolute download URL of a file, signed in with token.
+func (c *Client) FileURL(id string, name string, token string) string {
+	return c.URL + "/file/" + url.PathEscape(id) + "/" + url.PathEscape(name) + "?t=" + url.QueryEscape(token)
+}
@@ -0,0 +1,386 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPollInterval is the time between two copyFileStat calls of a Copier.
+const DefaultPollInterval = 5 * time.Second
+
+// stallPolls is the number of polls without progress after which a copy is
+// taken for dead and started over.
+const stallPolls = 12
+
+// Copier copies folder trees server side, file by file through the
+// copyFileInit, copyFileExec and copyFileStat API. It keeps a journal of the
+// folders created and the files copied so that an interrupted copy resumes
+// where it stopped.
+type Copier struct {
+	Client *Client
+	// Parallel is the number of files copied at once.
+	Parallel int
+	// Journal is the path of the journal file, none when empty.
+	Journal string
+	// PollInterval is the time between two polls of a copy in progress,
+	// DefaultPollInterval when 0.
+	PollInterval time.Duration
+	// Retries is the number of attempts of each file, 3 when 0.
+	Retries int
+	// Logf reports progress, nothing when nil.
+	Logf func(format string, args ...interface{})
+
+	mu      sync.Mutex
+	journal copyJournal
+	result  CopyResult
+}
+
+// CopyResult sums up a copy.
+type CopyResult struct {
+	Copied  int
+	Skipped int
+	Failed  int
+	// Bytes is the size of the files copied.
+	Bytes int64
+}
+
+// copyJournal is the resume state of a copy, keyed by source IDs.
+type copyJournal struct {
+	Src     string                `json:"src"`
+	Dst     string                `json:"dst"`
+	Folders map[string]string     `json:"folders"`
+	Files   map[string]*copyEntry `json:"files"`
+}
+
+// copyEntry is the journal of a file: the upload token of the copy in
+// progress, then the ID of the copy once done.
+type copyEntry struct {
+	Token string `json:"token,omitempty"`
+	ID    string `json:"id,omitempty"`
+}
+
+// copyTask is a file to copy into the folder dst.
+type copyTask struct {
+	file File
+	dst  string
+	path string
+}
+
+func (c *Copier) logf(format string, args ...interface{}) {
+	if c.Logf != nil {
+		c.Logf(format, args...)
+	}
+}
+
+// Copy copies the content of the folder src into the folder dst, or the file
+// src into dst. Folders already in dst are reused and files of the same name
+// and size are skipped. It returns an error summing up the files that failed.
+func (c *Copier) Copy(src string, dst string) (result CopyResult, err error) {
+	if err = c.loadJournal(src, dst); err != nil {
+		return
+	}
+	var file *File
+	if file, err = c.Client.File(src); err != nil {
+		return
+	}
+
+	parallel := c.Parallel
+	if parallel <= 0 {
+		parallel = 1
+	}
+	tasks := make(chan copyTask)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				c.copyFile(task)
+			}
+		}()
+	}
+
+	if file.IsFolder() {
+		err = c.walk(src, dst, "", false, tasks)
+	} else {
+		var existing *FileList
+		if existing, err = c.Client.List(dst, ""); err == nil {
+			c.plan(*file, dst, file.Name, existing.Files, tasks)
+		}
+	}
+	close(tasks)
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result = c.result
+	if err != nil {
+		return
+	}
+	if result.Failed > 0 {
+		return result, fmt.Errorf("%d of %d files failed, run the command again to resume", result.Failed, result.Copied+result.Skipped+result.Failed)
+	}
+	if c.Journal != "" {
+		os.Remove(c.Journal)
+	}
+	return
+}
+
+// loadJournal resumes the journal of a copy of src into dst, if any.
+func (c *Copier) loadJournal(src string, dst string) (err error) {
+	c.journal = copyJournal{Src: src, Dst: dst, Folders: map[string]string{}, Files: map[string]*copyEntry{}}
+	if c.Journal == "" {
+		return
+	}
+	var b []byte
+	if b, err = ioutil.ReadFile(c.Journal); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	var saved copyJournal
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return fmt.Errorf("invalid journal %s: %w", c.Journal, err)
+	}
+	if saved.Src != src || saved.Dst != dst {
+		return fmt.Errorf("journal %s is of a copy of %s into %s", c.Journal, saved.Src, saved.Dst)
+	}
+	if saved.Folders != nil {
+		c.journal.Folders = saved.Folders
+	}
+	if saved.Files != nil {
+		c.journal.Files = saved.Files
+	}
+	c.logf("Resuming from %s: %d folders and %d files recorded\n", c.Journal, len(c.journal.Folders), len(c.journal.Files))
+	return
+}
+
+// saveJournal writes the journal, with c.mu held.
+func (c *Copier) saveJournal() {
+	if c.Journal == "" {
+		return
+	}
+	b, err := json.Marshal(c.journal)
+	if err == nil {
+		tmp := c.Journal + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, c.Journal)
+		}
+	}
+	if err != nil {
+		c.logf("Failed to save journal %s: %v\n", c.Journal, err)
+	}
+}
+
+// entry returns the journal of the file id, with c.mu held.
+func (c *Copier) entry(id string) *copyEntry {
+	e := c.journal.Files[id]
+	if e == nil {
+		e = new(copyEntry)
+		c.journal.Files[id] = e
+	}
+	return e
+}
+
+// walk copies the children of the folder src into the folder dst. fresh
+// tells that dst was just created, and so is empty.
+func (c *Copier) walk(src string, dst string, dir string, fresh bool, tasks chan<- copyTask) (err error) {
+	var list *FileList
+	if list, err = c.Client.List(src, ""); err != nil {
+		return fmt.Errorf("failed to list %s: %w", "/"+dir, err)
+	}
+	existing := new(FileList)
+	if !fresh {
+		if existing, err = c.Client.List(dst, ""); err != nil {
+			return fmt.Errorf("failed to list the copy of %s: %w", "/"+dir, err)
+		}
+	}
+	for _, file := range list.Files {
+		p := path.Join(dir, file.Name)
+		if !file.IsFolder() {
+			c.plan(file, dst, p, existing.Files, tasks)
+			continue
+		}
+		c.mu.Lock()
+		folder := c.journal.Folders[file.ID]
+		c.mu.Unlock()
+		created := false
+		if folder == "" {
+			for _, f := range existing.Files {
+				if f.IsFolder() && f.Name == file.Name {
+					folder = f.ID
+					break
+				}
+			}
+		}
+		if folder == "" {
+			var f *File
+			if f, err = c.Client.Mkdir(dst, file.Name); err != nil {
+				return fmt.Errorf("failed to create folder %s: %w", "/"+p, err)
+			}
+			folder, created = f.ID, true
+		}
+		c.mu.Lock()
+		c.journal.Folders[file.ID] = folder
+		c.saveJournal()
+		c.mu.Unlock()
+		if err = c.walk(file.ID, folder, p, created, tasks); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// plan queues the copy of file into dst unless it is already there.
+func (c *Copier) plan(file File, dst string, p string, existing []File, tasks chan<- copyTask) {
+	skip := func(format string, args ...interface{}) {
+		c.mu.Lock()
+		c.result.Skipped++
+		c.mu.Unlock()
+		c.logf("Skipped /%s: "+format+"\n", append([]interface{}{p}, args...)...)
+	}
+	if strings.HasPrefix(file.MimeType, "application/vnd.google-apps.") {
+		skip("%s documents cannot be copied", file.MimeType)
+		return
+	}
+	c.mu.Lock()
+	e := c.journal.Files[file.ID]
+	c.mu.Unlock()
+	if e != nil && e.ID != "" {
+		skip("already copied")
+		return
+	}
+	for _, f := range existing {
+		if !f.IsFolder() && f.Name == file.Name && f.Size == file.Size {
+			c.mu.Lock()
+			c.entry(file.ID).ID = f.ID
+			c.saveJournal()
+			c.mu.Unlock()
+			skip("already in the destination")
+			return
+		}
+	}
+	tasks <- copyTask{file: file, dst: dst, path: p}
+}
+
+// copyFile copies a file, starting over when its upload session expires or
+// stalls.
+func (c *Copier) copyFile(task copyTask) {
+	retries := c.Retries
+	if retries <= 0 {
+		retries = 3
+	}
+	c.mu.Lock()
+	token := c.entry(task.file.ID).Token
+	c.mu.Unlock()
+	resumed := token != ""
+
+	var id string
+	var err error
+	for attempt := 0; attempt < retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<uint(attempt-1)) * time.Second)
+		}
+		if resumed {
+			// the upload left by the last run is kept when done, or still going
+			resumed = false
+			var status *CopyStatus
+			if status, err = c.Client.CopyFileStat(token); err == nil && status.Status == CopyUploaded {
+				id = status.ID
+				break
+			}
+			if err == nil && status.Status == CopyUploading {
+				if id, err = c.poll(token); err == nil {
+					break
+				}
+			}
+			attempt--
+		} else {
+			if id, err = c.copyOnce(task); err == nil {
+				break
+			}
+			if err == ErrDenied || IsNotFound(err) {
+				break
+			}
+		}
+		token = ""
+		c.mu.Lock()
+		c.entry(task.file.ID).Token = ""
+		c.saveJournal()
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id == "" {
+		if err == nil {
+			err = errors.New("no file ID returned")
+		}
+		c.result.Failed++
+		c.logf("Failed /%s: %v\n", task.path, err)
+		return
+	}
+	e := c.entry(task.file.ID)
+	e.ID, e.Token = id, ""
+	c.saveJournal()
+	c.result.Copied++
+	c.result.Bytes += task.file.Size
+	c.logf("Copied /%s\n", task.path)
+}
+
+// copyOnce runs a copy from copyFileInit to the end of the upload.
+func (c *Copier) copyOnce(task copyTask) (id string, err error) {
+	var job *CopyJob
+	if job, err = c.Client.CopyFileInit(task.file.ID, task.dst); err != nil {
+		return
+	}
+	c.mu.Lock()
+	c.entry(task.file.ID).Token = job.Token
+	c.saveJournal()
+	c.mu.Unlock()
+
+	var file *File
+	if file, err = c.Client.CopyFileExec(task.file.ID, job.Token); err == nil && file.ID != "" {
+		return file.ID, nil
+	}
+	if err == ErrCopyExpired || err == ErrDenied || IsNotFound(err) {
+		return
+	}
+	// the upload may go on after the request is cut short
+	return c.poll(job.Token)
+}
+
+// poll waits for the upload of a copy to finish.
+func (c *Copier) poll(token string) (id string, err error) {
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	var last int64 = -1
+	stalled := 0
+	for {
+		var status *CopyStatus
+		if status, err = c.Client.CopyFileStat(token); err != nil {
+			return
+		}
+		if status.Status == CopyUploaded {
+			return status.ID, nil
+		}
+		if status.Uploaded == last {
+			if stalled++; stalled >= stallPolls {
+				return "", fmt.Errorf("upload stalled at %d bytes", last)
+			}
+		} else {
+			last, stalled = status.Uploaded, 0
+		}
+		time.Sleep(interval)
+	}
+}
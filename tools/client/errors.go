@@ -0,0 +1,59 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrLoginFailed is returned when /login does not issue a token.
+var ErrLoginFailed = errors.New("login failed: wrong name, password or code, or the user is disabled or expired")
+
+// ErrDenied is returned when the site answers with a page instead of the API,
+// as it does for requests not signed in, users without the capability, and
+// files outside of the drives and folders the user may access.
+var ErrDenied = errors.New("not signed in, or not allowed to access this")
+
+// ErrCopyExpired is returned when the upload session of a copy has expired,
+// and the copy must start over with CopyFileInit.
+var ErrCopyExpired = errors.New("copy upload session expired")
+
+// StatusError is an unexpected HTTP response of the site.
+type StatusError struct {
+	Op         string
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s: unexpected HTTP status %d", e.Op, e.StatusCode)
+	}
+	return fmt.Sprintf("%s: unexpected HTTP status %d: %s", e.Op, e.StatusCode, e.Message)
+}
+
+// APIError is an error of the Google Drive API relayed by the site.
+type APIError struct {
+	Op      string
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: Google Drive API error %d: %s", e.Op, e.Code, e.Message)
+}
+
+// CopyError is a failed copy reported by CopyFileStat.
+type CopyError struct {
+	Message string
+}
+
+func (e *CopyError) Error() string {
+	return "copy failed: " + e.Message
+}
+
+// IsNotFound reports whether err is a Google Drive API error for a file that
+// does not exist or is not visible to the account serving the request.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == 404
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// ExportEntry is a file of an exported folder, with its path set.
+type ExportEntry struct {
+	File
+	// URL downloads the file without signing in, until the token expires.
+	URL string `json:"url"`
+}
+
+// Export lists the files under folder, walking its subfolders when recursive,
+// along with download URLs carrying a token scoped to folder. The paths of the
+// entries start with the name of folder, as the tree "gdir get" recreates.
+// Google Docs have no content to download and are left out.
+func (c *Client) Export(folder string, recursive bool, ttl time.Duration) (entries []ExportEntry, expires time.Time, err error) {
+	var file *File
+	if file, err = c.File(folder); err != nil {
+		return
+	}
+	if !file.IsFolder() {
+		return nil, expires, fmt.Errorf("%s is not a folder", file.Name)
+	}
+	var token string
+	if token, expires, err = c.ScopedToken(file.ID, ttl); err != nil {
+		return
+	}
+	entries = []ExportEntry{}
+	err = c.export(file.ID, localName(file.Name), recursive, token, &entries)
+	return
+}
+
+func (c *Client) export(folderID string, dir string, recursive bool, token string, entries *[]ExportEntry) (err error) {
+	var list *FileList
+	if list, err = c.List(folderID, ""); err != nil {
+		return fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+	seen := map[string]bool{}
+	for _, file := range list.Files {
+		if !file.IsFolder() && strings.HasPrefix(file.MimeType, "application/vnd.google-apps.") {
+			continue
+		}
+		name := localName(file.Name)
+		if seen[strings.ToLower(name)] {
+			// Drive allows several files of the same name in a folder
+			ext := path.Ext(name)
+			name = fmt.Sprintf("%s (%s)%s", strings.TrimSuffix(name, ext), file.ID, ext)
+		}
+		seen[strings.ToLower(name)] = true
+		if file.IsFolder() {
+			if recursive {
+				if err = c.export(file.ID, path.Join(dir, name), recursive, token, entries); err != nil {
+					return
+				}
+			}
+			continue
+		}
+		file.Path = path.Join(dir, name)
+		*entries = append(*entries, ExportEntry{File: file, URL: c.FileURL(file.ID, file.Name, token)})
+	}
+	return
+}
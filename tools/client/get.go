@@ -0,0 +1,377 @@
+package client
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSegmentSize is the size of the byte ranges fetched by a Getter.
+const DefaultSegmentSize = 16 << 20
+
+// Suffixes of the files a Getter keeps next to a download in progress.
+const (
+	PartSuffix  = ".part"
+	StateSuffix = ".part.state"
+)
+
+// Getter downloads files and folder trees in byte range segments fetched in
+// parallel, keeping a state file next to each partial download so that an
+// interrupted download resumes where it stopped.
+type Getter struct {
+	// received is first to be 64-bit aligned for atomic operations.
+	received int64
+
+	Client *Client
+	// Parallel is the number of segments fetched at once.
+	Parallel int
+	// SegmentSize is the size of each byte range, DefaultSegmentSize when 0.
+	SegmentSize int64
+	// Retries is the number of attempts of each segment, 5 when 0.
+	Retries int
+	// Logf reports progress, nothing when nil.
+	Logf func(format string, args ...interface{})
+}
+
+// Target is a file to download to Path.
+type Target struct {
+	File File
+	Path string
+}
+
+// getState is the resume state of a partial download.
+type getState struct {
+	ID          string `json:"id"`
+	Size        int64  `json:"size"`
+	MD5Checksum string `json:"md5Checksum,omitempty"`
+	SegmentSize int64  `json:"segmentSize"`
+	Done        []bool `json:"done"`
+}
+
+func (g *Getter) logf(format string, args ...interface{}) {
+	if g.Logf != nil {
+		g.Logf(format, args...)
+	}
+}
+
+// Received returns the number of bytes downloaded so far.
+func (g *Getter) Received() int64 {
+	return atomic.LoadInt64(&g.received)
+}
+
+// Plan resolves id into the files to download under dir. A folder or a
+// shared drive is walked recursively and its tree recreated under dir.
+func (g *Getter) Plan(id string, dir string) (targets []Target, err error) {
+	var file *File
+	if file, err = g.Client.File(id); err != nil {
+		return
+	}
+	if !file.IsFolder() {
+		return []Target{{File: *file, Path: filepath.Join(dir, localName(file.Name))}}, nil
+	}
+	err = g.walk(file.ID, filepath.Join(dir, localName(file.Name)), &targets)
+	return
+}
+
+func (g *Getter) walk(folderID string, dir string, targets *[]Target) (err error) {
+	var list *FileList
+	if list, err = g.Client.List(folderID, ""); err != nil {
+		return fmt.Errorf("failed to list %s: %w", dir, err)
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	seen := map[string]bool{}
+	for _, file := range list.Files {
+		name := localName(file.Name)
+		if seen[strings.ToLower(name)] {
+			// Drive allows several files of the same name in a folder
+			ext := filepath.Ext(name)
+			name = fmt.Sprintf("%s (%s)%s", strings.TrimSuffix(name, ext), file.ID, ext)
+		}
+		seen[strings.ToLower(name)] = true
+		if file.IsFolder() {
+			if err = g.walk(file.ID, filepath.Join(dir, name), targets); err != nil {
+				return
+			}
+			continue
+		}
+		*targets = append(*targets, Target{File: file, Path: filepath.Join(dir, name)})
+	}
+	return
+}
+
+// localName turns a Drive file name into a safe local file name.
+func localName(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_", "\x00", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+	return name
+}
+
+// download is a target being downloaded.
+type download struct {
+	Target
+	state     getState
+	out       *os.File
+	remaining int32
+	mu        sync.Mutex
+	err       error
+}
+
+// segment is a byte range of a download.
+type segment struct {
+	d     *download
+	index int
+	start int64
+	end   int64
+}
+
+// Get downloads targets, skipping those already complete, and returns an
+// error summing up the targets that failed.
+func (g *Getter) Get(targets []Target) (err error) {
+	parallel := g.Parallel
+	if parallel <= 0 {
+		parallel = 1
+	}
+	segments := make(chan segment)
+	var failed []string
+	var failedMu sync.Mutex
+	fail := func(d *download, err error) {
+		failedMu.Lock()
+		defer failedMu.Unlock()
+		failed = append(failed, d.Path)
+		g.logf("Failed %s: %v\n", d.Path, err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range segments {
+				if e := g.fetch(s); e != nil {
+					s.d.mu.Lock()
+					if s.d.err == nil {
+						s.d.err = e
+					}
+					s.d.mu.Unlock()
+				} else {
+					s.d.markDone(s.index)
+				}
+				if atomic.AddInt32(&s.d.remaining, -1) == 0 {
+					if e := g.finish(s.d); e != nil {
+						fail(s.d, e)
+					}
+				}
+			}
+		}()
+	}
+
+	for _, target := range targets {
+		d := &download{Target: target}
+		var pending []segment
+		var skip bool
+		if pending, skip, err = g.prepare(d); err != nil {
+			fail(d, err)
+			err = nil
+			continue
+		}
+		if skip {
+			continue
+		}
+		if len(pending) == 0 {
+			if err = g.finish(d); err != nil {
+				fail(d, err)
+				err = nil
+			}
+			continue
+		}
+		d.remaining = int32(len(pending))
+		for _, s := range pending {
+			segments <- s
+		}
+	}
+	close(segments)
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d files failed, run the command again to resume", len(failed), len(targets))
+	}
+	return
+}
+
+// prepare opens the partial download of d, resuming its state when it
+// matches the file, and returns the segments left to fetch.
+func (g *Getter) prepare(d *download) (pending []segment, skip bool, err error) {
+	file := d.File
+	if strings.HasPrefix(file.MimeType, "application/vnd.google-apps.") {
+		g.logf("Skipped %s: %s documents can only be exported\n", d.Path, file.MimeType)
+		return nil, true, nil
+	}
+	if info, e := os.Stat(d.Path); e == nil && info.Size() == file.Size {
+		g.logf("Skipped %s: already downloaded\n", d.Path)
+		return nil, true, nil
+	}
+	if err = os.MkdirAll(filepath.Dir(d.Path), 0755); err != nil {
+		return
+	}
+	segmentSize := g.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	fresh := getState{ID: file.ID, Size: file.Size, MD5Checksum: file.MD5Checksum, SegmentSize: segmentSize}
+	fresh.Done = make([]bool, int((file.Size+segmentSize-1)/segmentSize))
+	d.state = fresh
+	if b, e := ioutil.ReadFile(d.Path + StateSuffix); e == nil {
+		var saved getState
+		if json.Unmarshal(b, &saved) == nil && saved.ID == fresh.ID && saved.Size == fresh.Size &&
+			saved.MD5Checksum == fresh.MD5Checksum && saved.SegmentSize == fresh.SegmentSize && len(saved.Done) == len(fresh.Done) {
+			d.state = saved
+		}
+	}
+	if d.out, err = os.OpenFile(d.Path+PartSuffix, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return
+	}
+	if err = d.out.Truncate(file.Size); err != nil {
+		d.out.Close()
+		return
+	}
+	done := 0
+	for i, ok := range d.state.Done {
+		if ok {
+			done++
+			continue
+		}
+		end := int64(i+1)*segmentSize - 1
+		if end >= file.Size {
+			end = file.Size - 1
+		}
+		pending = append(pending, segment{d: d, index: i, start: int64(i) * segmentSize, end: end})
+	}
+	if done > 0 {
+		g.logf("Resuming %s: %d of %d segments already downloaded\n", d.Path, done, len(d.state.Done))
+	}
+	err = d.saveState()
+	return
+}
+
+func (d *download) saveState() (err error) {
+	var b []byte
+	if b, err = json.Marshal(d.state); err != nil {
+		return
+	}
+	tmp := d.Path + StateSuffix + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, d.Path+StateSuffix)
+}
+
+func (d *download) markDone(index int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.state.Done[index] = true
+	d.saveState()
+}
+
+// fetch downloads a segment, resuming from the last byte written when the
+// connection drops.
+func (g *Getter) fetch(s segment) (err error) {
+	retries := g.Retries
+	if retries <= 0 {
+		retries = 5
+	}
+	start := s.start
+	for attempt := 0; attempt < retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<uint(attempt-1)) * time.Second)
+		}
+		s.d.mu.Lock()
+		failed := s.d.err != nil
+		s.d.mu.Unlock()
+		if failed {
+			return fmt.Errorf("another segment failed")
+		}
+		var body io.ReadCloser
+		if body, err = g.Client.Download(s.d.File.ID, &Range{Start: start, End: s.end}); err != nil {
+			if err == ErrDenied || IsNotFound(err) {
+				return
+			}
+			continue
+		}
+		var n int64
+		n, err = io.Copy(&offsetWriter{w: s.d.out, offset: start, counter: &g.received}, io.LimitReader(body, s.end-start+1))
+		body.Close()
+		start += n
+		if err == nil && start <= s.end {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			return
+		}
+	}
+	return fmt.Errorf("bytes %d-%d: %w", s.start, s.end, err)
+}
+
+// finish verifies a complete download against its MD5 checksum and moves it
+// into place.
+func (g *Getter) finish(d *download) (err error) {
+	if d.out == nil {
+		return
+	}
+	defer d.out.Close()
+	if d.err != nil {
+		return d.err
+	}
+	if d.File.MD5Checksum != "" {
+		hash := md5.New()
+		if _, err = d.out.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		if _, err = io.Copy(hash, d.out); err != nil {
+			return
+		}
+		if sum := hex.EncodeToString(hash.Sum(nil)); sum != d.File.MD5Checksum {
+			// start over next time
+			os.Remove(d.Path + StateSuffix)
+			return fmt.Errorf("MD5 checksum mismatch, expected %s, got %s", d.File.MD5Checksum, sum)
+		}
+	}
+	if err = d.out.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(d.Path+PartSuffix, d.Path); err != nil {
+		return
+	}
+	os.Remove(d.Path + StateSuffix)
+	if !d.File.ModifiedTime.IsZero() {
+		os.Chtimes(d.Path, d.File.ModifiedTime, d.File.ModifiedTime)
+	}
+	g.logf("Downloaded %s\n", d.Path)
+	return
+}
+
+// offsetWriter writes sequentially into w from offset.
+type offsetWriter struct {
+	w       io.WriterAt
+	offset  int64
+	counter *int64
+}
+
+func (o *offsetWriter) Write(p []byte) (n int, err error) {
+	n, err = o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	atomic.AddInt64(o.counter, int64(n))
+	return
+}
@@ -0,0 +1,359 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultListingTTL is how long a WebDAV server keeps folder listings.
+const DefaultListingTTL = time.Minute
+
+// davSessionTTL is how long a WebDAV server keeps the session of a user who
+// stopped sending requests.
+const davSessionTTL = 30 * time.Minute
+
+// WebDAV serves a deployed gdir site as a read-only WebDAV tree, for file
+// managers and media players. The credentials of HTTP basic authentication
+// sign in to the site as a gdir user. Shared drives and the folders of the
+// user make up the root, and files are addressed by name below them.
+type WebDAV struct {
+	// Site is the URL of the gdir site.
+	Site string
+	// TTL is how long folder listings are cached, DefaultListingTTL when 0.
+	TTL time.Duration
+	// Logf reports errors, nothing when nil.
+	Logf func(format string, args ...interface{})
+
+	mu       sync.Mutex
+	sessions map[[sha256.Size]byte]*davSession
+}
+
+// davSession is a signed in user with its cached listings.
+type davSession struct {
+	client   *Client
+	expires  time.Time
+	mu       sync.Mutex
+	listings map[string]*davListing
+}
+
+// davListing is a cached folder listing.
+type davListing struct {
+	entries []davEntry
+	expires time.Time
+}
+
+// davEntry is a file, a folder or a shared drive of a listing.
+type davEntry struct {
+	ID           string
+	Name         string
+	Folder       bool
+	Size         int64
+	MimeType     string
+	ModifiedTime time.Time
+}
+
+func (d *WebDAV) logf(format string, args ...interface{}) {
+	if d.Logf != nil {
+		d.Logf(format, args...)
+	}
+}
+
+func (d *WebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("DAV", "1")
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD")
+		return
+	}
+	name, pass, ok := r.BasicAuth()
+	if !ok {
+		d.unauthorized(w)
+		return
+	}
+	session, err := d.session(name, pass)
+	if err == ErrLoginFailed {
+		d.unauthorized(w)
+		return
+	}
+	if err != nil {
+		d.logf("Failed to sign in %s: %v\n", name, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	switch r.Method {
+	case "PROPFIND":
+		err = d.propfind(session, w, r)
+	case "GET", "HEAD":
+		err = d.get(session, w, r)
+	default:
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD")
+		http.Error(w, "read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	if err == ErrDenied {
+		// the token may have expired, sign in again next time
+		d.mu.Lock()
+		delete(d.sessions, sha256.Sum256([]byte(name+"\x00"+pass)))
+		d.mu.Unlock()
+	}
+	if err != nil {
+		d.logf("%s %s: %v\n", r.Method, r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func (d *WebDAV) unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="gdir"`)
+	http.Error(w, "sign in with your gdir user name and password", http.StatusUnauthorized)
+}
+
+// session returns the session of a user, signing in on first use or once
+// the session expired.
+func (d *WebDAV) session(name string, pass string) (session *davSession, err error) {
+	key := sha256.Sum256([]byte(name + "\x00" + pass))
+	now := time.Now()
+	d.mu.Lock()
+	if session = d.sessions[key]; session != nil && now.Before(session.expires) {
+		session.expires = now.Add(davSessionTTL)
+		d.mu.Unlock()
+		return
+	}
+	d.mu.Unlock()
+	var c *Client
+	if c, err = New(d.Site); err != nil {
+		return
+	}
+	if err = c.Login(name, pass, ""); err != nil {
+		return nil, err
+	}
+	session = &davSession{client: c, expires: now.Add(davSessionTTL), listings: map[string]*davListing{}}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sessions == nil {
+		d.sessions = map[[sha256.Size]byte]*davSession{}
+	}
+	// evict the sessions of users gone, so that they do not pile up
+	for k, s := range d.sessions {
+		if now.After(s.expires) {
+			delete(d.sessions, k)
+		}
+	}
+	d.sessions[key] = session
+	return
+}
+
+// list returns the entries of a folder, or of the root when id is empty.
+func (d *WebDAV) list(session *davSession, id string) (entries []davEntry, err error) {
+	session.mu.Lock()
+	listing := session.listings[id]
+	session.mu.Unlock()
+	if listing != nil && time.Now().Before(listing.expires) {
+		return listing.entries, nil
+	}
+	var list *FileList
+	if list, err = session.client.List(id, ""); err != nil {
+		return
+	}
+	for _, drive := range list.Drives {
+		entries = append(entries, davEntry{ID: drive.ID, Name: drive.Name, Folder: true})
+	}
+	for _, file := range list.Files {
+		entries = append(entries, davEntry{
+			ID:           file.ID,
+			Name:         file.Name,
+			Folder:       file.IsFolder(),
+			Size:         file.Size,
+			MimeType:     file.MimeType,
+			ModifiedTime: file.ModifiedTime,
+		})
+	}
+	ttl := d.TTL
+	if ttl <= 0 {
+		ttl = DefaultListingTTL
+	}
+	now := time.Now()
+	session.mu.Lock()
+	for k, l := range session.listings {
+		if now.After(l.expires) {
+			delete(session.listings, k)
+		}
+	}
+	session.listings[id] = &davListing{entries: entries, expires: now.Add(ttl)}
+	session.mu.Unlock()
+	return
+}
+
+// resolve finds the entry at a path, walking the listings from the root.
+// It returns nil when there is none.
+func (d *WebDAV) resolve(session *davSession, p string) (entry *davEntry, err error) {
+	entry = &davEntry{Name: "/", Folder: true}
+	for _, name := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if !entry.Folder {
+			return nil, nil
+		}
+		var entries []davEntry
+		if entries, err = d.list(session, entry.ID); err != nil {
+			return
+		}
+		var next *davEntry
+		for i := range entries {
+			if entries[i].Name == name {
+				next = &entries[i]
+				break
+			}
+		}
+		if next == nil {
+			return nil, nil
+		}
+		entry = next
+	}
+	return
+}
+
+// davMultistatus is the body of a PROPFIND response.
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XMLNS     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+	ETag          string          `xml:"D:getetag,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+func davResponseOf(href string, entry *davEntry) davResponse {
+	prop := davProp{DisplayName: entry.Name}
+	if entry.Folder {
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		size := entry.Size
+		prop.ContentLength = &size
+		prop.ContentType = entry.MimeType
+	}
+	if !entry.ModifiedTime.IsZero() {
+		prop.LastModified = entry.ModifiedTime.UTC().Format(http.TimeFormat)
+	}
+	if entry.ID != "" {
+		prop.ETag = `"` + entry.ID + `"`
+	}
+	return davResponse{Href: href, Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"}}
+}
+
+// davHref escapes a path for the href of a response.
+func davHref(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// propfind answers with the properties of an entry, and of its children
+// unless the Depth header is 0. A Depth of infinity is served as 1.
+func (d *WebDAV) propfind(session *davSession, w http.ResponseWriter, r *http.Request) (err error) {
+	var entry *davEntry
+	if entry, err = d.resolve(session, r.URL.Path); err != nil || entry == nil {
+		if entry == nil && err == nil {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	p := path.Clean("/" + r.URL.Path)
+	if entry.Folder && p != "/" {
+		p += "/"
+	}
+	ms := davMultistatus{XMLNS: "DAV:", Responses: []davResponse{davResponseOf(davHref(p), entry)}}
+	if entry.Folder && r.Header.Get("Depth") != "0" {
+		var entries []davEntry
+		if entries, err = d.list(session, entry.ID); err != nil {
+			return
+		}
+		for i := range entries {
+			child := p + entries[i].Name
+			if entries[i].Folder {
+				child += "/"
+			}
+			ms.Responses = append(ms.Responses, davResponseOf(davHref(child), &entries[i]))
+		}
+	}
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(207)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(ms)
+	return
+}
+
+// get serves the content of a file, relaying the Range header to the site.
+func (d *WebDAV) get(session *davSession, w http.ResponseWriter, r *http.Request) (err error) {
+	var entry *davEntry
+	if entry, err = d.resolve(session, r.URL.Path); err != nil || entry == nil {
+		if entry == nil && err == nil {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	if entry.Folder {
+		http.Error(w, "is a folder", http.StatusMethodNotAllowed)
+		return
+	}
+	header := w.Header()
+	header.Set("Accept-Ranges", "bytes")
+	if !entry.ModifiedTime.IsZero() {
+		header.Set("Last-Modified", entry.ModifiedTime.UTC().Format(http.TimeFormat))
+	}
+	if r.Method == "HEAD" {
+		header.Set("Content-Type", entry.MimeType)
+		header.Set("Content-Length", fmt.Sprint(entry.Size))
+		return
+	}
+	upstream := http.Header{}
+	if rng := r.Header.Get("Range"); rng != "" {
+		upstream.Set("Range", rng)
+	}
+	var resp *http.Response
+	if resp, err = session.client.get("/file/"+url.PathEscape(entry.ID), nil, upstream); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if err = checkResponse("download", resp, b); err != nil {
+			return
+		}
+		return &StatusError{Op: "download", StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+	}
+	for _, key := range []string{"Content-Type", "Content-Length", "Content-Range"} {
+		if v := resp.Header.Get(key); v != "" {
+			header.Set(key, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return
+}
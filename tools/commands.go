@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+// command is a non-interactive gdir sub-command, run as "gdir [flags] <name> ...".
+type command struct {
+	args string
+	help string
+	run  func(args []string) error
+}
+
+var commands = map[string]command{
+	"accounts": {"add-user-oauth|audit|drives|grant|import-rclone|remove|tag ...", "manage the account pool", accountsCommand},
+	"doctor":   {"[-json] [-offline]", "check each layer of the deployment, from the config file to the deployed worker", doctorCommand},
+	"drive":    {"copy|move|report|upload ...", "copy, move and upload into shared drives with the Drive API directly, rotating the accounts of the pool, and report their usage", driveCommand},
+	"get":      {"<file ID|folder URL>", "download files and folders from a deployed gdir site in parallel, resumable segments", getCommand},
+	"groups":   {"list|set|remove ...", "manage named drive groups for access lists", groupsCommand},
+	"index":    {"build|deploy ...", "build the encrypted search index of the shared drives and publish it for the worker", indexCommand},
+	"migrate":  {"-from gdindex <worker.js>", "import accounts and users from a GDIndex or GoIndex worker", migrateCommand},
+	"remote":   {"ls|search|stat|get|export ...", "browse, download and export download links from a deployed gdir site", remoteCommand},
+	"rotation": {"simulate|check|strategy|preview ...", "choose, simulate and cross-check the account selection", rotationCommand},
+	"serve":    {"-listen :8080", "serve the index and its API from this machine instead of a worker", serveCommand},
+	"user":     {"add|totp-reset|backup-codes ...", "manage a single user", userCommand},
+	"users":    {"list|prune ...", "manage all users", usersCommand},
+	"webdav":   {"-listen :8080 -remote <URL>", "serve a deployed gdir site as a read-only WebDAV tree for file managers and media players", webdavCommand},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: gdir [flags]                  run the interactive setup and menu\n")
+	fmt.Fprintf(out, "       gdir [flags] <command> ...\n\nCommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "    %s %s\t%s\n", name, commands[name].args, commands[name].help)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func runCommand(args []string) (err error) {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		flag.Usage()
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+	return cmd.run(args[1:])
+}
+
+// runSubcommand dispatches args[0] of a command group to one of subs.
+func runSubcommand(group string, subs map[string]func(args []string) error, args []string) (err error) {
+	var names []string
+	for name := range subs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(args) == 0 {
+		return fmt.Errorf("usage: gdir %s %s ...", group, strings.Join(names, "|"))
+	}
+	sub, ok := subs[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown %s command: %s (expected %s)", group, args[0], strings.Join(names, "|"))
+	}
+	return sub(args[1:])
+}
+
+// newFlagSet returns a flag set for "gdir <name>" that exits on parse errors.
+func newFlagSet(name string, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet("gdir "+name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gdir %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func requireConfig() error {
+	if !core.ValidateConfig() {
+		return fmt.Errorf("gdir is not set up yet, run %s without a command to start the setup wizard", os.Args[0])
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Account is a Google account credential as stored in the encrypted pool,
+// either an OAuth user account or a service account.
+type Account struct {
+	Type string `json:"type"`
+
+	// authorized_user fields
+	ClientID     string `json:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+
+	// service_account fields
+	ProjectID    string `json:"project_id,omitempty"`
+	PrivateKeyID string `json:"private_key_id,omitempty"`
+	PrivateKey   string `json:"private_key,omitempty"`
+	ClientEmail  string `json:"client_email,omitempty"`
+	TokenURI     string `json:"token_uri,omitempty"`
+
+	// File is the name of the encrypted file under accounts/
+	File string `json:"-"`
+}
+
+const (
+	AccountTypeUser    = "authorized_user"
+	AccountTypeService = "service_account"
+)
+
+// Label returns a human readable identifier of the account.
+func (account *Account) Label() string {
+	if account.ClientEmail != "" {
+		return account.ClientEmail
+	}
+	if account.ClientID != "" && account.File == "" {
+		return fmt.Sprintf("user account (%s)", account.ClientID)
+	}
+	if account.ClientID != "" {
+		return fmt.Sprintf("user account %s (%s)", account.File, account.ClientID)
+	}
+	return "account " + account.File
+}
+
+// ReadAccountByPath decrypts an account file from the pool.
+func ReadAccountByPath(accountPath string, account *Account) (err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile(accountPath); err != nil {
+		return
+	}
+	if b, err = GCMDecrypt(Config.SecretKey, "account", b); err != nil {
+		return fmt.Errorf("failed to decrypt account %s: %w", accountPath, err)
+	}
+	if err = json.Unmarshal(b, account); err != nil {
+		return fmt.Errorf("failed to parse account %s: %w", accountPath, err)
+	}
+	account.File = filepath.Base(accountPath)
+	return
+}
+
+// AccountFiles returns the names of the encrypted files under accounts/ in
+// numeric order.
+func AccountFiles() (names []string, err error) {
+	var fis []os.FileInfo
+	if fis, err = ioutil.ReadDir("accounts"); err != nil {
+		return
+	}
+	for _, info := range fis {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		names = append(names, info.Name())
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, errA := strconv.Atoi(names[i])
+		b, errB := strconv.Atoi(names[j])
+		if errA != nil || errB != nil {
+			return names[i] < names[j]
+		}
+		return a < b
+	})
+	return
+}
+
+// LoadAccounts decrypts every account in the pool.
+func LoadAccounts() (accounts []*Account, err error) {
+	var names []string
+	if names, err = AccountFiles(); err != nil {
+		return
+	}
+	for _, name := range names {
+		account := new(Account)
+		if err = ReadAccountByPath(filepath.Join("accounts", name), account); err != nil {
+			return
+		}
+		accounts = append(accounts, account)
+	}
+	if len(accounts) == 0 {
+		err = fmt.Errorf("no accounts found under accounts/, please run the setup wizard first")
+	}
+	return
+}
+
+// LoadFirstAccount decrypts the first account in the pool.
+func LoadFirstAccount() (account *Account, err error) {
+	var names []string
+	if names, err = AccountFiles(); err != nil {
+		return
+	}
+	if len(names) == 0 {
+		err = fmt.Errorf("no accounts found under accounts/, please run the setup wizard first")
+		return
+	}
+	account = new(Account)
+	err = ReadAccountByPath(filepath.Join("accounts", names[0]), account)
+	return
+}
+
+// ReadAccountJSON reads a plain account JSON file, as downloaded from the
+// Google Cloud console or written by rclone and gcloud.
+func ReadAccountJSON(jsonPath string, account *Account) (err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile(jsonPath); err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, account); err != nil {
+		return fmt.Errorf("failed to parse account %s: %w", jsonPath, err)
+	}
+	if account.Type != AccountTypeUser && account.Type != AccountTypeService {
+		return fmt.Errorf("%s is neither an authorized_user nor a service_account JSON", jsonPath)
+	}
+	account.File = filepath.Base(jsonPath)
+	return
+}
+
+// AddAccount encrypts an account JSON into the next free file of the pool,
+// counts it in the config and returns the file name.
+func AddAccount(b []byte) (name string, err error) {
+	var names []string
+	var outBytes []byte
+	if err = os.MkdirAll("accounts", 0700); err != nil {
+		return
+	}
+	if names, err = AccountFiles(); err != nil {
+		return
+	}
+	next := 0
+	for _, n := range names {
+		if i, e := strconv.Atoi(n); e == nil && i >= next {
+			next = i + 1
+		}
+	}
+	if outBytes, err = GCMEncrypt(Config.SecretKey, "account", b); err != nil {
+		return
+	}
+	name = strconv.Itoa(next)
+	if err = ioutil.WriteFile(filepath.Join("accounts", name), outBytes, 0600); err != nil {
+		return
+	}
+	Config.AccountsCount++
+	if err = SaveConfigFile(); err != nil {
+		return
+	}
+	if drives := PooledDrives(); len(drives) > 0 {
+		account := &Account{File: name}
+		if err = json.Unmarshal(b, account); err != nil {
+			return
+		}
+		result, e := ProbeAccountDrives([]*Account{account}, drives, 1)
+		if e != nil || len(result.Errors) > 0 {
+			fmt.Printf("Cannot probe the shared drives of account %s, it will serve drives without a pool only.\n", name)
+		} else {
+			fmt.Printf("Account %s serves %d of the %d shared drives with a pool of accounts.\n", name, result.Count(0), len(drives))
+		}
+	}
+	return
+}
+
+// Key identifies the credential of the account regardless of its file, to
+// detect duplicates in the pool.
+func (account *Account) Key() string {
+	if account.Type == AccountTypeService {
+		return AccountTypeService + ":" + strings.ToLower(account.ClientEmail)
+	}
+	return account.Type + ":" + account.ClientID + ":" + account.RefreshToken
+}
+
+// ImportAccountJSON writes an account JSON into the accounts JSON directory,
+// so that re-scanning the directory keeps it, and adds it to the pool.
+func ImportAccountJSON(jsonName string, b []byte) (name string, err error) {
+	jsonPath := filepath.Join(Config.AccountsJSONDir, jsonName)
+	if _, err = os.Stat(jsonPath); err == nil {
+		return "", fmt.Errorf("%s already exists", jsonPath)
+	}
+	if err = ioutil.WriteFile(jsonPath, b, 0600); err != nil {
+		return
+	}
+	return AddAccount(b)
+}
+
+// PoolKeys maps the keys of the accounts in the pool to their labels.
+func PoolKeys() (keys map[string]string, err error) {
+	var accounts []*Account
+	if accounts, err = LoadAccounts(); err != nil {
+		return
+	}
+	keys = map[string]string{}
+	for _, account := range accounts {
+		keys[account.Key()] = "account " + account.File
+	}
+	return
+}
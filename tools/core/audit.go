@@ -0,0 +1,232 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Access states of an account on a shared drive.
+const (
+	AccessUnknown = iota
+	AccessGranted
+	AccessDenied
+)
+
+// AuditResult is the access matrix of accounts by shared drives.
+type AuditResult struct {
+	Accounts []*Account
+	Drives   []string
+	Access   [][]int
+	Errors   []error
+}
+
+// AccountError is an error of a request made as an account of the pool.
+type AccountError struct {
+	Account *Account
+	Err     error
+}
+
+func (e *AccountError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Account.Label(), e.Err)
+}
+
+func (e *AccountError) Unwrap() error {
+	return e.Err
+}
+
+// ReferencedDrives returns the shared drives referenced by users' allow-lists
+// and block-lists.
+func ReferencedDrives() (drives []string, err error) {
+	seen := map[string]bool{}
+	err = ForEachUser(func(userPath string, user *User) error {
+		for _, id := range append(append([]string{}, user.DrivesAllowList...), user.DrivesBlockList...) {
+			if !seen[id] {
+				seen[id] = true
+				drives = append(drives, id)
+			}
+		}
+		return nil
+	})
+	sort.Strings(drives)
+	return
+}
+
+// VisibleDrives returns the union of the shared drives visible to accounts.
+func VisibleDrives(accounts []*Account, parallel int) (drives []string, err error) {
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	errs := forEachAccount(accounts, parallel, func(i int, client *DriveClient) error {
+		list, err := client.ListDrives()
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, drive := range list {
+			if !seen[drive.ID] {
+				seen[drive.ID] = true
+				drives = append(drives, drive.ID)
+				driveCatalogAdd(drive)
+			}
+		}
+		return nil
+	})
+	if len(errs) == len(accounts) && len(errs) > 0 {
+		err = errs[0]
+	}
+	sort.Strings(drives)
+	return
+}
+
+// AuditAccounts checks the access of every account to every drive.
+func AuditAccounts(accounts []*Account, drives []string, parallel int) (result *AuditResult) {
+	result = &AuditResult{Accounts: accounts, Drives: drives, Access: make([][]int, len(accounts))}
+	for i := range result.Access {
+		result.Access[i] = make([]int, len(drives))
+	}
+	result.Errors = forEachAccount(accounts, parallel, func(i int, client *DriveClient) error {
+		for j, id := range drives {
+			drive, err := client.GetDrive(id)
+			if err == nil {
+				result.Access[i][j] = AccessGranted
+				driveCatalogAdd(drive)
+				continue
+			}
+			if e, ok := err.(*DriveError); ok && e.Code == 404 {
+				result.Access[i][j] = AccessDenied
+				continue
+			}
+			return err
+		}
+		return nil
+	})
+	return
+}
+
+// forEachAccount runs fn for every account with at most parallel accounts at
+// a time, and returns the errors labelled by account.
+func forEachAccount(accounts []*Account, parallel int, fn func(i int, client *DriveClient) error) (errs []error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	if parallel < 1 {
+		parallel = 1
+	}
+	sem := make(chan struct{}, parallel)
+	for i, account := range accounts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, account *Account) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(i, NewDriveClient(account)); err != nil {
+				mu.Lock()
+				errs = append(errs, &AccountError{Account: account, Err: err})
+				mu.Unlock()
+			}
+		}(i, account)
+	}
+	wg.Wait()
+	return
+}
+
+// Count returns the number of drives account i can access.
+func (result *AuditResult) Count(i int) (count int) {
+	for _, access := range result.Access[i] {
+		if access == AccessGranted {
+			count++
+		}
+	}
+	return
+}
+
+// MajorityCount returns the most common number of accessible drives.
+func (result *AuditResult) MajorityCount() (majority int) {
+	freq := map[int]int{}
+	best := 0
+	for i := range result.Accounts {
+		count := result.Count(i)
+		freq[count]++
+		if freq[count] > best || (freq[count] == best && count > majority) {
+			best, majority = freq[count], count
+		}
+	}
+	return
+}
+
+// Print prints the access matrix and the accounts seeing fewer drives than
+// the majority of the pool.
+func (result *AuditResult) Print() {
+	fmt.Println("Drives:")
+	for j, id := range result.Drives {
+		fmt.Printf("    D%-3d %s\n", j+1, FormatDriveID(id))
+	}
+	fmt.Println()
+
+	width := len("Accounts")
+	for _, account := range result.Accounts {
+		if l := len(account.Label()); l > width {
+			width = l
+		}
+	}
+	fmt.Printf("%-*s", width+2, "Account")
+	for j := range result.Drives {
+		fmt.Printf(" D%-3d", j+1)
+	}
+	fmt.Println(" Total")
+	marks := map[int]string{AccessUnknown: "?", AccessGranted: "Y", AccessDenied: "-"}
+	for i, account := range result.Accounts {
+		fmt.Printf("%-*s", width+2, account.Label())
+		for j := range result.Drives {
+			fmt.Printf(" %-4s", marks[result.Access[i][j]])
+		}
+		fmt.Printf(" %d/%d\n", result.Count(i), len(result.Drives))
+	}
+	fmt.Printf("%-*s", width+2, "Accounts")
+	var unreachable []string
+	for j, id := range result.Drives {
+		count := 0
+		for i := range result.Accounts {
+			if result.Access[i][j] == AccessGranted {
+				count++
+			}
+		}
+		if count == 0 {
+			unreachable = append(unreachable, id)
+		}
+		fmt.Printf(" %-4d", count)
+	}
+	fmt.Println()
+	fmt.Println()
+
+	if len(unreachable) > 0 {
+		fmt.Printf("Drives not visible to any account: %s\n", strings.Join(unreachable, ","))
+	}
+
+	majority := result.MajorityCount()
+	var lagging []string
+	for i, account := range result.Accounts {
+		if result.Count(i) < majority {
+			var missing []string
+			for j, id := range result.Drives {
+				if result.Access[i][j] != AccessGranted {
+					missing = append(missing, id)
+				}
+			}
+			lagging = append(lagging, fmt.Sprintf("    %s sees %d drives, missing %s", account.Label(), result.Count(i), strings.Join(missing, ",")))
+		}
+	}
+	if len(lagging) == 0 {
+		fmt.Printf("No account sees fewer drives than the majority (%d of %d).\n", majority, len(result.Drives))
+	} else {
+		fmt.Printf("Most accounts see %d drives, %d accounts see fewer:\n", majority, len(lagging))
+		fmt.Println(strings.Join(lagging, "\n"))
+	}
+	if len(result.Errors) > 0 {
+		fmt.Printf("\n%d accounts could not be audited:\n", len(result.Errors))
+		for _, err := range result.Errors {
+			fmt.Printf("    %v\n", err)
+		}
+	}
+}
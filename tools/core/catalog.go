@@ -0,0 +1,229 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// driveCatalog caches the shared drives listed with the account pool, so that
+// drive IDs can be picked and displayed by name.
+var driveCatalog struct {
+	sync.Mutex
+	loaded  bool
+	drives  []Drive
+	names   map[string]string
+	missing map[string]bool
+}
+
+// LoadDriveCatalog lists the shared drives visible to any account of the pool,
+// sorted by name. Failures of every account are reported once and leave the
+// catalog empty.
+func LoadDriveCatalog() []Drive {
+	if driveCatalog.loaded {
+		return driveCatalog.drives
+	}
+	driveCatalog.loaded = true
+	accounts, err := LoadAccounts()
+	if err == nil {
+		var mu sync.Mutex
+		seen := map[string]bool{}
+		errs := forEachAccount(accounts, catalogParallel, func(i int, client *DriveClient) error {
+			client.HTTPClient = catalogHTTPClient
+			list, err := client.ListDrives()
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, drive := range list {
+				if !seen[drive.ID] {
+					seen[drive.ID] = true
+					driveCatalog.drives = append(driveCatalog.drives, drive)
+				}
+			}
+			return nil
+		})
+		if len(errs) == len(accounts) && len(errs) > 0 {
+			err = errs[0]
+		}
+	}
+	if err != nil {
+		fmt.Printf("Cannot list shared drives, drive names are unavailable: %v\n", err)
+		return nil
+	}
+	sort.Slice(driveCatalog.drives, func(i, j int) bool {
+		a, b := driveCatalog.drives[i], driveCatalog.drives[j]
+		return a.Name < b.Name || a.Name == b.Name && a.ID < b.ID
+	})
+	for _, drive := range driveCatalog.drives {
+		driveCatalogAdd(drive)
+	}
+	return driveCatalog.drives
+}
+
+// driveCatalogAdd records the name of a drive seen through any account.
+func driveCatalogAdd(drive Drive) {
+	driveCatalog.Lock()
+	defer driveCatalog.Unlock()
+	if driveCatalog.names == nil {
+		driveCatalog.names = map[string]string{}
+		driveCatalog.missing = map[string]bool{}
+	}
+	driveCatalog.names[drive.ID] = drive.Name
+	delete(driveCatalog.missing, drive.ID)
+}
+
+const (
+	// catalogTimeout bounds each request made to look up drive names.
+	catalogTimeout = 15 * time.Second
+	// catalogParallel is the number of accounts listing drives at once.
+	catalogParallel = 8
+	// maxDriveLookups bounds the number of drives looked up through the
+	// accounts of the pool in one call of ResolveDriveNames.
+	maxDriveLookups = 50
+)
+
+var catalogHTTPClient = &http.Client{Timeout: catalogTimeout}
+
+// ResolveDriveNames looks up the names of ids, asking every account of the pool
+// for the drives missing from the catalog. Group references are resolved
+// through the drives they expand to. It returns the ids that no account can
+// see.
+func ResolveDriveNames(ids []string) (missing []string) {
+	if LoadDriveCatalog() == nil {
+		return
+	}
+	ids = expandDriveGroupRefs(ids)
+	var unknown []string
+	for _, id := range ids {
+		if _, ok := driveCatalog.names[id]; !ok && !driveCatalog.missing[id] {
+			unknown = append(unknown, id)
+		}
+	}
+	if len(unknown) > 0 {
+		accounts, err := LoadAccounts()
+		if err != nil {
+			fmt.Printf("Cannot load accounts to look up drives: %v\n", err)
+			return
+		}
+		lookups := 0
+		for i, id := range unknown {
+			if lookups >= maxDriveLookups {
+				fmt.Printf("Stopped looking up drives after %d requests, %d drives are left unnamed.\n", lookups, len(unknown)-i)
+				break
+			}
+			driveCatalog.missing[id] = true
+			for _, account := range accounts {
+				if lookups >= maxDriveLookups {
+					// not all accounts were asked, so the drive is not known to be missing
+					delete(driveCatalog.missing, id)
+					break
+				}
+				lookups++
+				client := NewDriveClient(account)
+				client.HTTPClient = catalogHTTPClient
+				if drive, err := client.GetDrive(id); err == nil {
+					driveCatalogAdd(drive)
+					break
+				}
+			}
+		}
+	}
+	for _, id := range ids {
+		if driveCatalog.missing[id] {
+			missing = append(missing, id)
+		}
+	}
+	return
+}
+
+// expandDriveGroupRefs replaces the group references of ids with the drives of
+// the groups, dropping unknown groups.
+func expandDriveGroupRefs(ids []string) (drives []string) {
+	for _, id := range ids {
+		if strings.HasPrefix(id, DriveGroupPrefix) {
+			drives = append(drives, Config.DriveGroups[strings.TrimPrefix(id, DriveGroupPrefix)]...)
+		} else {
+			drives = append(drives, id)
+		}
+	}
+	return
+}
+
+// FormatDriveID returns the drive name followed by its ID when known. A group
+// reference is followed by the drives it expands to.
+func FormatDriveID(id string) string {
+	if strings.HasPrefix(id, DriveGroupPrefix) {
+		drives, ok := Config.DriveGroups[strings.TrimPrefix(id, DriveGroupPrefix)]
+		if !ok {
+			return fmt.Sprintf("%s (unknown group)", id)
+		}
+		names := make([]string, len(drives))
+		for i, drive := range drives {
+			names[i] = FormatDriveID(drive)
+		}
+		return fmt.Sprintf("%s: %s", id, strings.Join(names, ", "))
+	}
+	if name, ok := driveCatalog.names[id]; ok {
+		return fmt.Sprintf("%s [%s]", name, id)
+	}
+	if driveCatalog.missing[id] {
+		return fmt.Sprintf("%s (not visible to any account)", id)
+	}
+	return id
+}
+
+// PrintDriveIDs prints each drive of ids on its own line with its name.
+func PrintDriveIDs(indent string, ids []string) {
+	ResolveDriveNames(ids)
+	for _, id := range ids {
+		fmt.Printf("%s%s\n", indent, FormatDriveID(id))
+	}
+}
+
+// EnterDriveList reads a comma separated list of drives, each being a number
+// from the listed shared drives, a drive ID, or a @group reference.
+func EnterDriveList(prompt string) (drives []string) {
+	catalog := LoadDriveCatalog()
+	if len(catalog) > 0 {
+		fmt.Println("Shared drives visible to your accounts:")
+		for i, drive := range catalog {
+			fmt.Printf("    (%d) %s [%s]\n", i+1, drive.Name, drive.ID)
+		}
+	}
+	for {
+		var line string
+		valid := true
+		drives = nil
+		if len(catalog) > 0 {
+			fmt.Println("(Use comma to separate between numbers from the list above, drive IDs or @group names.)")
+		} else {
+			fmt.Println("(Use comma to separate between drive IDs or @group names.)")
+		}
+		fmt.Print(prompt)
+		fmt.Scanln(&line)
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			if i, err := strconv.Atoi(entry); err == nil {
+				if i < 1 || i > len(catalog) {
+					fmt.Printf("No drive numbered %d.\n", i)
+					valid = false
+					break
+				}
+				entry = catalog[i-1].ID
+			}
+			drives = append(drives, entry)
+		}
+		if valid {
+			return
+		}
+	}
+}
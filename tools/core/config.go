@@ -1,6 +1,8 @@
 package core
 
 import (
+    "time"
+
     "github.com/cloudflare/cloudflare-go"
     "github.com/google/go-github/v31/github"
 )
@@ -19,15 +21,24 @@ var Config = struct {
         Accounts string `json:"accounts,omitempty"`
         Users    string `json:"users,omitempty"`
         Static   string `json:"static,omitempty"`
+        Index    string `json:"index,omitempty"`
     } `json:"gist_id,omitempty"`
-    SecretKey            string `json:"secret_key,omitempty"`
-    AccountRotation      uint64 `json:"account_rotation,omitempty"`
-    AccountRotationStr   string `json:"-"`
-    AccountCandidates    uint64 `json:"account_candidates,omitempty"`
-    AccountCandidatesStr string `json:"-"`
-    AccountsJSONDir      string `json:"accounts_json_dir,omitempty"`
-    AccountsCount        uint64 `json:"accounts_count,omitempty"`
-    Debug                bool   `json:"-"`
+    SecretKey            string              `json:"secret_key,omitempty"`
+    AccountRotation      uint64              `json:"account_rotation,omitempty"`
+    AccountRotationStr   string              `json:"-"`
+    AccountCandidates    uint64              `json:"account_candidates,omitempty"`
+    AccountCandidatesStr string              `json:"-"`
+    AccountsJSONDir      string              `json:"accounts_json_dir,omitempty"`
+    AccountsCount        uint64              `json:"accounts_count,omitempty"`
+    AccountStrategy      string              `json:"account_strategy,omitempty"`
+    AccountWeights       map[string]float64  `json:"account_weights,omitempty"`
+    AccountTags          map[string][]string `json:"account_tags,omitempty"`
+    AccountDrives        map[string][]string `json:"account_drives,omitempty"`
+    DriveGroups          map[string][]string `json:"drive_groups,omitempty"`
+    DriveAPIURL          string              `json:"-"`
+    TokenURL             string              `json:"-"`
+    AuthURL              string              `json:"-"`
+    Debug                bool                `json:"-"`
 }{}
 
 // Cf is the Cloudflare client
@@ -38,8 +49,67 @@ var Gh *github.Client
 
 // User is the user type
 type User struct {
-    Name            string   `json:"name"`
-    Pass            string   `json:"pass"`
-    DrivesAllowList []string `json:"drives_white_list,omitempty"`
-    DrivesBlockList []string `json:"drives_black_list,omitempty"`
+    Name                string   `json:"name"`
+    Pass                string   `json:"pass"`
+    DrivesAllowList     []string `json:"drives_white_list,omitempty"`
+    DrivesBlockList     []string `json:"drives_black_list,omitempty"`
+    DrivesAllowListRefs []string `json:"drives_white_list_refs,omitempty"`
+    DrivesBlockListRefs []string `json:"drives_black_list_refs,omitempty"`
+    FoldersAllowList    []string `json:"folders_allow_list,omitempty"`
+    FoldersAllowListStr string   `json:"-"`
+    TOTPSecret          string   `json:"totp_secret,omitempty"`
+    TOTPBackupCodes     []string `json:"totp_backup_codes,omitempty"`
+    ExpiresAt           int64    `json:"expires_at,omitempty"`
+    ExpiresAtStr        string   `json:"-"`
+    Disabled            bool     `json:"disabled,omitempty"`
+    DisabledStr         string   `json:"-"`
+    Capabilities        []string `json:"capabilities,omitempty"`
+    CapabilitiesStr     string   `json:"-"`
+}
+
+// User capabilities enforced by the worker. A user without any capabilities
+// recorded gets DefaultCapabilities.
+const (
+    CapabilityList     = "list"
+    CapabilitySearch   = "search"
+    CapabilityDownload = "download"
+    CapabilityCopy     = "copy"
+)
+
+var AllCapabilities = []string{CapabilityList, CapabilitySearch, CapabilityDownload, CapabilityCopy}
+
+var DefaultCapabilities = AllCapabilities
+
+// CapabilityPresets are the named capability sets offered by the CLI.
+var CapabilityPresets = []struct {
+    Name         string
+    Description  string
+    Capabilities []string
+}{
+    {"full", "browse, search, download and copy", AllCapabilities},
+    {"download", "browse, search and download", []string{CapabilityList, CapabilitySearch, CapabilityDownload}},
+    {"browse", "browse and search only", []string{CapabilityList, CapabilitySearch}},
+}
+
+// EffectiveCapabilities returns the capabilities the worker grants the user.
+func (user *User) EffectiveCapabilities() []string {
+    if len(user.Capabilities) == 0 {
+        return DefaultCapabilities
+    }
+    return user.Capabilities
+}
+
+// HasCapability reports whether the worker grants capability c to the user.
+func (user *User) HasCapability(c string) bool {
+    for _, capability := range user.EffectiveCapabilities() {
+        if capability == c {
+            return true
+        }
+    }
+    return false
+}
+
+// Expired reports whether the user has an expiry date that has passed at now.
+func (user *User) Expired(now time.Time) bool {
+    return user.ExpiresAt != 0 && now.Unix() >= user.ExpiresAt
 }
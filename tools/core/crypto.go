@@ -5,6 +5,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 )
 
 func GCMKey(secret string, namespace string) (key []byte) {
@@ -38,5 +39,8 @@ func GCMDecrypt(secret string, namespace string, data []byte) (out []byte, err e
 	if err != nil {
 		return
 	}
+	if len(data) < 12 {
+		return nil, errors.New("ciphertext too short")
+	}
 	return gcm.Open(nil, data[:12], data[12:], nil)
 }
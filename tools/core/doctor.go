@@ -0,0 +1,381 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/go-git/go-git/v5"
+)
+
+// Statuses of a check of a deployment.
+const (
+	CheckPass = "pass"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+// deployHint is the fix of a deployment lagging behind the local files.
+const deployHint = `run gdir without a command and choose "Force deploy"`
+
+// setupHint is the fix of a broken local setup.
+const setupHint = "run gdir without a command to start the setup wizard"
+
+// Check is the outcome of a check of a deployment.
+type Check struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	// Hint tells how to fix a warning or a failure.
+	Hint string `json:"hint,omitempty"`
+}
+
+// Doctor checks a deployment layer by layer, from the local config file to
+// the deployed worker.
+type Doctor struct {
+	// Parallel is the number of raw Gist files fetched at once.
+	Parallel int
+	// Offline skips the checks calling GitHub and Cloudflare.
+	Offline bool
+	// HTTPClient fetches the raw Gist files, http.DefaultClient when nil.
+	HTTPClient *http.Client
+
+	Checks []Check
+}
+
+// gistDir is a local Gist repo pushed by a deploy.
+type gistDir struct {
+	dir  string
+	id   string
+	hint string
+}
+
+func (d *Doctor) add(name, status, hint, format string, args ...interface{}) {
+	check := Check{Name: name, Status: status, Message: fmt.Sprintf(format, args...)}
+	if status != CheckPass {
+		check.Hint = hint
+	}
+	d.Checks = append(d.Checks, check)
+}
+
+// Failed reports whether any check failed.
+func (d *Doctor) Failed() bool {
+	for _, check := range d.Checks {
+		if check.Status == CheckFail {
+			return true
+		}
+	}
+	return false
+}
+
+// Run runs every check, adding their outcomes to d.Checks. The checks
+// needing a valid config file are skipped when it is not.
+func (d *Doctor) Run() {
+	d.checkConfig()
+	d.checkPermissions()
+	if !ValidateConfig() {
+		return
+	}
+	gists := []gistDir{
+		{"accounts", Config.GistID.Accounts, deployHint},
+		{"users", Config.GistID.Users, deployHint},
+		{"static", Config.GistID.Static, deployHint},
+	}
+	if Config.GistID.Index != "" {
+		gists = append(gists, gistDir{IndexDir, Config.GistID.Index, `run "gdir index deploy"`})
+	}
+	for _, gist := range gists {
+		d.checkGistRepo(gist)
+	}
+	d.checkAccounts()
+	if d.Offline {
+		return
+	}
+	for _, gist := range gists {
+		d.checkRawGist(gist)
+	}
+	d.checkWorker()
+}
+
+func (d *Doctor) checkConfig() {
+	problems := ConfigProblems()
+	for _, problem := range problems {
+		d.add("config", CheckFail, setupHint, "%s: %s", problem.Field, problem.Problem)
+	}
+	if len(problems) == 0 {
+		d.add("config", CheckPass, "", "%s has every setting", Config.ConfigFile)
+	}
+}
+
+// checkPermissions checks that the config file and the encrypted accounts
+// and users are private, as they hold the secret key and the credentials.
+func (d *Doctor) checkPermissions() {
+	if runtime.GOOS == "windows" {
+		d.add("permissions", CheckWarn, "", "file permissions are not checked on Windows")
+		return
+	}
+	var loose []string
+	missing := false
+	check := func(path string, info os.FileInfo) {
+		if info.Mode().Perm()&0077 != 0 {
+			loose = append(loose, fmt.Sprintf("%s (%#o)", path, info.Mode().Perm()))
+		}
+	}
+	if info, err := os.Stat(Config.ConfigFile); err != nil {
+		missing = true
+		d.add("permissions", CheckFail, setupHint, "%v", err)
+	} else {
+		check(Config.ConfigFile, info)
+	}
+	for _, dir := range []string{"accounts", "users"} {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			check(path, info)
+			return nil
+		})
+		if err != nil {
+			missing = true
+			d.add("permissions", CheckFail, setupHint, "%v", err)
+		}
+	}
+	switch {
+	case len(loose) > 0:
+		d.add("permissions", CheckWarn,
+			fmt.Sprintf("run \"chmod -R go-rwx %s accounts users\"", Config.ConfigFile),
+			"readable by other users: %s", summarize(loose))
+	case !missing:
+		d.add("permissions", CheckPass, "", "%s, accounts/ and users/ are private", Config.ConfigFile)
+	}
+}
+
+// checkGistRepo checks that the origin of a Gist repo is the configured
+// Gist, pushed to with the configured credentials, and that nothing is left
+// to deploy.
+func (d *Doctor) checkGistRepo(gist gistDir) {
+	name := "gist " + gist.dir
+	r, err := git.PlainOpen(gist.dir)
+	if err != nil {
+		d.add(name, CheckFail, setupHint, "failed to open repo %s: %v", gist.dir, err)
+		return
+	}
+	remote, err := r.Remote("origin")
+	if err != nil || len(remote.Config().URLs) == 0 {
+		d.add(name, CheckFail, setupHint, "repo %s has no origin", gist.dir)
+		return
+	}
+	origin, err := url.Parse(remote.Config().URLs[0])
+	if err != nil {
+		d.add(name, CheckFail, setupHint, "repo %s has an invalid origin", gist.dir)
+		return
+	}
+	if id := strings.TrimSuffix(strings.TrimPrefix(origin.Path, "/"), ".git"); origin.Host != "gist.github.com" || id != gist.id {
+		// the origin carries the token, which is left out
+		d.add(name, CheckFail, setupHint, "repo %s pushes to %s%s instead of Gist %s", gist.dir, origin.Host, origin.Path, gist.id)
+		return
+	}
+	if pass, _ := origin.User.Password(); origin.User.Username() != Config.GistUser || pass != Config.GistToken {
+		d.add(name, CheckWarn, setupHint, "repo %s pushes with other credentials than %s", gist.dir, Config.ConfigFile)
+		return
+	}
+	var status git.Status
+	if w, err := r.Worktree(); err != nil {
+		d.add(name, CheckFail, setupHint, "failed to get git worktree of repo %s: %v", gist.dir, err)
+		return
+	} else if status, err = w.Status(); err != nil {
+		d.add(name, CheckFail, setupHint, "failed to get worktree status of repo %s: %v", gist.dir, err)
+		return
+	}
+	if !status.IsClean() {
+		var changed []string
+		for path := range status {
+			changed = append(changed, path)
+		}
+		sort.Strings(changed)
+		d.add(name, CheckWarn, gist.hint, "repo %s has changes not deployed: %s", gist.dir, summarize(changed))
+		return
+	}
+	d.add(name, CheckPass, "", "repo %s pushes to Gist %s", gist.dir, gist.id)
+}
+
+// checkAccounts checks that every account decrypts, and that the worker
+// knows of each of them.
+func (d *Doctor) checkAccounts() {
+	names, err := AccountFiles()
+	if err != nil {
+		d.add("accounts", CheckFail, setupHint, "%v", err)
+		return
+	}
+	var broken []string
+	for _, name := range names {
+		if err := ReadAccountByPath(filepath.Join("accounts", name), new(Account)); err != nil {
+			broken = append(broken, name)
+		}
+	}
+	if len(broken) > 0 {
+		d.add("accounts", CheckFail, "re-import the accounts with the setup wizard, or restore secret_key of the config file they were encrypted with",
+			"%d of %d accounts fail to decrypt: %s", len(broken), len(names), summarize(broken))
+		return
+	}
+	// the worker fetches the accounts 1 to accounts_count
+	var missing []string
+	for i := uint64(1); i <= Config.AccountsCount; i++ {
+		if _, err := os.Stat(filepath.Join("accounts", strconv.FormatUint(i, 10))); err != nil {
+			missing = append(missing, strconv.FormatUint(i, 10))
+		}
+	}
+	switch {
+	case len(missing) > 0:
+		d.add("accounts", CheckFail,
+			fmt.Sprintf("number the files of accounts/ from 1 to %d, then %s", Config.AccountsCount, deployHint),
+			"the worker fetches accounts 1 to %d, accounts/ lacks %s", Config.AccountsCount, summarize(missing))
+	case uint64(len(names)) != Config.AccountsCount:
+		d.add("accounts", CheckWarn, setupHint, "accounts_count is %d, the worker ignores the other %d accounts/ files",
+			Config.AccountsCount, uint64(len(names))-Config.AccountsCount)
+	default:
+		d.add("accounts", CheckPass, "", "all %d accounts decrypt", len(names))
+	}
+}
+
+// checkRawGist checks that the worker fetches the same files from a Gist as
+// in its local repo.
+func (d *Doctor) checkRawGist(gist gistDir) {
+	name := "raw " + gist.dir
+	fis, err := ioutil.ReadDir(gist.dir)
+	if err != nil {
+		d.add(name, CheckFail, setupHint, "%v", err)
+		return
+	}
+	var files []string
+	for _, info := range fis {
+		if !info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			files = append(files, info.Name())
+		}
+	}
+	httpClient := d.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	parallel := d.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	var mu sync.Mutex
+	var differ, failed []string
+	var fetchErr error
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for _, file := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(file string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			local, err := ioutil.ReadFile(filepath.Join(gist.dir, file))
+			var remote []byte
+			if err == nil {
+				remote, err = fetchRaw(httpClient, GistRawURL(gist.id)+file)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed = append(failed, file)
+				fetchErr = err
+			} else if !bytes.Equal(local, remote) {
+				differ = append(differ, file)
+			}
+		}(file)
+	}
+	wg.Wait()
+	sort.Strings(differ)
+	sort.Strings(failed)
+	switch {
+	case len(failed) > 0:
+		d.add(name, CheckFail, gist.hint, "%d of %d files of Gist %s failed to fetch, %s: %v", len(failed), len(files), gist.id, summarize(failed), fetchErr)
+	case len(differ) > 0:
+		d.add(name, CheckFail, gist.hint+", GitHub serves the previous files for a few minutes after a push",
+			"%d of %d files of Gist %s differ from %s/: %s", len(differ), len(files), gist.id, gist.dir, summarize(differ))
+	default:
+		d.add(name, CheckPass, "", "all %d files of Gist %s match %s/", len(files), gist.id, gist.dir)
+	}
+}
+
+func fetchRaw(httpClient *http.Client, rawURL string) (b []byte, err error) {
+	var resp *http.Response
+	if resp, err = httpClient.Get(rawURL); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// checkWorker checks that the deployed worker script is the one rendered
+// from the local config.
+func (d *Doctor) checkWorker() {
+	name := "worker"
+	script, err := RenderWorker()
+	if err != nil {
+		d.add(name, CheckFail, "", "failed to render the worker: %v", err)
+		return
+	}
+	if err = InitCloudflareAPI(); err != nil {
+		d.add(name, CheckFail, setupHint, "%v", err)
+		return
+	}
+	Cf.AccountID = Config.CloudflareAccount
+	deployed, err := Cf.DownloadWorker(&cloudflare.WorkerRequestParams{ScriptName: Config.CloudflareWorker})
+	if err != nil && strings.Contains(err.Error(), "script_not_found") {
+		d.add(name, CheckFail, deployHint, "worker %s is not deployed", Config.CloudflareWorker)
+		return
+	} else if err != nil {
+		d.add(name, CheckFail, deployHint, "failed to download worker %s: %v", Config.CloudflareWorker, err)
+		return
+	}
+	if deployed.Script != script {
+		d.add(name, CheckFail, deployHint, "worker %s differs from the one rendered from %s", Config.CloudflareWorker, Config.ConfigFile)
+		return
+	}
+	d.add(name, CheckPass, "", "worker %s is up to date", Config.CloudflareWorker)
+}
+
+// WorkerURL returns the workers.dev URL of the worker.
+func WorkerURL() (siteURL string, err error) {
+	if err = InitCloudflareAPI(); err != nil {
+		return
+	}
+	Cf.AccountID = Config.CloudflareAccount
+	var subdomain string
+	if subdomain, err = Cf.GetSubdomain(); err != nil {
+		return
+	}
+	if subdomain == "" {
+		return "", fmt.Errorf("no workers.dev subdomain registered")
+	}
+	return fmt.Sprintf("https://%s.%s.workers.dev", Config.CloudflareWorker, subdomain), nil
+}
+
+// summarize lists the first few items of a long list.
+func summarize(items []string) string {
+	const max = 5
+	if len(items) > max {
+		return fmt.Sprintf("%s and %d more", strings.Join(items[:max], ", "), len(items)-max)
+	}
+	return strings.Join(items, ", ")
+}
@@ -0,0 +1,485 @@
+package core
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDriveAPIURL = "https://www.googleapis.com"
+	DefaultTokenURL    = "https://oauth2.googleapis.com/token"
+	DriveScope         = "https://www.googleapis.com/auth/drive"
+)
+
+// DriveAPIURL returns the base URL of the Google APIs, configurable to point
+// gdir at a local stub.
+func DriveAPIURL() string {
+	if Config.DriveAPIURL != "" {
+		return strings.TrimRight(Config.DriveAPIURL, "/")
+	}
+	return DefaultDriveAPIURL
+}
+
+// TokenURL returns the OAuth2 token endpoint for the account.
+func TokenURL(account *Account) string {
+	if Config.TokenURL != "" {
+		return Config.TokenURL
+	}
+	if account != nil && account.TokenURI != "" {
+		return account.TokenURI
+	}
+	return DefaultTokenURL
+}
+
+// DriveError is an error response of the Google Drive API.
+type DriveError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Errors  []struct {
+		Domain  string `json:"domain"`
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func (e *DriveError) Error() string {
+	if reason := e.Reason(); reason != "" {
+		return fmt.Sprintf("drive API error %d (%s): %s", e.Code, reason, e.Message)
+	}
+	return fmt.Sprintf("drive API error %d: %s", e.Code, e.Message)
+}
+
+// Reason returns the reason of the first error detail, e.g. userRateLimitExceeded.
+func (e *DriveError) Reason() string {
+	if len(e.Errors) > 0 {
+		return e.Errors[0].Reason
+	}
+	return ""
+}
+
+// RateLimited reports whether the request may succeed when retried later.
+func (e *DriveError) RateLimited() bool {
+	switch e.Reason() {
+	case "userRateLimitExceeded", "rateLimitExceeded", "sharingRateLimitExceeded", "backendError":
+		return true
+	}
+	return e.Code == 429 || e.Code >= 500
+}
+
+// RetryDrive calls fn until it succeeds, fails with an error that is not a
+// rate limit, or has been tried attempts times, doubling the delay between
+// tries starting from one second.
+func RetryDrive(attempts int, fn func() error) (err error) {
+	delay := time.Second
+	for i := 0; ; i++ {
+		if err = fn(); err == nil || i+1 >= attempts {
+			return
+		}
+		if e, ok := err.(*DriveError); !ok || !e.RateLimited() {
+			return
+		}
+		time.Sleep(delay + time.Duration(mathrand.Int63n(int64(delay/2))))
+		delay *= 2
+	}
+}
+
+// DriveClient calls the Google Drive API v3 as a single account.
+type DriveClient struct {
+	Account *Account
+	// HTTPClient sends the requests, http.DefaultClient when nil.
+	HTTPClient *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func NewDriveClient(account *Account) *DriveClient {
+	return &DriveClient{Account: account}
+}
+
+func (c *DriveClient) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Drive is a shared drive.
+type Drive struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// AccessToken returns a cached access token, refreshing it when expired.
+func (c *DriveClient) AccessToken() (token string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+	form := url.Values{}
+	switch c.Account.Type {
+	case AccountTypeUser:
+		form.Set("client_id", c.Account.ClientID)
+		form.Set("client_secret", c.Account.ClientSecret)
+		form.Set("refresh_token", c.Account.RefreshToken)
+		form.Set("grant_type", "refresh_token")
+	case AccountTypeService:
+		var jws string
+		if jws, err = c.signJWT(); err != nil {
+			return
+		}
+		form.Set("assertion", jws)
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	default:
+		err = fmt.Errorf("unsupported account type %q of %s", c.Account.Type, c.Account.Label())
+		return
+	}
+	var resp *http.Response
+	if resp, err = c.httpClient().PostForm(TokenURL(c.Account), form); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode token response for %s: %w", c.Account.Label(), err)
+	}
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("failed to get access token for %s: %s %s", c.Account.Label(), result.Error, result.ErrorDescription)
+	}
+	c.token = result.AccessToken
+	c.expires = time.Now().Add(time.Duration(result.ExpiresIn-100) * time.Second)
+	return c.token, nil
+}
+
+func (c *DriveClient) signJWT() (jws string, err error) {
+	var key *rsa.PrivateKey
+	if key, err = parseRSAPrivateKey(c.Account.PrivateKey); err != nil {
+		return "", fmt.Errorf("invalid private key of %s: %w", c.Account.Label(), err)
+	}
+	now := time.Now().Unix() - 10
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": c.Account.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iat":   now,
+		"exp":   now + 3600,
+		"iss":   c.Account.ClientEmail,
+		"aud":   TokenURL(c.Account),
+		"scope": DriveScope,
+	})
+	body := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(body))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return
+	}
+	return body + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func parseRSAPrivateKey(s string) (key *rsa.PrivateKey, err error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	if k, e := x509.ParsePKCS8PrivateKey(block.Bytes); e == nil {
+		var ok bool
+		if key, ok = k.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("not an RSA private key")
+		}
+		return
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// Do sends an authorized request to path under the API base URL and decodes
+// the JSON response into out, if out is not nil.
+func (c *DriveClient) Do(method string, path string, query url.Values, body interface{}, out interface{}) (err error) {
+	var reader io.Reader
+	if body != nil {
+		var b []byte
+		if b, err = json.Marshal(body); err != nil {
+			return
+		}
+		reader = strings.NewReader(string(b))
+	}
+	var req *http.Request
+	u := DriveAPIURL() + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	if req, err = http.NewRequest(method, u, reader); err != nil {
+		return
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	}
+	var resp *http.Response
+	if resp, err = c.Send(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if err = CheckDriveResponse(resp); err != nil {
+		return
+	}
+	if out == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Send authorizes req with the account's access token and sends it.
+func (c *DriveClient) Send(req *http.Request) (resp *http.Response, err error) {
+	var token string
+	if token, err = c.AccessToken(); err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return c.httpClient().Do(req)
+}
+
+// CheckDriveResponse turns a non-2xx response into a *DriveError.
+func CheckDriveResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	var result struct {
+		Error *DriveError `json:"error"`
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if json.Unmarshal(b, &result) == nil && result.Error != nil {
+		if result.Error.Code == 0 {
+			result.Error.Code = resp.StatusCode
+		}
+		return result.Error
+	}
+	return &DriveError{Code: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+}
+
+// ListDrives lists all shared drives visible to the account.
+func (c *DriveClient) ListDrives() (drives []Drive, err error) {
+	query := url.Values{}
+	query.Set("pageSize", "100")
+	query.Set("fields", "nextPageToken,drives(id,name)")
+	for {
+		var result struct {
+			NextPageToken string  `json:"nextPageToken"`
+			Drives        []Drive `json:"drives"`
+		}
+		if err = c.Do("GET", "/drive/v3/drives", query, nil, &result); err != nil {
+			return
+		}
+		drives = append(drives, result.Drives...)
+		if result.NextPageToken == "" {
+			return
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+// GetDrive returns the shared drive with id, if the account can see it.
+func (c *DriveClient) GetDrive(id string) (drive Drive, err error) {
+	query := url.Values{}
+	query.Set("fields", "id,name")
+	err = c.Do("GET", "/drive/v3/drives/"+url.PathEscape(id), query, nil, &drive)
+	return
+}
+
+// Permission is a Drive permission granted to a user or a group.
+type Permission struct {
+	ID           string `json:"id,omitempty"`
+	Type         string `json:"type"`
+	Role         string `json:"role"`
+	EmailAddress string `json:"emailAddress,omitempty"`
+}
+
+// ListPermissions lists the permissions of a file or shared drive.
+func (c *DriveClient) ListPermissions(fileID string) (permissions []Permission, err error) {
+	query := url.Values{}
+	query.Set("pageSize", "100")
+	query.Set("supportsAllDrives", "true")
+	query.Set("fields", "nextPageToken,permissions(id,type,role,emailAddress)")
+	for {
+		var result struct {
+			NextPageToken string       `json:"nextPageToken"`
+			Permissions   []Permission `json:"permissions"`
+		}
+		if err = c.Do("GET", "/drive/v3/files/"+url.PathEscape(fileID)+"/permissions", query, nil, &result); err != nil {
+			return
+		}
+		permissions = append(permissions, result.Permissions...)
+		if result.NextPageToken == "" {
+			return
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+// CreatePermission grants permission on a file or shared drive without
+// sending a notification email.
+func (c *DriveClient) CreatePermission(fileID string, permission Permission) (created Permission, err error) {
+	query := url.Values{}
+	query.Set("supportsAllDrives", "true")
+	query.Set("sendNotificationEmail", "false")
+	query.Set("fields", "id,type,role,emailAddress")
+	err = c.Do("POST", "/drive/v3/files/"+url.PathEscape(fileID)+"/permissions", query, permission, &created)
+	return
+}
+
+// DriveFile is a file or folder in a shared drive.
+type DriveFile struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	MimeType    string   `json:"mimeType"`
+	Size        int64    `json:"size,string,omitempty"`
+	MD5Checksum string   `json:"md5Checksum,omitempty"`
+	Parents     []string `json:"parents,omitempty"`
+	DriveID     string   `json:"driveId,omitempty"`
+}
+
+// driveFileFieldList are the fields of the files returned by DriveClient.
+const driveFileFieldList = "id,name,mimeType,size,md5Checksum,parents,driveId"
+
+// IsFolder reports whether the file is a folder. Shared drives, as returned
+// by GetFile, are folders too.
+func (f *DriveFile) IsFolder() bool {
+	return f.MimeType == folderMimeType
+}
+
+// GetFile returns the metadata of a file, a folder or a shared drive.
+func (c *DriveClient) GetFile(id string) (file DriveFile, err error) {
+	query := url.Values{}
+	query.Set("supportsAllDrives", "true")
+	query.Set("fields", driveFileFieldList)
+	if err = c.Do("GET", "/drive/v3/files/"+url.PathEscape(id), query, nil, &file); err != nil {
+		return
+	}
+	if file.DriveID == id {
+		// the root of a shared drive
+		file.MimeType = folderMimeType
+	}
+	return
+}
+
+// ListDriveFiles returns a page of every file and folder of a shared drive,
+// trashed ones aside, and the token of the next page, empty on the last one.
+func (c *DriveClient) ListDriveFiles(driveID string, pageToken string) (files []DriveFile, next string, err error) {
+	query := url.Values{}
+	query.Set("q", "trashed = false")
+	query.Set("corpora", "drive")
+	query.Set("driveId", driveID)
+	query.Set("pageSize", "1000")
+	query.Set("supportsAllDrives", "true")
+	query.Set("includeItemsFromAllDrives", "true")
+	query.Set("fields", "nextPageToken,files("+driveFileFieldList+")")
+	if pageToken != "" {
+		query.Set("pageToken", pageToken)
+	}
+	var result struct {
+		NextPageToken string      `json:"nextPageToken"`
+		Files         []DriveFile `json:"files"`
+	}
+	if err = c.Do("GET", "/drive/v3/files", query, nil, &result); err != nil {
+		return
+	}
+	return result.Files, result.NextPageToken, nil
+}
+
+// ListChildren lists the files and folders in a folder, trashed ones aside.
+func (c *DriveClient) ListChildren(folderID string) (files []DriveFile, err error) {
+	query := url.Values{}
+	query.Set("q", "'"+strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(folderID)+"' in parents and trashed = false")
+	query.Set("pageSize", "1000")
+	query.Set("supportsAllDrives", "true")
+	query.Set("includeItemsFromAllDrives", "true")
+	query.Set("fields", "nextPageToken,files("+driveFileFieldList+")")
+	for {
+		var result struct {
+			NextPageToken string      `json:"nextPageToken"`
+			Files         []DriveFile `json:"files"`
+		}
+		if err = c.Do("GET", "/drive/v3/files", query, nil, &result); err != nil {
+			return
+		}
+		files = append(files, result.Files...)
+		if result.NextPageToken == "" {
+			return
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+// CopyFile copies a file into the folder parent, server side.
+func (c *DriveClient) CopyFile(id string, parent string) (copied DriveFile, err error) {
+	query := url.Values{}
+	query.Set("supportsAllDrives", "true")
+	query.Set("fields", driveFileFieldList)
+	err = c.Do("POST", "/drive/v3/files/"+url.PathEscape(id)+"/copy", query, map[string]interface{}{"parents": []string{parent}}, &copied)
+	return
+}
+
+// MoveFile moves a file or folder from the folders in from to the folder to.
+func (c *DriveClient) MoveFile(id string, to string, from []string) (moved DriveFile, err error) {
+	query := url.Values{}
+	query.Set("supportsAllDrives", "true")
+	query.Set("addParents", to)
+	query.Set("removeParents", strings.Join(from, ","))
+	query.Set("fields", driveFileFieldList)
+	err = c.Do("PATCH", "/drive/v3/files/"+url.PathEscape(id), query, map[string]interface{}{}, &moved)
+	return
+}
+
+// CreateFolder creates a folder named name in the folder parent.
+func (c *DriveClient) CreateFolder(parent string, name string) (folder DriveFile, err error) {
+	query := url.Values{}
+	query.Set("supportsAllDrives", "true")
+	query.Set("fields", driveFileFieldList)
+	err = c.Do("POST", "/drive/v3/files", query, map[string]interface{}{"name": name, "parents": []string{parent}, "mimeType": folderMimeType}, &folder)
+	return
+}
+
+// CreateUploadSession starts a resumable upload of a file of size bytes into
+// the folder parent, and returns the URL of the session to send the content
+// to.
+func (c *DriveClient) CreateUploadSession(parent string, name string, mimeType string, size int64) (sessionURL string, err error) {
+	body, _ := json.Marshal(map[string]interface{}{"name": name, "parents": []string{parent}})
+	var req *http.Request
+	if req, err = http.NewRequest("POST", DriveAPIURL()+"/upload/drive/v3/files?uploadType=resumable&supportsAllDrives=true&fields="+url.QueryEscape(driveFileFieldList), strings.NewReader(string(body))); err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", mimeType)
+	req.Header.Set("X-Upload-Content-Length", fmt.Sprint(size))
+	var resp *http.Response
+	if resp, err = c.Send(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if err = CheckDriveResponse(resp); err != nil {
+		return
+	}
+	if sessionURL = resp.Header.Get("Location"); sessionURL == "" {
+		err = fmt.Errorf("no upload session URL returned for %s", name)
+	}
+	return
+}
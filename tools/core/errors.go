@@ -3,3 +3,4 @@ package core
 import "errors"
 
 var ErrUserNotExists = errors.New("user not exists")
+var ErrTOTPNotEnabled = errors.New("two-factor authentication is not enabled for this user")
@@ -0,0 +1,89 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DriveRoles are the roles that can be granted on a shared drive.
+var DriveRoles = []string{"reader", "commenter", "writer", "fileOrganizer", "organizer"}
+
+// GrantResult reports the changes made by GrantDriveAccess.
+type GrantResult struct {
+	Granted []string
+	Skipped []string
+	Failed  []error
+}
+
+// ValidateDriveRole checks that role can be granted on a shared drive.
+func ValidateDriveRole(role string) error {
+	for _, r := range DriveRoles {
+		if r == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid role %q, expected one of %s", role, strings.Join(DriveRoles, ", "))
+}
+
+// PoolEmails returns the client emails of the service accounts in accounts.
+// User accounts have no client email and are returned as skipped.
+func PoolEmails(accounts []*Account) (emails []string, skipped []*Account) {
+	seen := map[string]bool{}
+	for _, account := range accounts {
+		if account.ClientEmail == "" {
+			skipped = append(skipped, account)
+			continue
+		}
+		if email := strings.ToLower(account.ClientEmail); !seen[email] {
+			seen[email] = true
+			emails = append(emails, account.ClientEmail)
+		}
+	}
+	return
+}
+
+// GrantDriveAccess uses admin to grant role on the shared drive to every
+// grantee of the given type ("user" or "group"). Grantees that already have
+// a permission on the drive are skipped, whatever their role. Requests hitting
+// rate limits are retried with backoff.
+func GrantDriveAccess(admin *Account, driveID string, role string, granteeType string, grantees []string, dryRun bool) (result GrantResult, err error) {
+	var permissions []Permission
+	client := NewDriveClient(admin)
+	if err = RetryDrive(6, func() (err error) {
+		permissions, err = client.ListPermissions(driveID)
+		return
+	}); err != nil {
+		return
+	}
+	existing := map[string]string{}
+	for _, permission := range permissions {
+		if permission.EmailAddress != "" {
+			existing[strings.ToLower(permission.EmailAddress)] = permission.Role
+		}
+	}
+	for _, email := range grantees {
+		if r, ok := existing[strings.ToLower(email)]; ok {
+			fmt.Printf("    %s already has role %s, skipped\n", email, r)
+			result.Skipped = append(result.Skipped, email)
+			continue
+		}
+		if dryRun {
+			fmt.Printf("    %s would be granted %s\n", email, role)
+			result.Granted = append(result.Granted, email)
+			continue
+		}
+		permission := Permission{Type: granteeType, Role: role, EmailAddress: email}
+		if e := RetryDrive(6, func() (err error) {
+			_, err = client.CreatePermission(driveID, permission)
+			return
+		}); e != nil {
+			fmt.Printf("    %s failed: %v\n", email, e)
+			result.Failed = append(result.Failed, fmt.Errorf("%s: %w", email, e))
+			continue
+		}
+		fmt.Printf("    %s granted %s\n", email, role)
+		existing[strings.ToLower(email)] = role
+		result.Granted = append(result.Granted, email)
+	}
+	return
+}
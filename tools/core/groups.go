@@ -0,0 +1,159 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DriveGroupPrefix marks a drive group reference in users' access lists.
+const DriveGroupPrefix = "@"
+
+var driveGroupNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// ValidateDriveGroupName checks that name can be referenced as @name.
+func ValidateDriveGroupName(name string) error {
+	if !driveGroupNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid drive group name %q: use only letters, digits, underscore and hyphen", name)
+	}
+	return nil
+}
+
+// UserDriveListSource returns the access list as the admin entered it, with
+// group references kept unexpanded.
+func UserDriveListSource(list []string, refs []string) []string {
+	if len(refs) > 0 {
+		return refs
+	}
+	return list
+}
+
+// ExpandUserDriveGroups expands the group references in the user's access
+// lists into drive IDs, remembering the references to re-expand them later.
+func ExpandUserDriveGroups(user *User) (err error) {
+	if user.DrivesAllowList, user.DrivesAllowListRefs, err = expandDriveList(user.DrivesAllowList, user.DrivesAllowListRefs); err != nil {
+		return
+	}
+	user.DrivesBlockList, user.DrivesBlockListRefs, err = expandDriveList(user.DrivesBlockList, user.DrivesBlockListRefs)
+	return
+}
+
+func expandDriveList(list []string, refs []string) (expanded []string, newRefs []string, err error) {
+	source := UserDriveListSource(list, refs)
+	seen := map[string]bool{}
+	add := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			expanded = append(expanded, id)
+		}
+	}
+	hasGroups := false
+	for _, entry := range source {
+		if !strings.HasPrefix(entry, DriveGroupPrefix) {
+			add(entry)
+			continue
+		}
+		hasGroups = true
+		name := strings.TrimPrefix(entry, DriveGroupPrefix)
+		drives, ok := Config.DriveGroups[name]
+		if !ok {
+			err = fmt.Errorf("unknown drive group: %s", entry)
+			return
+		}
+		for _, id := range drives {
+			add(id)
+		}
+	}
+	if hasGroups {
+		newRefs = source
+	}
+	return
+}
+
+// FormatUserDriveList formats an access list for display, as its drives with
+// their names, or its group references and the number of drives they expand to.
+func FormatUserDriveList(list []string, refs []string) string {
+	if len(refs) == 0 {
+		names := make([]string, len(list))
+		for i, id := range list {
+			names[i] = FormatDriveID(id)
+		}
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s (%d drives)", strings.Join(refs, ","), len(list))
+}
+
+func ListDriveGroups() {
+	var names []string
+	for name := range Config.DriveGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		fmt.Println("No drive groups defined.")
+	}
+	for _, name := range names {
+		fmt.Printf("%s%s: %s\n", DriveGroupPrefix, name, strings.Join(Config.DriveGroups[name], ","))
+	}
+}
+
+// SetDriveGroup defines or replaces a drive group, or removes it when drives
+// is empty, and saves the config file.
+func SetDriveGroup(name string, drives []string) (err error) {
+	if err = ValidateDriveGroupName(name); err != nil {
+		return
+	}
+	if len(drives) == 0 {
+		delete(Config.DriveGroups, name)
+	} else {
+		if Config.DriveGroups == nil {
+			Config.DriveGroups = map[string][]string{}
+		}
+		Config.DriveGroups[name] = drives
+	}
+	return SaveConfigFile()
+}
+
+// UsersReferencingDriveGroup returns the users whose access lists reference
+// the drive group name.
+func UsersReferencingDriveGroup(name string) (users []User, err error) {
+	ref := DriveGroupPrefix + name
+	err = ForEachUser(func(userPath string, user *User) error {
+		for _, entry := range append(append([]string{}, user.DrivesAllowListRefs...), user.DrivesBlockListRefs...) {
+			if entry == ref {
+				users = append(users, *user)
+				break
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// ResaveUsersForDriveGroup re-expands the group in every user referencing it.
+// It returns the number of users saved.
+func ResaveUsersForDriveGroup(name string, confirm bool) (saved int, err error) {
+	var users []User
+	if users, err = UsersReferencingDriveGroup(name); err != nil {
+		return
+	}
+	if len(users) == 0 {
+		fmt.Printf("No users reference %s%s.\n", DriveGroupPrefix, name)
+		return
+	}
+	fmt.Printf("Users referencing %s%s:\n", DriveGroupPrefix, name)
+	for _, user := range users {
+		fmt.Printf("    %s\n", user.Name)
+	}
+	if confirm && !PromptYesNoWithDefault(fmt.Sprintf("Re-save and redeploy these %d users?", len(users)), true) {
+		return
+	}
+	for i := range users {
+		if err = SaveUser(&users[i]); err != nil {
+			return
+		}
+		saved++
+	}
+	return
+}
@@ -0,0 +1,426 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IndexDir is the gist directory holding the encrypted search index.
+const IndexDir = "index"
+
+// IndexNamespace is the encryption namespace of the search index files.
+const IndexNamespace = "index"
+
+// indexVersion is the format of the index files, checked by the worker.
+const indexVersion = 1
+
+// IndexManifest lists the drives of the search index. It is stored in
+// IndexDir as IndexFileName(""), each drive as IndexFileName(drive ID).
+type IndexManifest struct {
+	Version int          `json:"v"`
+	Built   int64        `json:"built"`
+	Drives  []IndexDrive `json:"drives"`
+}
+
+// IndexDrive is a drive of the manifest.
+type IndexDrive struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Built   int64  `json:"built"`
+	Folders int    `json:"folders"`
+	Files   int    `json:"files"`
+}
+
+// IndexShard is the index of a shared drive. Folders[0] is the drive itself.
+// Folders and files refer to their parent by its position in Folders, -1
+// when unknown, and files to their MIME type by its position in MimeTypes.
+type IndexShard struct {
+	Version   int           `json:"v"`
+	Drive     string        `json:"drive"`
+	Name      string        `json:"name"`
+	Built     int64         `json:"built"`
+	MimeTypes []string      `json:"mimeTypes"`
+	Folders   []IndexFolder `json:"folders"`
+	Files     []IndexFile   `json:"files"`
+}
+
+// IndexFolder is a folder of a shard, encoded as [id, name, parent].
+type IndexFolder struct {
+	ID     string
+	Name   string
+	Parent int
+}
+
+func (f IndexFolder) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{f.ID, f.Name, f.Parent})
+}
+
+func (f *IndexFolder) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, &[]interface{}{&f.ID, &f.Name, &f.Parent})
+}
+
+// IndexFile is a file of a shard, encoded as [id, name, folder, size, mimeType].
+type IndexFile struct {
+	ID       string
+	Name     string
+	Folder   int
+	Size     int64
+	MimeType int
+}
+
+func (f IndexFile) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{f.ID, f.Name, f.Folder, f.Size, f.MimeType})
+}
+
+func (f *IndexFile) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, &[]interface{}{&f.ID, &f.Name, &f.Folder, &f.Size, &f.MimeType})
+}
+
+// Path returns the path of folder i, starting with the drive name.
+func (shard *IndexShard) Path(i int) string {
+	var names []string
+	// bounded by the number of folders, in case of cycles
+	for n := 0; i >= 0 && i < len(shard.Folders) && n <= len(shard.Folders); n++ {
+		names = append(names, shard.Folders[i].Name)
+		i = shard.Folders[i].Parent
+	}
+	p := ""
+	for j := len(names) - 1; j >= 0; j-- {
+		p += "/" + names[j]
+	}
+	return p
+}
+
+// IndexMatch is a folder or a file found by IndexShard.Search, as returned
+// by /api/indexSearch.
+type IndexMatch struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	MimeType string   `json:"mimeType"`
+	Size     string   `json:"size,omitempty"`
+	Parents  []string `json:"parents"`
+	DriveID  string   `json:"driveId"`
+	Path     string   `json:"path"`
+}
+
+// Search returns up to limit folders and files with every term in their
+// lower cased names, leaving out those for which allowed returns false.
+// allowed is given the ID of the match followed by those of its ancestors.
+func (shard *IndexShard) Search(terms []string, limit int, allowed func(ids []string) bool) (matches []IndexMatch) {
+	match := func(name string, id string, parent int) bool {
+		name = strings.ToLower(name)
+		for _, term := range terms {
+			if !strings.Contains(name, term) {
+				return false
+			}
+		}
+		ids := []string{id}
+		for n := 0; parent >= 0 && parent < len(shard.Folders) && n <= len(shard.Folders); n++ {
+			ids = append(ids, shard.Folders[parent].ID)
+			parent = shard.Folders[parent].Parent
+		}
+		return allowed(ids)
+	}
+	parents := func(i int) []string {
+		if i < 0 || i >= len(shard.Folders) {
+			return []string{}
+		}
+		return []string{shard.Folders[i].ID}
+	}
+	for i := 1; i < len(shard.Folders) && len(matches) < limit; i++ {
+		folder := shard.Folders[i]
+		if match(folder.Name, folder.ID, folder.Parent) {
+			matches = append(matches, IndexMatch{
+				ID:       folder.ID,
+				Name:     folder.Name,
+				MimeType: folderMimeType,
+				Parents:  parents(folder.Parent),
+				DriveID:  shard.Drive,
+				Path:     shard.Path(i),
+			})
+		}
+	}
+	for i := 0; i < len(shard.Files) && len(matches) < limit; i++ {
+		file := shard.Files[i]
+		if match(file.Name, file.ID, file.Folder) {
+			mimeType := ""
+			if file.MimeType >= 0 && file.MimeType < len(shard.MimeTypes) {
+				mimeType = shard.MimeTypes[file.MimeType]
+			}
+			matches = append(matches, IndexMatch{
+				ID:       file.ID,
+				Name:     file.Name,
+				MimeType: mimeType,
+				Size:     strconv.FormatInt(file.Size, 10),
+				Parents:  parents(file.Folder),
+				DriveID:  shard.Drive,
+				Path:     shard.Path(file.Folder) + "/" + file.Name,
+			})
+		}
+	}
+	return
+}
+
+// IndexFileName returns the name of the index file of a drive, or of the
+// manifest when drive is empty, as the worker computes it.
+func IndexFileName(drive string) string {
+	hash := sha256.Sum256([]byte(Config.SecretKey + ":index:" + drive))
+	return hex.EncodeToString(hash[:])
+}
+
+func readIndexFile(name string, v interface{}) (err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile(filepath.Join(IndexDir, name)); err != nil {
+		return
+	}
+	if b, err = GCMDecrypt(Config.SecretKey, IndexNamespace, b); err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", filepath.Join(IndexDir, name), err)
+	}
+	return json.Unmarshal(b, v)
+}
+
+func writeIndexFile(name string, v interface{}) (err error) {
+	var b []byte
+	if b, err = json.Marshal(v); err != nil {
+		return
+	}
+	if b, err = GCMEncrypt(Config.SecretKey, IndexNamespace, b); err != nil {
+		return
+	}
+	if err = os.MkdirAll(IndexDir, 0700); err != nil {
+		return
+	}
+	return ioutil.WriteFile(filepath.Join(IndexDir, name), b, 0644)
+}
+
+// ReadIndexManifest reads the local manifest, empty when no index was built.
+func ReadIndexManifest() (manifest *IndexManifest, err error) {
+	manifest = &IndexManifest{Version: indexVersion}
+	if err = readIndexFile(IndexFileName(""), manifest); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// indexCache keeps the shards read by LoadIndexShard until their file changes.
+var indexCache struct {
+	sync.Mutex
+	shards map[string]*IndexShard
+	times  map[string]time.Time
+}
+
+// LoadIndexShard reads the local index of a drive, cached while unchanged.
+func LoadIndexShard(drive string) (shard *IndexShard, err error) {
+	var info os.FileInfo
+	if info, err = os.Stat(filepath.Join(IndexDir, IndexFileName(drive))); err != nil {
+		return
+	}
+	indexCache.Lock()
+	defer indexCache.Unlock()
+	if shard = indexCache.shards[drive]; shard != nil && indexCache.times[drive].Equal(info.ModTime()) {
+		return
+	}
+	if shard, err = ReadIndexShard(drive); err != nil {
+		return
+	}
+	if indexCache.shards == nil {
+		indexCache.shards = map[string]*IndexShard{}
+		indexCache.times = map[string]time.Time{}
+	}
+	indexCache.shards[drive] = shard
+	indexCache.times[drive] = info.ModTime()
+	return
+}
+
+// ReadIndexShard reads the local index of a drive.
+func ReadIndexShard(drive string) (shard *IndexShard, err error) {
+	shard = new(IndexShard)
+	if err = readIndexFile(IndexFileName(drive), shard); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// IndexBuilder crawls shared drives with the account pool into the search
+// index, each drive with the accounts serving it.
+type IndexBuilder struct {
+	Accounts []*Account
+	// Parallel is the number of drives crawled at once.
+	Parallel int
+}
+
+// Build crawls drives and writes their index files and the manifest. The
+// other drives of the manifest are kept, unless prune is set, in which case
+// their files are removed.
+func (b *IndexBuilder) Build(drives []string, prune bool) (manifest *IndexManifest, err error) {
+	if manifest, err = ReadIndexManifest(); err != nil {
+		return
+	}
+	parallel := b.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	built := make([]*IndexShard, len(drives))
+	var failed []string
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for i, drive := range drives {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, drive string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			shard, err := b.crawl(drive)
+			if err == nil {
+				err = writeIndexFile(IndexFileName(drive), shard)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				fmt.Printf("    %s failed: %v\n", drive, err)
+				failed = append(failed, drive)
+				return
+			}
+			built[i] = shard
+			fmt.Printf("    %s [%s]: %d folders, %d files\n", shard.Name, drive, len(shard.Folders)-1, len(shard.Files))
+		}(i, drive)
+	}
+	wg.Wait()
+
+	entries := map[string]IndexDrive{}
+	if !prune {
+		for _, entry := range manifest.Drives {
+			entries[entry.ID] = entry
+		}
+	}
+	for _, shard := range built {
+		if shard != nil {
+			entries[shard.Drive] = IndexDrive{ID: shard.Drive, Name: shard.Name, Built: shard.Built, Folders: len(shard.Folders) - 1, Files: len(shard.Files)}
+		}
+	}
+	if prune {
+		// drives failing to crawl keep their previous index
+		for _, entry := range manifest.Drives {
+			if containsString(failed, entry.ID) {
+				entries[entry.ID] = entry
+			}
+		}
+		if err = pruneIndexFiles(entries); err != nil {
+			return
+		}
+	}
+	manifest.Version = indexVersion
+	manifest.Built = time.Now().Unix()
+	manifest.Drives = []IndexDrive{}
+	for _, entry := range entries {
+		manifest.Drives = append(manifest.Drives, entry)
+	}
+	sort.Slice(manifest.Drives, func(i, j int) bool {
+		if manifest.Drives[i].Name != manifest.Drives[j].Name {
+			return manifest.Drives[i].Name < manifest.Drives[j].Name
+		}
+		return manifest.Drives[i].ID < manifest.Drives[j].ID
+	})
+	if err = writeIndexFile(IndexFileName(""), manifest); err != nil {
+		return
+	}
+	if len(failed) > 0 {
+		err = fmt.Errorf("%d of %d drives failed, run the command again to retry them", len(failed), len(drives))
+	}
+	return
+}
+
+// pruneIndexFiles removes the files of IndexDir other than the manifest and
+// the files of drives, leaving the git metadata alone.
+func pruneIndexFiles(drives map[string]IndexDrive) (err error) {
+	keep := map[string]bool{IndexFileName(""): true}
+	for id := range drives {
+		keep[IndexFileName(id)] = true
+	}
+	var infos []os.FileInfo
+	if infos, err = ioutil.ReadDir(IndexDir); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if info.IsDir() || keep[info.Name()] {
+			continue
+		}
+		if err = os.Remove(filepath.Join(IndexDir, info.Name())); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// crawl lists every file of a drive.
+func (b *IndexBuilder) crawl(drive string) (shard *IndexShard, err error) {
+	var files []DriveFile
+	var info Drive
+	if err = CrawlDrive(b.Accounts, drive, "", func(d Drive, page []DriveFile, next string) error {
+		info = d
+		files = append(files, page...)
+		if next != "" && len(files)%10000 < len(page) {
+			fmt.Printf("    %s [%s]: %d listed so far\n", d.Name, drive, len(files))
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	return newIndexShard(info, files), nil
+}
+
+// newIndexShard builds the index of a drive from its files.
+func newIndexShard(drive Drive, files []DriveFile) (shard *IndexShard) {
+	shard = &IndexShard{
+		Version:   indexVersion,
+		Drive:     drive.ID,
+		Name:      drive.Name,
+		Built:     time.Now().Unix(),
+		MimeTypes: []string{},
+		Folders:   []IndexFolder{{ID: drive.ID, Name: drive.Name, Parent: -1}},
+		Files:     []IndexFile{},
+	}
+	folders := map[string]int{drive.ID: 0}
+	for _, file := range files {
+		if file.IsFolder() {
+			folders[file.ID] = len(shard.Folders)
+			shard.Folders = append(shard.Folders, IndexFolder{ID: file.ID, Name: file.Name})
+		}
+	}
+	parent := func(file DriveFile) int {
+		for _, id := range file.Parents {
+			if i, ok := folders[id]; ok {
+				return i
+			}
+		}
+		return -1
+	}
+	mimeTypes := map[string]int{}
+	for _, file := range files {
+		if file.IsFolder() {
+			shard.Folders[folders[file.ID]].Parent = parent(file)
+			continue
+		}
+		mimeType, ok := mimeTypes[file.MimeType]
+		if !ok {
+			mimeType = len(shard.MimeTypes)
+			mimeTypes[file.MimeType] = mimeType
+			shard.MimeTypes = append(shard.MimeTypes, file.MimeType)
+		}
+		shard.Files = append(shard.Files, IndexFile{ID: file.ID, Name: file.Name, Folder: parent(file), Size: file.Size, MimeType: mimeType})
+	}
+	return
+}
@@ -0,0 +1,223 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// LegacyRoot is a drive root of a GDIndex or GoIndex deployment.
+type LegacyRoot struct {
+	ID   string
+	Name string
+	User string
+	Pass string
+}
+
+// LegacyIndex holds the values extracted from a GDIndex or GoIndex worker
+// script.
+type LegacyIndex struct {
+	Accounts []*Account
+	Roots    []LegacyRoot
+}
+
+var (
+	jsPairPattern  = regexp.MustCompile(`["']?([A-Za-z_$][\w$]*)["']?\s*:\s*("(?:[^"\\\n]|\\.)*"|'(?:[^'\\\n]|\\.)*'|` + "`[^`]*`" + `)`)
+	jsRootsPattern = regexp.MustCompile(`["']?roots["']?\s*:\s*\[`)
+	slugPattern    = regexp.MustCompile(`[^a-z0-9_.-]+`)
+)
+
+// ParseGDIndexScript extracts the OAuth clients and the roots with their
+// passwords from the worker script of a GDIndex or GoIndex deployment.
+// It recognizes the roots array of GoIndex forks, the root and root_pass of
+// GoIndex, and the default_root_id, user and pass of GDIndex.
+func ParseGDIndexScript(scriptPath string) (index *LegacyIndex, err error) {
+	var b []byte
+	if b, err = ioutil.ReadFile(scriptPath); err != nil {
+		return
+	}
+	src := stripJSComments(string(b))
+	index = new(LegacyIndex)
+
+	var account *Account
+	seen := map[string]bool{}
+	addAccount := func() {
+		if account != nil && account.ClientID != "" && account.ClientSecret != "" && account.RefreshToken != "" && !seen[account.Key()] {
+			seen[account.Key()] = true
+			index.Accounts = append(index.Accounts, account)
+		}
+	}
+	top := map[string]string{}
+	for _, m := range jsPairPattern.FindAllStringSubmatch(src, -1) {
+		key, value := m[1], jsUnquote(m[2])
+		switch key {
+		case "client_id":
+			addAccount()
+			account = &Account{Type: AccountTypeUser, ClientID: value}
+		case "client_secret":
+			if account != nil {
+				account.ClientSecret = value
+			}
+		case "refresh_token":
+			if account != nil {
+				account.RefreshToken = value
+			}
+		}
+		if _, ok := top[key]; !ok {
+			top[key] = value
+		}
+	}
+	addAccount()
+
+	if loc := jsRootsPattern.FindStringIndex(src); loc != nil {
+		for _, object := range jsObjects(src[loc[1]:]) {
+			root := LegacyRoot{}
+			for _, m := range jsPairPattern.FindAllStringSubmatch(object, -1) {
+				value := jsUnquote(m[2])
+				switch m[1] {
+				case "id":
+					root.ID = value
+				case "name":
+					root.Name = value
+				case "user":
+					root.User = value
+				case "pass", "password":
+					root.Pass = value
+				}
+			}
+			if root.ID != "" {
+				index.Roots = append(index.Roots, root)
+			}
+		}
+	} else if top["root"] != "" {
+		index.Roots = append(index.Roots, LegacyRoot{ID: top["root"], Name: top["siteName"], Pass: top["root_pass"]})
+	} else if top["default_root_id"] != "" {
+		index.Roots = append(index.Roots, LegacyRoot{ID: top["default_root_id"], Name: top["title"], User: top["user"], Pass: top["pass"]})
+	}
+	return
+}
+
+// IsSharedDriveID reports whether id looks like the ID of a shared drive
+// rather than of a folder: shared drive IDs start with 0A and are much
+// shorter than the 28 or more characters of file IDs.
+func IsSharedDriveID(id string) bool {
+	return strings.HasPrefix(id, "0A") && len(id) < 24
+}
+
+// LegacyRootUsers turns every root protected by a password into a user whose
+// allow-list holds the root: shared drives go to the drives allow-list and
+// folders to the folders allow-list. Roots sharing a user name and password
+// are merged into one user. Roots that cannot be migrated are reported in
+// skipped.
+func LegacyRootUsers(roots []LegacyRoot) (users []*User, skipped []string) {
+	byName := map[string]*User{}
+	for i, root := range roots {
+		label := root.Name
+		if label == "" {
+			label = root.ID
+		}
+		if root.Pass == "" {
+			skipped = append(skipped, fmt.Sprintf("root %s has no password", label))
+			continue
+		}
+		if root.ID == "root" {
+			skipped = append(skipped, fmt.Sprintf("root %s is a My Drive, gdir only serves shared drives and their folders", label))
+			continue
+		}
+		name := root.User
+		if name == "" {
+			name = strings.Trim(slugPattern.ReplaceAllString(strings.ToLower(root.Name), "-"), "-")
+		}
+		if name == "" {
+			name = fmt.Sprintf("root%d", i)
+		}
+		user, ok := byName[name]
+		if !ok {
+			user = &User{Name: name, Pass: root.Pass}
+			byName[name] = user
+			users = append(users, user)
+		} else if user.Pass != root.Pass {
+			skipped = append(skipped, fmt.Sprintf("root %s has user %s with a different password than another root", label, name))
+			continue
+		}
+		if IsSharedDriveID(root.ID) {
+			user.DrivesAllowList = append(user.DrivesAllowList, root.ID)
+		} else {
+			user.FoldersAllowList = append(user.FoldersAllowList, root.ID)
+		}
+	}
+	return
+}
+
+// stripJSComments removes // and /* */ comments outside of string literals.
+func stripJSComments(src string) string {
+	var sb strings.Builder
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				j = len(src) - 1
+			}
+			sb.WriteString(src[i : j+1])
+			i = j
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			sb.WriteByte('\n')
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			if end := strings.Index(src[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(src)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// jsObjects returns the top level {...} objects of the array starting at src,
+// up to its closing bracket.
+func jsObjects(src string) (objects []string) {
+	depth, start := 0, 0
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; c {
+		case '"', '\'', '`':
+			for i++; i < len(src) && src[i] != c; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+		case '{', '[':
+			if depth == 0 && c == '{' {
+				start = i
+			}
+			depth++
+		case '}', ']':
+			if depth == 0 {
+				return
+			}
+			depth--
+			if depth == 0 && c == '}' {
+				objects = append(objects, src[start:i+1])
+			}
+		}
+	}
+	return
+}
+
+func jsUnquote(s string) string {
+	s = s[1 : len(s)-1]
+	return strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\'`, `'`, "\\`", "`").Replace(s)
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const DefaultAuthURL = "https://accounts.google.com/o/oauth2/auth"
+
+// AuthURL returns the OAuth2 consent endpoint.
+func AuthURL() string {
+	if Config.AuthURL != "" {
+		return Config.AuthURL
+	}
+	return DefaultAuthURL
+}
+
+// AuthorizeUserAccount runs the OAuth2 loopback flow: it listens on
+// 127.0.0.1:port (any free port if 0), prints the consent URL, waits for the
+// redirect and exchanges the code for a refresh token.
+func AuthorizeUserAccount(clientID string, clientSecret string, port int, timeout time.Duration) (account *Account, err error) {
+	var listener net.Listener
+	if listener, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err != nil {
+		return
+	}
+	redirectURI := fmt.Sprintf("http://%s/", listener.Addr().String())
+
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		listener.Close()
+		return
+	}
+	state := hex.EncodeToString(b)
+
+	query := url.Values{}
+	query.Set("client_id", clientID)
+	query.Set("redirect_uri", redirectURI)
+	query.Set("response_type", "code")
+	query.Set("scope", DriveScope)
+	query.Set("access_type", "offline")
+	query.Set("prompt", "consent")
+	query.Set("state", state)
+	fmt.Printf("Open this URL in your browser and grant gdir access to Google Drive:\n\n%s?%s\n\n", AuthURL(), query.Encode())
+	fmt.Printf("Waiting for the consent redirect on %s ...\n", redirectURI)
+
+	type callback struct {
+		code string
+		err  error
+	}
+	done := make(chan callback, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("state") != state {
+			http.Error(w, "Invalid state, please retry from the URL printed by gdir.", http.StatusBadRequest)
+			return
+		}
+		var cb callback
+		if e := q.Get("error"); e != "" {
+			cb.err = fmt.Errorf("consent was not granted: %s", e)
+			fmt.Fprintf(w, "Consent was not granted: %s. You can close this window.\n", e)
+		} else if cb.code = q.Get("code"); cb.code == "" {
+			cb.err = fmt.Errorf("redirect is missing the authorization code")
+			http.Error(w, "Missing authorization code.", http.StatusBadRequest)
+		} else {
+			fmt.Fprintln(w, "gdir received the authorization. You can close this window.")
+		}
+		select {
+		case done <- cb:
+		default:
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+
+	var cb callback
+	select {
+	case cb = <-done:
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out after %v waiting for consent", timeout)
+	}
+	if cb.err != nil {
+		return nil, cb.err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", cb.code)
+	form.Set("client_id", clientID)
+	form.Set("client_secret", clientSecret)
+	form.Set("redirect_uri", redirectURI)
+	var resp *http.Response
+	if resp, err = http.PostForm(TokenURL(nil), form); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var result struct {
+		RefreshToken     string `json:"refresh_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if result.RefreshToken == "" {
+		return nil, fmt.Errorf("no refresh token received: %s", strings.TrimSpace(result.Error+" "+result.ErrorDescription))
+	}
+	return &Account{
+		Type:         AccountTypeUser,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RefreshToken: result.RefreshToken,
+	}, nil
+}
@@ -0,0 +1,311 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// AccountDriveMap maps each shared drive to the indexes of the accounts
+// serving it, in the order of the worker. Drives missing from the map are
+// served by every account.
+func AccountDriveMap() map[string][]int {
+	m := map[string][]int{}
+	for i := 0; i < int(Config.AccountsCount); i++ {
+		for _, drive := range Config.AccountDrives[WorkerAccountFile(i)] {
+			m[drive] = append(m[drive], i)
+		}
+	}
+	return m
+}
+
+// PooledDrives returns the drives that have a pool of accounts.
+func PooledDrives() (drives []string) {
+	seen := map[string]bool{}
+	for _, list := range Config.AccountDrives {
+		for _, drive := range list {
+			if !seen[drive] {
+				seen[drive] = true
+				drives = append(drives, drive)
+			}
+		}
+	}
+	sort.Strings(drives)
+	return
+}
+
+// SetAccountDrives sets the drives served by an account of the pool, removing
+// the account from every pool when drives is empty.
+func SetAccountDrives(file string, drives []string) (err error) {
+	if _, err = os.Stat(filepath.Join("accounts", file)); err != nil {
+		return fmt.Errorf("no account %s in the pool: %w", file, err)
+	}
+	setAccountDrives(file, drives)
+	return SaveConfigFile()
+}
+
+func setAccountDrives(file string, drives []string) {
+	if len(drives) == 0 {
+		delete(Config.AccountDrives, file)
+		return
+	}
+	if Config.AccountDrives == nil {
+		Config.AccountDrives = map[string][]string{}
+	}
+	drives = append([]string{}, drives...)
+	sort.Strings(drives)
+	Config.AccountDrives[file] = drives
+}
+
+// ProbeAccountDrives checks the access of accounts to drives and records the
+// drives each account can reach. Accounts without a definite answer for every
+// drive, because of a token, network or server error, keep their drives.
+func ProbeAccountDrives(accounts []*Account, drives []string, parallel int) (result *AuditResult, err error) {
+	result = AuditAccounts(accounts, drives, parallel)
+	failed := map[string]bool{}
+	for _, err := range result.Errors {
+		var e *AccountError
+		if errors.As(err, &e) {
+			failed[e.Account.File] = true
+		}
+	}
+	for i, account := range accounts {
+		if failed[account.File] {
+			continue
+		}
+		var reachable []string
+		probed := true
+		for j, drive := range drives {
+			switch result.Access[i][j] {
+			case AccessGranted:
+				reachable = append(reachable, drive)
+			case AccessUnknown:
+				probed = false
+			}
+		}
+		if probed {
+			setAccountDrives(account.File, reachable)
+		}
+	}
+	err = SaveConfigFile()
+	return
+}
+
+// PrintAccountDrives prints the drives served by each account of the pool.
+func PrintAccountDrives() (err error) {
+	var files []string
+	if files, err = AccountFiles(); err != nil {
+		return
+	}
+	ResolveDriveNames(PooledDrives())
+	for _, file := range files {
+		drives := Config.AccountDrives[file]
+		if len(drives) == 0 {
+			fmt.Printf("Account %s: all drives\n", file)
+			continue
+		}
+		fmt.Printf("Account %s:\n", file)
+		PrintDriveIDs("    ", drives)
+	}
+	return
+}
+
+// accountFileKeys maps the key of every account of the pool to its file.
+func accountFileKeys() (keys map[string]string, err error) {
+	var accounts []*Account
+	var names []string
+	if names, err = AccountFiles(); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil || len(names) == 0 {
+		return
+	}
+	if accounts, err = LoadAccounts(); err != nil {
+		return
+	}
+	keys = map[string]string{}
+	for _, account := range accounts {
+		keys[account.Key()] = account.File
+	}
+	return
+}
+
+// remapAccountFiles moves the tags and drives of the accounts, recorded by
+// file, to the files now holding the same accounts, and drops those of the
+// accounts no longer in the pool.
+func remapAccountFiles(before map[string]string) (err error) {
+	var after map[string]string
+	if after, err = accountFileKeys(); err != nil {
+		return
+	}
+	moved := map[string]string{}
+	for key, file := range before {
+		if newFile, ok := after[key]; ok {
+			moved[file] = newFile
+		}
+	}
+	remap := func(m map[string][]string) map[string][]string {
+		if len(m) == 0 {
+			return m
+		}
+		out := map[string][]string{}
+		for file, values := range m {
+			if newFile, ok := moved[file]; ok {
+				out[newFile] = values
+			}
+		}
+		return out
+	}
+	Config.AccountTags = remap(Config.AccountTags)
+	Config.AccountDrives = remap(Config.AccountDrives)
+	return
+}
+
+// RemoveAccount deletes an account from the pool, renumbers the following
+// files so that the worker still finds every account, and keeps the tags and
+// drives of the remaining accounts.
+func RemoveAccount(file string) (err error) {
+	var before map[string]string
+	var names []string
+	removed, err := strconv.Atoi(file)
+	if err != nil {
+		return fmt.Errorf("invalid account file %q", file)
+	}
+	if _, err = os.Stat(filepath.Join("accounts", file)); err != nil {
+		return fmt.Errorf("no account %s in the pool: %w", file, err)
+	}
+	if before, err = accountFileKeys(); err != nil {
+		return
+	}
+	if err = os.Remove(filepath.Join("accounts", file)); err != nil {
+		return
+	}
+	if names, err = AccountFiles(); err != nil {
+		return
+	}
+	for _, name := range names {
+		if i, e := strconv.Atoi(name); e == nil && i > removed {
+			if err = os.Rename(filepath.Join("accounts", name), filepath.Join("accounts", strconv.Itoa(i-1))); err != nil {
+				return
+			}
+		}
+	}
+	if Config.AccountsCount > 0 {
+		Config.AccountsCount--
+	}
+	if err = remapAccountFiles(before); err != nil {
+		return
+	}
+	return SaveConfigFile()
+}
+
+// DrivePool returns the accounts serving drive, as the worker picks them:
+// those with drive in their pool, or all accounts when none has.
+func DrivePool(accounts []*Account, drive string) (pool []*Account) {
+	for _, account := range accounts {
+		if containsString(Config.AccountDrives[account.File], drive) {
+			pool = append(pool, account)
+		}
+	}
+	if len(pool) == 0 {
+		pool = accounts
+	}
+	return
+}
+
+// ValidateFolders checks that each of ids is a folder of a shared drive, found
+// by an account of the pool serving the drive.
+func ValidateFolders(ids []string) (err error) {
+	if len(ids) == 0 {
+		return
+	}
+	var accounts []*Account
+	if accounts, err = LoadAccounts(); err != nil {
+		return fmt.Errorf("cannot load accounts to check the folders: %w", err)
+	}
+	for _, id := range ids {
+		var file DriveFile
+		found := false
+		for _, account := range accounts {
+			client := NewDriveClient(account)
+			client.HTTPClient = catalogHTTPClient
+			if file, err = client.GetFile(id); err == nil && containsAccount(DrivePool(accounts, file.DriveID), account) {
+				found = true
+				break
+			}
+		}
+		switch {
+		case !found:
+			return fmt.Errorf("folder %s is not visible to any account of the pool of its drive", id)
+		case !file.IsFolder():
+			return fmt.Errorf("%s is not a folder: %s", id, file.Name)
+		case file.DriveID == "":
+			return fmt.Errorf("folder %s is not in a shared drive", id)
+		}
+	}
+	return nil
+}
+
+func containsAccount(accounts []*Account, account *Account) bool {
+	for _, a := range accounts {
+		if a == account {
+			return true
+		}
+	}
+	return false
+}
+
+// CrawlDrive lists every file of a drive with the accounts of its pool,
+// starting from pageToken, and calls page for each page of files with the
+// token of the next one, empty on the last page. It moves on to the next
+// account when one is rate limited, and leaves out those that cannot reach
+// the drive.
+func CrawlDrive(accounts []*Account, drive string, pageToken string, page func(info Drive, files []DriveFile, next string) error) (err error) {
+	var clients []*DriveClient
+	for _, account := range DrivePool(accounts, drive) {
+		clients = append(clients, NewDriveClient(account))
+	}
+	if len(clients) == 0 {
+		return fmt.Errorf("no accounts in the pool")
+	}
+	next := 0
+	call := func(fn func(client *DriveClient) error) error {
+		return RetryDrive(2*len(clients)+4, func() (err error) {
+			for len(clients) > 0 {
+				i := next % len(clients)
+				err = fn(clients[i])
+				if e, ok := err.(*DriveError); !ok || e.Code != 404 {
+					next = i + 1
+					return
+				}
+				// the account is not a member of the drive
+				clients = append(clients[:i], clients[i+1:]...)
+			}
+			return
+		})
+	}
+
+	var info Drive
+	if err = call(func(client *DriveClient) (err error) {
+		info, err = client.GetDrive(drive)
+		return
+	}); err != nil {
+		return
+	}
+	for {
+		var files []DriveFile
+		var nextToken string
+		if err = call(func(client *DriveClient) (err error) {
+			files, nextToken, err = client.ListDriveFiles(drive, pageToken)
+			return
+		}); err != nil {
+			return
+		}
+		if err = page(info, files, nextToken); err != nil || nextToken == "" {
+			return
+		}
+		pageToken = nextToken
+	}
+}
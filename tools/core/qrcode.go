@@ -0,0 +1,453 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// QRCode is a square matrix of QR code modules, true being dark.
+type QRCode struct {
+	Size    int
+	modules [][]bool
+	isFunc  [][]bool
+}
+
+// QR codes are encoded in byte mode with error correction level M. Versions
+// 1 to 10 are enough for otpauth:// URIs and keep the tables short.
+var qrECCPerBlock = [...]int{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26}
+var qrNumBlocks = [...]int{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5}
+
+const qrMaxVersion = 10
+const qrFormatBitsM = 0
+
+// EncodeQRCode encodes text as a QR code using the smallest version that fits.
+func EncodeQRCode(text string) (qr *QRCode, err error) {
+	data := []byte(text)
+	version := 1
+	for ; version <= qrMaxVersion; version++ {
+		if 4+qrCharCountBits(version)+len(data)*8 <= qrNumDataCodewords(version)*8 {
+			break
+		}
+	}
+	if version > qrMaxVersion {
+		err = fmt.Errorf("text too long for QR code: %d bytes", len(data))
+		return
+	}
+
+	var bits qrBitBuffer
+	bits.append(0x4, 4)
+	bits.append(len(data), qrCharCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := qrNumDataCodewords(version) * 8
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		codewords[i>>3] |= byte(bit) << (7 - uint(i&7))
+	}
+
+	size := version*4 + 17
+	qr = &QRCode{Size: size}
+	qr.modules = make([][]bool, size)
+	qr.isFunc = make([][]bool, size)
+	for i := range qr.modules {
+		qr.modules[i] = make([]bool, size)
+		qr.isFunc[i] = make([]bool, size)
+	}
+	qr.drawFunctionPatterns(version)
+	qr.drawCodewords(qrAddECCAndInterleave(version, codewords))
+
+	bestMask, minPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.drawFormatBits(mask)
+		if penalty := qr.penaltyScore(); minPenalty < 0 || penalty < minPenalty {
+			bestMask, minPenalty = mask, penalty
+		}
+		qr.applyMask(mask)
+	}
+	qr.applyMask(bestMask)
+	qr.drawFormatBits(bestMask)
+	qr.isFunc = nil
+	return
+}
+
+// Module reports whether the module at column x and row y is dark.
+func (qr *QRCode) Module(x, y int) bool {
+	return x >= 0 && x < qr.Size && y >= 0 && y < qr.Size && qr.modules[y][x]
+}
+
+// PrintQRCode renders text as a QR code to a terminal using Unicode half
+// blocks, two rows of modules per line, light modules drawn as blocks.
+func PrintQRCode(w io.Writer, text string) (err error) {
+	var qr *QRCode
+	if qr, err = EncodeQRCode(text); err != nil {
+		return
+	}
+	const border = 2
+	var sb strings.Builder
+	for y := -border; y < qr.Size+border; y += 2 {
+		for x := -border; x < qr.Size+border; x++ {
+			top, bottom := !qr.Module(x, y), !qr.Module(x, y+1)
+			if y+1 >= qr.Size+border {
+				bottom = false
+			}
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	_, err = io.WriteString(w, sb.String())
+	return
+}
+
+type qrBitBuffer []int
+
+func (bb *qrBitBuffer) append(val, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*bb = append(*bb, (val>>uint(i))&1)
+	}
+}
+
+func qrCharCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+func qrNumRawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		result -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+func qrNumDataCodewords(version int) int {
+	return qrNumRawDataModules(version)/8 - qrECCPerBlock[version]*qrNumBlocks[version]
+}
+
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	numAlign := version/7 + 2
+	step := (version*4 + numAlign*2 + 1) / (numAlign*2 - 2) * 2
+	result := make([]int, numAlign)
+	result[0] = 6
+	for i, pos := numAlign-1, version*4+17-7; i >= 1; i, pos = i-1, pos-step {
+		result[i] = pos
+	}
+	return result
+}
+
+func qrAddECCAndInterleave(version int, data []byte) (result []byte) {
+	numBlocks := qrNumBlocks[version]
+	blockECCLen := qrECCPerBlock[version]
+	rawCodewords := qrNumRawDataModules(version) / 8
+	numShortBlocks := numBlocks - rawCodewords%numBlocks
+	shortBlockLen := rawCodewords / numBlocks
+
+	divisor := qrReedSolomonDivisor(blockECCLen)
+	blocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		datLen := shortBlockLen - blockECCLen
+		if i >= numShortBlocks {
+			datLen++
+		}
+		dat := data[k : k+datLen]
+		k += datLen
+		block := make([]byte, 0, shortBlockLen+1)
+		block = append(block, dat...)
+		if i < numShortBlocks {
+			block = append(block, 0)
+		}
+		block = append(block, qrReedSolomonRemainder(dat, divisor)...)
+		blocks[i] = block
+	}
+
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			if i != shortBlockLen-blockECCLen || j >= numShortBlocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return
+}
+
+func qrReedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = qrGFMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrGFMultiply(root, 0x02)
+	}
+	return result
+}
+
+func qrReedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= qrGFMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+func qrGFMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+func (qr *QRCode) setFunction(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.isFunc[y][x] = true
+}
+
+func (qr *QRCode) drawFunctionPatterns(version int) {
+	for i := 0; i < qr.Size; i++ {
+		qr.setFunction(6, i, i%2 == 0)
+		qr.setFunction(i, 6, i%2 == 0)
+	}
+
+	qr.drawFinderPattern(3, 3)
+	qr.drawFinderPattern(qr.Size-4, 3)
+	qr.drawFinderPattern(3, qr.Size-4)
+
+	pos := qrAlignmentPositions(version)
+	for i := range pos {
+		for j := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					qr.setFunction(pos[i]+dx, pos[j]+dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// reserve the format areas, the real bits are drawn after masking
+	qr.drawFormatBits(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			bit := (bits>>uint(i))&1 != 0
+			a, b := qr.Size-11+i%3, i/3
+			qr.setFunction(a, b, bit)
+			qr.setFunction(b, a, bit)
+		}
+	}
+}
+
+func (qr *QRCode) drawFinderPattern(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			dist := qrMax(qrAbs(dx), qrAbs(dy))
+			xx, yy := x+dx, y+dy
+			if xx >= 0 && xx < qr.Size && yy >= 0 && yy < qr.Size {
+				qr.setFunction(xx, yy, dist != 2 && dist != 4)
+			}
+		}
+	}
+}
+
+func (qr *QRCode) drawFormatBits(mask int) {
+	data := qrFormatBitsM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		qr.setFunction(8, i, bit(i))
+	}
+	qr.setFunction(8, 7, bit(6))
+	qr.setFunction(8, 8, bit(7))
+	qr.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		qr.setFunction(qr.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.setFunction(8, qr.Size-15+i, bit(i))
+	}
+	qr.setFunction(8, qr.Size-8, true)
+}
+
+func (qr *QRCode) drawCodewords(data []byte) {
+	i := 0
+	for right := qr.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < qr.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = qr.Size - 1 - vert
+				}
+				if !qr.isFunc[y][x] && i < len(data)*8 {
+					qr.modules[y][x] = (data[i>>3]>>(7-uint(i&7)))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (qr *QRCode) applyMask(mask int) {
+	for y := 0; y < qr.Size; y++ {
+		for x := 0; x < qr.Size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !qr.isFunc[y][x] {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// penaltyScore implements the four mask evaluation rules of ISO/IEC 18004.
+func (qr *QRCode) penaltyScore() (result int) {
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+	line := make([]bool, qr.Size)
+	dark := 0
+	for pass := 0; pass < 2; pass++ {
+		for a := 0; a < qr.Size; a++ {
+			for b := 0; b < qr.Size; b++ {
+				if pass == 0 {
+					line[b] = qr.modules[a][b]
+				} else {
+					line[b] = qr.modules[b][a]
+				}
+			}
+			run := 1
+			for b := 1; b <= qr.Size; b++ {
+				if b < qr.Size && line[b] == line[b-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					result += 3 + run - 5
+				}
+				run = 1
+			}
+			for b := 0; b+11 <= qr.Size; b++ {
+				for _, pattern := range finderLike {
+					match := true
+					for k, v := range pattern {
+						if line[b+k] != v {
+							match = false
+							break
+						}
+					}
+					if match {
+						result += 40
+					}
+				}
+			}
+		}
+	}
+	for y := 0; y < qr.Size; y++ {
+		for x := 0; x < qr.Size; x++ {
+			if qr.modules[y][x] {
+				dark++
+			}
+			if x+1 < qr.Size && y+1 < qr.Size {
+				c := qr.modules[y][x]
+				if c == qr.modules[y][x+1] && c == qr.modules[y+1][x] && c == qr.modules[y+1][x+1] {
+					result += 3
+				}
+			}
+		}
+	}
+	total := qr.Size * qr.Size
+	k := (qrAbs(dark*20-total*10)+total-1)/total - 1
+	result += k * 10
+	return
+}
+
+func qrAbs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func qrMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
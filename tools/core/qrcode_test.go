@@ -0,0 +1,259 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestQRCodeRoundTrip(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"gdir",
+		TOTPURI("alice", "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"),
+		TOTPURI(strings.Repeat("user.with.a.long.name", 4), "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"),
+		strings.Repeat("0123456789", 21),
+	} {
+		qr, err := EncodeQRCode(text)
+		if err != nil {
+			t.Errorf("EncodeQRCode(%q): %v", text, err)
+			continue
+		}
+		decoded, err := decodeQRCode(qr)
+		if err != nil {
+			t.Errorf("decoding the QR code of %q: %v", text, err)
+			continue
+		}
+		if decoded != text {
+			t.Errorf("QR code of %q decodes to %q", text, decoded)
+		}
+	}
+}
+
+func TestQRCodeTooLong(t *testing.T) {
+	if _, err := EncodeQRCode(strings.Repeat("x", 300)); err == nil {
+		t.Error("EncodeQRCode accepted a text too long for version 10")
+	}
+}
+
+// QR code tables of ISO/IEC 18004 for error correction level M, kept apart
+// from the encoder so that the decoder checks them.
+var (
+	testQRCodewords    = [...]int{0, 26, 44, 70, 100, 134, 172, 196, 242, 292, 346}
+	testQRBlocks       = [...]int{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5}
+	testQRECCPerBlock  = [...]int{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26}
+	testQRAlignCenters = [...][]int{nil, nil, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34}, {6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50}}
+)
+
+// decodeQRCode reads back a byte mode QR code of error correction level M,
+// checking its format bits and error correction codewords.
+func decodeQRCode(qr *QRCode) (text string, err error) {
+	version := (qr.Size - 17) / 4
+	if version < 1 || version > qrMaxVersion || qr.Size != version*4+17 {
+		return "", fmt.Errorf("unexpected size %d", qr.Size)
+	}
+	isFunc := testQRFunctionModules(version)
+
+	// format bits around the top left finder, bit 14 first
+	var format int
+	for _, p := range [][2]int{
+		{0, 8}, {1, 8}, {2, 8}, {3, 8}, {4, 8}, {5, 8}, {7, 8}, {8, 8},
+		{8, 7}, {8, 5}, {8, 4}, {8, 3}, {8, 2}, {8, 1}, {8, 0},
+	} {
+		format <<= 1
+		if qr.Module(p[0], p[1]) {
+			format |= 1
+		}
+	}
+	format ^= 0x5412
+	rem := format >> 10
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	if rem != format&0x3ff {
+		return "", fmt.Errorf("invalid format bits %015b", format)
+	}
+	if level := format >> 13; level != 0 {
+		return "", fmt.Errorf("error correction level bits %02b, want M", level)
+	}
+	mask := format >> 10 & 7
+
+	// codewords in the zigzag order, unmasked
+	var bits []bool
+	for right := qr.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < qr.Size; vert++ {
+			y := vert
+			if (right+1)&2 == 0 {
+				y = qr.Size - 1 - vert
+			}
+			for x := right; x >= right-1; x-- {
+				if !isFunc[y][x] {
+					bits = append(bits, qr.Module(x, y) != testQRMask(mask, x, y))
+				}
+			}
+		}
+	}
+	codewords := make([]byte, testQRCodewords[version])
+	for i := range codewords {
+		for _, bit := range bits[i*8 : i*8+8] {
+			codewords[i] <<= 1
+			if bit {
+				codewords[i] |= 1
+			}
+		}
+	}
+
+	// de-interleave the blocks, the long ones last, and check their syndromes
+	numBlocks, eccLen := testQRBlocks[version], testQRECCPerBlock[version]
+	numLong := testQRCodewords[version] % numBlocks
+	shortData := testQRCodewords[version]/numBlocks - eccLen
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; i < shortData+1; i++ {
+		for j := range blocks {
+			if i < shortData || j >= numBlocks-numLong {
+				blocks[j] = append(blocks[j], codewords[k])
+				k++
+			}
+		}
+	}
+	for i := 0; i < eccLen; i++ {
+		for j := range blocks {
+			blocks[j] = append(blocks[j], codewords[k])
+			k++
+		}
+	}
+	var data []byte
+	for j, block := range blocks {
+		for i := 0; i < eccLen; i++ {
+			if s := testGFPolyEval(block, testGFExp(i)); s != 0 {
+				return "", fmt.Errorf("block %d has a non-zero syndrome %d", j, i)
+			}
+		}
+		data = append(data, block[:len(block)-eccLen]...)
+	}
+
+	// byte mode segment
+	pos := 0
+	read := func(n int) (v int) {
+		for i := 0; i < n; i++ {
+			v = v<<1 | int(data[pos/8]>>(7-uint(pos%8))&1)
+			pos++
+		}
+		return
+	}
+	if mode := read(4); mode != 0x4 {
+		return "", fmt.Errorf("mode %04b, want byte mode", mode)
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	n := read(countBits)
+	if pos+n*8 > len(data)*8 {
+		return "", fmt.Errorf("%d bytes do not fit the data codewords", n)
+	}
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(read(8))
+	}
+	return string(b), nil
+}
+
+// testQRFunctionModules marks the finder, timing, alignment, format and
+// version modules of a QR code of version.
+func testQRFunctionModules(version int) [][]bool {
+	size := version*4 + 17
+	isFunc := make([][]bool, size)
+	for y := range isFunc {
+		isFunc[y] = make([]bool, size)
+	}
+	rect := func(x0, y0, w, h int) {
+		for y := y0; y < y0+h; y++ {
+			for x := x0; x < x0+w; x++ {
+				isFunc[y][x] = true
+			}
+		}
+	}
+	// finders with their separators and format areas, and the timing patterns
+	rect(0, 0, 9, 9)
+	rect(size-8, 0, 8, 9)
+	rect(0, size-8, 9, 8)
+	rect(6, 0, 1, size)
+	rect(0, 6, size, 1)
+	centers := testQRAlignCenters[version]
+	last := len(centers) - 1
+	for i, cy := range centers {
+		for j, cx := range centers {
+			// no alignment patterns over the finders
+			if i == 0 && (j == 0 || j == last) || i == last && j == 0 {
+				continue
+			}
+			rect(cx-2, cy-2, 5, 5)
+		}
+	}
+	if version >= 7 {
+		rect(size-11, 0, 3, 6)
+		rect(0, size-11, 6, 3)
+	}
+	return isFunc
+}
+
+func testQRMask(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (y+x)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (y+x)%3 == 0
+	case 4:
+		return (y/2+x/3)%2 == 0
+	case 5:
+		return y*x%2+y*x%3 == 0
+	case 6:
+		return (y*x%2+y*x%3)%2 == 0
+	default:
+		return ((y+x)%2+y*x%3)%2 == 0
+	}
+}
+
+// testGFExp returns 2^n in GF(256) with the QR code polynomial 0x11D.
+func testGFExp(n int) byte {
+	v := 1
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if v&0x100 != 0 {
+			v ^= 0x11D
+		}
+	}
+	return byte(v)
+}
+
+// testGFPolyEval evaluates the polynomial of coefficients p, highest degree
+// first, at x in GF(256).
+func testGFPolyEval(p []byte, x byte) (y byte) {
+	for _, c := range p {
+		y = testGFMul(y, x) ^ c
+	}
+	return
+}
+
+func testGFMul(a, b byte) (p byte) {
+	for ; b != 0; b >>= 1 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a&0x80 != 0
+		a <<= 1
+		if carry {
+			a ^= 0x1D
+		}
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RcloneRemote is a section of an rclone.conf file.
+type RcloneRemote struct {
+	Name    string
+	Options map[string]string
+}
+
+// ParseRcloneConfig parses the remotes of an rclone.conf file in order.
+func ParseRcloneConfig(confPath string) (remotes []*RcloneRemote, err error) {
+	var f *os.File
+	if f, err = os.Open(confPath); err != nil {
+		return
+	}
+	defer f.Close()
+	var remote *RcloneRemote
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			remote = &RcloneRemote{Name: strings.TrimSpace(line[1 : len(line)-1]), Options: map[string]string{}}
+			remotes = append(remotes, remote)
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 || remote == nil {
+			return nil, fmt.Errorf("%s:%d: unexpected line %q", confPath, n, line)
+		}
+		remote.Options[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	err = scanner.Err()
+	return
+}
+
+// RcloneAccount turns a drive remote into an account and its JSON. Remotes
+// authorized with a token need their own client ID and secret, since the
+// refresh token is bound to the client that requested it.
+func RcloneAccount(remote *RcloneRemote) (account *Account, b []byte, err error) {
+	opts := remote.Options
+	account = new(Account)
+	switch {
+	case opts["service_account_credentials"] != "":
+		b = []byte(opts["service_account_credentials"])
+	case opts["service_account_file"] != "":
+		if b, err = ioutil.ReadFile(expandHome(opts["service_account_file"])); err != nil {
+			return nil, nil, err
+		}
+	case opts["token"] != "":
+		var token struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err = json.Unmarshal([]byte(opts["token"]), &token); err != nil {
+			return nil, nil, fmt.Errorf("invalid token: %w", err)
+		}
+		if token.RefreshToken == "" {
+			return nil, nil, fmt.Errorf("token has no refresh_token")
+		}
+		if opts["client_id"] == "" || opts["client_secret"] == "" {
+			return nil, nil, fmt.Errorf("uses rclone's built-in client, set client_id and client_secret and reconnect it")
+		}
+		account.Type = AccountTypeUser
+		account.ClientID = opts["client_id"]
+		account.ClientSecret = opts["client_secret"]
+		account.RefreshToken = token.RefreshToken
+		b, err = json.MarshalIndent(account, "", "  ")
+		return
+	default:
+		return nil, nil, fmt.Errorf("has neither a token nor a service account")
+	}
+	if err = json.Unmarshal(b, account); err != nil {
+		return nil, nil, fmt.Errorf("invalid service account JSON: %w", err)
+	}
+	if account.Type != AccountTypeService || account.ClientEmail == "" || account.PrivateKey == "" {
+		return nil, nil, fmt.Errorf("invalid service account JSON")
+	}
+	return
+}
+
+func expandHome(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, p[1:])
+		}
+	}
+	return p
+}
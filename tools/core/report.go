@@ -0,0 +1,412 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// DefaultReportState is the state file an interrupted drive report resumes
+// from.
+const DefaultReportState = ".gdir-report.json"
+
+// DriveReport is the storage usage of shared drives.
+type DriveReport struct {
+	// Usage is the folder tree of the drives, depth first, with the largest
+	// folders first. The drives themselves are at depth 0.
+	Usage []ReportFolder `json:"usage"`
+	// Largest are the largest files, largest first.
+	Largest []ReportFile `json:"largest"`
+	// Duplicates are the files sharing an MD5 checksum, the groups wasting
+	// the most space first.
+	Duplicates []DuplicateGroup `json:"duplicates"`
+}
+
+// ReportFolder is a folder of the usage tree, with the files of its subtree.
+type ReportFolder struct {
+	ID    string `json:"id"`
+	Path  string `json:"path"`
+	Depth int    `json:"depth"`
+	Files int    `json:"files"`
+	Size  int64  `json:"size"`
+}
+
+// ReportFile is a file of a report.
+type ReportFile struct {
+	ID      string `json:"id"`
+	DriveID string `json:"driveId"`
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	MD5     string `json:"md5,omitempty"`
+}
+
+// DuplicateGroup is a set of files with the same content.
+type DuplicateGroup struct {
+	MD5   string       `json:"md5"`
+	Size  int64        `json:"size"`
+	Files []ReportFile `json:"files"`
+	// Wasted is the space taken by all copies but one.
+	Wasted int64 `json:"wasted"`
+}
+
+// ReportBuilder crawls shared drives with the accounts of their pools and
+// sums up their storage.
+type ReportBuilder struct {
+	Accounts []*Account
+	// Parallel is the number of drives crawled at once.
+	Parallel int
+	// StateFile keeps the progress of each drive, so that an interrupted
+	// report resumes where it stopped. The files listed so far are appended to
+	// a file per drive, named after StateFile and the drive. They are all
+	// removed once the report is done.
+	StateFile string
+	// Depth is the number of folder levels below the drives in the usage tree.
+	Depth int
+	// Top is the number of largest files and duplicate groups reported, all
+	// when 0.
+	Top int
+	// Logf reports progress, nothing when nil.
+	Logf func(format string, args ...interface{})
+
+	mu    sync.Mutex
+	state reportState
+}
+
+// reportState is the content of the state file.
+type reportState struct {
+	Drives map[string]*reportDrive `json:"drives"`
+}
+
+// reportDrive is a drive listed up to PageToken, entirely when Done. Its
+// files are kept up to Offset in its files file, past which a page may have
+// been written without its page token being saved.
+type reportDrive struct {
+	Name      string        `json:"name"`
+	PageToken string        `json:"pageToken,omitempty"`
+	Done      bool          `json:"done,omitempty"`
+	Offset    int64         `json:"offset"`
+	Files     []reportEntry `json:"-"`
+}
+
+// reportEntry is a file or a folder of a drive, with short keys to keep the
+// state file of large drives small.
+type reportEntry struct {
+	ID     string `json:"i"`
+	Name   string `json:"n"`
+	Parent string `json:"p,omitempty"`
+	Size   int64  `json:"s,omitempty"`
+	MD5    string `json:"m,omitempty"`
+	Folder bool   `json:"f,omitempty"`
+}
+
+func (b *ReportBuilder) logf(format string, args ...interface{}) {
+	if b.Logf != nil {
+		b.Logf(format, args...)
+	}
+}
+
+func (b *ReportBuilder) load() (err error) {
+	b.state = reportState{Drives: map[string]*reportDrive{}}
+	var data []byte
+	if data, err = ioutil.ReadFile(b.StateFile); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &b.state); err != nil {
+		return fmt.Errorf("invalid state file %s: %w", b.StateFile, err)
+	}
+	if b.state.Drives == nil {
+		b.state.Drives = map[string]*reportDrive{}
+	}
+	for id, d := range b.state.Drives {
+		if err = b.loadFiles(id, d); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// filesFile returns the name of the file the files of drive id are appended to.
+func (b *ReportBuilder) filesFile(id string) string {
+	return b.StateFile + "." + id
+}
+
+// loadFiles reads the files of a drive listed before, dropping those written
+// past its offset.
+func (b *ReportBuilder) loadFiles(id string, d *reportDrive) (err error) {
+	name := b.filesFile(id)
+	if err = os.Truncate(name, d.Offset); os.IsNotExist(err) && d.Offset == 0 {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("invalid state file %s: %w", name, err)
+	}
+	var f *os.File
+	if f, err = os.Open(name); err != nil {
+		return
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	for {
+		var entry reportEntry
+		if err = dec.Decode(&entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid state file %s: %w", name, err)
+		}
+		d.Files = append(d.Files, entry)
+	}
+}
+
+// appendFiles appends a page of files to the files file of drive id, and
+// returns the offset of its end.
+func (b *ReportBuilder) appendFiles(id string, offset int64, entries []reportEntry) (end int64, err error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err = enc.Encode(entry); err != nil {
+			return
+		}
+	}
+	var f *os.File
+	if f, err = os.OpenFile(b.filesFile(id), os.O_WRONLY|os.O_CREATE, 0600); err != nil {
+		return
+	}
+	_, err = f.WriteAt(buf.Bytes(), offset)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return offset + int64(buf.Len()), err
+}
+
+// save writes the state file, with b.mu held. It is small, as the files are
+// kept in the files files of the drives.
+func (b *ReportBuilder) save() (err error) {
+	var data []byte
+	if data, err = json.Marshal(&b.state); err != nil {
+		return
+	}
+	tmp := b.StateFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	return os.Rename(tmp, b.StateFile)
+}
+
+// remove removes the state file and the files files of the drives.
+func (b *ReportBuilder) remove() (err error) {
+	for id := range b.state.Drives {
+		if e := os.Remove(b.filesFile(id)); e != nil && !os.IsNotExist(e) && err == nil {
+			err = e
+		}
+	}
+	if e := os.Remove(b.StateFile); e != nil && !os.IsNotExist(e) && err == nil {
+		err = e
+	}
+	return
+}
+
+// Run crawls drives, resuming from the state file, and sums up their
+// storage. The state file is kept when some drive fails, so that running
+// again retries those drives only.
+func (b *ReportBuilder) Run(drives []string) (report *DriveReport, err error) {
+	if err = b.load(); err != nil {
+		return
+	}
+	parallel := b.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	var failed int
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for _, id := range drives {
+		b.mu.Lock()
+		d := b.state.Drives[id]
+		if d == nil {
+			d = &reportDrive{}
+			b.state.Drives[id] = d
+		}
+		b.mu.Unlock()
+		if d.Done {
+			b.logf("    %s [%s]: %d files and folders listed before\n", d.Name, id, len(d.Files))
+			continue
+		}
+		if d.PageToken != "" {
+			b.logf("    %s [%s]: resuming after %d files and folders\n", d.Name, id, len(d.Files))
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id string, d *reportDrive) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := CrawlDrive(b.Accounts, id, d.PageToken, func(info Drive, files []DriveFile, next string) error {
+				entries := make([]reportEntry, len(files))
+				for i, file := range files {
+					entries[i] = reportEntry{ID: file.ID, Name: file.Name, Size: file.Size, MD5: file.MD5Checksum, Folder: file.IsFolder()}
+					if len(file.Parents) > 0 {
+						entries[i].Parent = file.Parents[0]
+					}
+				}
+				// only this goroutine writes the files of the drive
+				offset, err := b.appendFiles(id, d.Offset, entries)
+				if err != nil {
+					return err
+				}
+				b.mu.Lock()
+				defer b.mu.Unlock()
+				d.Name = info.Name
+				d.Files = append(d.Files, entries...)
+				d.PageToken, d.Done, d.Offset = next, next == "", offset
+				if err := b.save(); err != nil {
+					b.logf("Failed to save %s: %v\n", b.StateFile, err)
+				}
+				if !d.Done && len(d.Files)%10000 < len(files) {
+					b.logf("    %s [%s]: %d listed so far\n", d.Name, id, len(d.Files))
+				}
+				return nil
+			})
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if err != nil {
+				failed++
+				b.logf("    %s failed: %v\n", id, err)
+				return
+			}
+			b.logf("    %s [%s]: %d files and folders listed\n", d.Name, id, len(d.Files))
+		}(id, d)
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		if e := b.save(); e != nil {
+			b.logf("Failed to save %s: %v\n", b.StateFile, e)
+		}
+		return nil, fmt.Errorf("%d of %d drives failed, run the command again to resume", failed, len(drives))
+	}
+	report = &DriveReport{Usage: []ReportFolder{}, Largest: []ReportFile{}, Duplicates: []DuplicateGroup{}}
+	byMD5 := map[string][]ReportFile{}
+	for _, id := range drives {
+		b.summarize(report, id, b.state.Drives[id], byMD5)
+	}
+	sort.Slice(report.Largest, func(i, j int) bool {
+		if report.Largest[i].Size != report.Largest[j].Size {
+			return report.Largest[i].Size > report.Largest[j].Size
+		}
+		return report.Largest[i].Path < report.Largest[j].Path
+	})
+	for md5, files := range byMD5 {
+		if len(files) < 2 {
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+		report.Duplicates = append(report.Duplicates, DuplicateGroup{
+			MD5:    md5,
+			Size:   files[0].Size,
+			Files:  files,
+			Wasted: files[0].Size * int64(len(files)-1),
+		})
+	}
+	sort.Slice(report.Duplicates, func(i, j int) bool {
+		if report.Duplicates[i].Wasted != report.Duplicates[j].Wasted {
+			return report.Duplicates[i].Wasted > report.Duplicates[j].Wasted
+		}
+		return report.Duplicates[i].MD5 < report.Duplicates[j].MD5
+	})
+	if b.Top > 0 && len(report.Largest) > b.Top {
+		report.Largest = report.Largest[:b.Top]
+	}
+	if b.Top > 0 && len(report.Duplicates) > b.Top {
+		report.Duplicates = report.Duplicates[:b.Top]
+	}
+	err = b.remove()
+	return
+}
+
+// summarize adds the usage tree and the files of a drive to report, and its
+// files with a checksum to byMD5.
+func (b *ReportBuilder) summarize(report *DriveReport, id string, d *reportDrive, byMD5 map[string][]ReportFile) {
+	type folder struct {
+		name     string
+		parent   string
+		files    int
+		size     int64
+		children []string
+	}
+	folders := map[string]*folder{id: {name: d.Name}}
+	for _, entry := range d.Files {
+		if entry.Folder {
+			folders[entry.ID] = &folder{name: entry.Name, parent: entry.Parent}
+		}
+	}
+	// entries whose parent is unknown are counted at the root of the drive
+	parentOf := func(parent string) string {
+		if _, ok := folders[parent]; ok {
+			return parent
+		}
+		return id
+	}
+	for fid, f := range folders {
+		if fid != id {
+			f.parent = parentOf(f.parent)
+			folders[f.parent].children = append(folders[f.parent].children, fid)
+		}
+	}
+	paths := map[string]string{}
+	var path func(fid string) string
+	path = func(fid string) string {
+		if p, ok := paths[fid]; ok {
+			return p
+		}
+		// guards against cycles while walking up
+		paths[fid] = "/" + folders[fid].name
+		if fid != id {
+			paths[fid] = path(folders[fid].parent) + "/" + folders[fid].name
+		}
+		return paths[fid]
+	}
+	for _, entry := range d.Files {
+		if entry.Folder {
+			continue
+		}
+		parent := parentOf(entry.Parent)
+		seen := map[string]bool{}
+		for fid := parent; !seen[fid]; fid = folders[fid].parent {
+			seen[fid] = true
+			folders[fid].files++
+			folders[fid].size += entry.Size
+			if fid == id {
+				break
+			}
+		}
+		file := ReportFile{ID: entry.ID, DriveID: id, Path: path(parent) + "/" + entry.Name, Size: entry.Size, MD5: entry.MD5}
+		report.Largest = append(report.Largest, file)
+		if entry.MD5 != "" {
+			byMD5[entry.MD5] = append(byMD5[entry.MD5], file)
+		}
+	}
+	var walk func(fid string, depth int)
+	walk = func(fid string, depth int) {
+		f := folders[fid]
+		report.Usage = append(report.Usage, ReportFolder{ID: fid, Path: path(fid), Depth: depth, Files: f.files, Size: f.size})
+		if depth >= b.Depth {
+			return
+		}
+		sort.Slice(f.children, func(i, j int) bool {
+			a, c := folders[f.children[i]], folders[f.children[j]]
+			if a.size != c.size {
+				return a.size > c.size
+			}
+			return a.name < c.name
+		})
+		for _, child := range f.children {
+			walk(child, depth+1)
+		}
+	}
+	walk(id, 0)
+}
@@ -0,0 +1,302 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/workerindex/gdir/dist"
+)
+
+// RotationParams are the worker settings driving pickAccount.
+type RotationParams struct {
+	Accounts   int
+	Rotation   uint64
+	Candidates uint64
+}
+
+// RotationWindow is the window of candidate accounts picked at a time.
+type RotationWindow struct {
+	Seed       string
+	Digest     string
+	Rand       uint32
+	Candidates []int
+}
+
+// PickWindow is a Go port of the candidate selection of the worker's
+// pickAccountIndex: the window starts at the first little-endian uint32 of
+// sha256(secret + floor(now / 1000 / rotation)) modulo the number of
+// accounts, and spans Candidates consecutive accounts. now is in
+// milliseconds, as Date.now() in the worker.
+func PickWindow(secret string, params RotationParams, now int64) RotationWindow {
+	return pickWindow(secret+strconv.FormatFloat(math.Floor(float64(now)/1000/float64(params.Rotation)), 'f', -1, 64), params)
+}
+
+// StickyWindow is the window of the sticky strategy for a signed in user.
+func StickyWindow(secret string, params RotationParams, user string) RotationWindow {
+	return pickWindow(secret+":sticky:"+user, params)
+}
+
+func pickWindow(seed string, params RotationParams) (window RotationWindow) {
+	if params.Accounts <= int(params.Candidates) {
+		for i := 0; i < params.Accounts; i++ {
+			window.Candidates = append(window.Candidates, i)
+		}
+		return
+	}
+	window.Seed = seed
+	digest := sha256.Sum256(jsStr2Buf(window.Seed))
+	window.Digest = hex.EncodeToString(digest[:])
+	window.Rand = binary.LittleEndian.Uint32(digest[:4])
+	for i, j := int(window.Rand%uint32(params.Accounts)), uint64(0); j < params.Candidates; i, j = (i+1)%params.Accounts, j+1 {
+		window.Candidates = append(window.Candidates, i)
+	}
+	return
+}
+
+// AccountPicker is a Go port of the worker's pickAccountIndex, with rng
+// replacing the unseeded Math.random of the worker.
+type AccountPicker struct {
+	Secret   string
+	Params   RotationParams
+	Strategy string
+	Weights  []float64
+
+	period int64
+	window RotationWindow
+	sticky map[string]RotationWindow
+}
+
+// Pick returns the index of the account picked at now for user, who may be
+// empty for requests without sign in.
+func (p *AccountPicker) Pick(now int64, user string, rng *rand.Rand) int {
+	return p.PickFrom(nil, now, user, rng)
+}
+
+// PickFrom is Pick restricted to the account indexes in pool, as
+// pickAccountIndex(pool) of the worker. A nil pool holds every account.
+func (p *AccountPicker) PickFrom(pool []int, now int64, user string, rng *rand.Rand) int {
+	n := p.Params.Accounts
+	at := func(i int) int { return i }
+	if pool != nil {
+		n = len(pool)
+		at = func(i int) int { return pool[i] }
+	}
+	switch p.Strategy {
+	case StrategyShuffle:
+		return at(int(math.Floor(rng.Float64() * float64(n))))
+	case StrategyWeighted:
+		total := 0.0
+		for i := 0; i < n; i++ {
+			if at(i) < len(p.Weights) {
+				total += p.Weights[at(i)]
+			}
+		}
+		if total > 0 {
+			r := rng.Float64() * total
+			for i := 0; i < n; i++ {
+				if at(i) < len(p.Weights) {
+					r -= p.Weights[at(i)]
+				}
+				if r < 0 {
+					return at(i)
+				}
+			}
+		}
+		return at(int(math.Floor(rng.Float64() * float64(n))))
+	}
+	var window RotationWindow
+	if pool != nil {
+		params := p.Params
+		params.Accounts = n
+		if p.Strategy == StrategySticky && user != "" {
+			window = StickyWindow(p.Secret, params, user)
+		} else {
+			window = PickWindow(p.Secret, params, now)
+		}
+	} else if p.Strategy == StrategySticky && user != "" {
+		if p.sticky == nil {
+			p.sticky = map[string]RotationWindow{}
+		}
+		var ok bool
+		if window, ok = p.sticky[user]; !ok {
+			window = StickyWindow(p.Secret, p.Params, user)
+			p.sticky[user] = window
+		}
+	} else {
+		if period := int64(math.Floor(float64(now) / 1000 / float64(p.Params.Rotation))); period != p.period || p.window.Candidates == nil {
+			p.period = period
+			p.window = PickWindow(p.Secret, p.Params, now)
+		}
+		window = p.window
+	}
+	return at(window.Candidates[int(math.Floor(rng.Float64()*float64(len(window.Candidates))))])
+}
+
+// jsStr2Buf mirrors str2buf of the worker, which keeps the low byte of each
+// UTF-16 code unit.
+func jsStr2Buf(s string) (b []byte) {
+	for _, unit := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(unit))
+	}
+	return
+}
+
+// RotationLoad is the outcome of a rotation simulation.
+type RotationLoad struct {
+	RotationParams
+	Requests      int
+	Counts        []int
+	PeakPerMinute int
+	PeakAccount   int
+	PeakMinute    time.Time
+}
+
+// SimulateRotation sends requests evenly spaced at perMinute per minute for
+// duration from start, each one from a random user out of users (none if 0),
+// picks an account for each one like the worker does and counts the requests
+// per account and per minute.
+func SimulateRotation(picker *AccountPicker, start time.Time, perMinute float64, duration time.Duration, users int, rng *rand.Rand) (load *RotationLoad) {
+	params := picker.Params
+	load = &RotationLoad{RotationParams: params, Counts: make([]int, params.Accounts)}
+	if params.Accounts == 0 || perMinute <= 0 {
+		return
+	}
+	step := time.Duration(float64(time.Minute) / perMinute)
+	minute := int64(-1)
+	perMinuteCounts := make([]int, params.Accounts)
+	for t := start; t.Before(start.Add(duration)); t = t.Add(step) {
+		user := ""
+		if users > 0 {
+			user = fmt.Sprintf("user%d", rng.Intn(users))
+		}
+		if m := t.Unix() / 60; m != minute {
+			minute = m
+			for i := range perMinuteCounts {
+				perMinuteCounts[i] = 0
+			}
+		}
+		i := picker.Pick(t.UnixNano()/int64(time.Millisecond), user, rng)
+		load.Requests++
+		load.Counts[i]++
+		if perMinuteCounts[i]++; perMinuteCounts[i] > load.PeakPerMinute {
+			load.PeakPerMinute = perMinuteCounts[i]
+			load.PeakAccount = i
+			load.PeakMinute = time.Unix(minute*60, 0)
+		}
+	}
+	return
+}
+
+// Idle returns the number of accounts that served no request.
+func (load *RotationLoad) Idle() (idle int) {
+	for _, count := range load.Counts {
+		if count == 0 {
+			idle++
+		}
+	}
+	return
+}
+
+// Max returns the largest number of requests served by one account.
+func (load *RotationLoad) Max() (max int) {
+	for _, count := range load.Counts {
+		if count > max {
+			max = count
+		}
+	}
+	return
+}
+
+var (
+	jsStr2BufPattern  = regexp.MustCompile(`const str2buf = .*;`)
+	jsPickAccountHead = "async pickAccountIndex(pool) {"
+)
+
+// CrossCheckWindow runs the pickAccountIndex of the embedded worker script with
+// Node.js at the given time and returns the candidates it picks, to confirm
+// that PickWindow matches the worker.
+func CrossCheckWindow(secret string, params RotationParams, now int64) (candidates []int, err error) {
+	var node string
+	var b []byte
+	if node, err = exec.LookPath("node"); err != nil {
+		return nil, fmt.Errorf("node is required to run the worker's pickAccountIndex: %w", err)
+	}
+	if b, err = dist.StaticFs.ReadFile("worker.js"); err != nil {
+		return
+	}
+	script := string(b)
+	str2buf := jsStr2BufPattern.FindString(script)
+	method := jsMethod(script, jsPickAccountHead)
+	if str2buf == "" || method == "" {
+		return nil, fmt.Errorf("cannot find pickAccountIndex in the embedded worker script")
+	}
+	args, _ := json.Marshal([]interface{}{secret, params.Accounts, params.Rotation, params.Candidates, now})
+	src := fmt.Sprintf(`globalThis.crypto = globalThis.crypto || require('crypto').webcrypto;
+%s
+const [secret, count, accountRotation, accountCandidates, now] = %s;
+class Drive {
+    constructor(config) { this.config = config; }
+    %s
+}
+Date.now = () => now;
+(async () => {
+    const drive = new Drive({ secret, accounts: Array.from({ length: count }), accountRotation, accountCandidates, accountStrategy: 'window', accountWeights: [] });
+    const n = Math.min(count, accountCandidates), picked = [];
+    for (let k = 0; k < n; ++k) {
+        Math.random = () => (k + 0.5) / n;
+        picked.push(await drive.pickAccountIndex());
+    }
+    console.log(JSON.stringify(picked));
+})();
+`, str2buf, args, method)
+	var f *os.File
+	if f, err = ioutil.TempFile("", "gdir-rotation-*.js"); err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString(src); err != nil {
+		f.Close()
+		return
+	}
+	f.Close()
+	var out []byte
+	if out, err = exec.Command(node, f.Name()).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("node failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	err = json.Unmarshal(out, &candidates)
+	return
+}
+
+// jsMethod returns the source of the method starting with head, up to its
+// matching closing brace.
+func jsMethod(script string, head string) string {
+	start := strings.Index(script, head)
+	if start < 0 {
+		return ""
+	}
+	depth := 0
+	for i := start + len(head) - 1; i < len(script); i++ {
+		switch script[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return script[start : i+1]
+			}
+		}
+	}
+	return ""
+}
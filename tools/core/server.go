@@ -0,0 +1,600 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/workerindex/gdir/dist"
+)
+
+// Server is a Go port of the worker, serving the same API and the embedded UI
+// from the local accounts/ and users/ files for sites that cannot run
+// Cloudflare Workers. Tokens and page tokens are interchangeable with the
+// worker deployed with the same secret key.
+type Server struct {
+	// Accounts are indexed as the accounts of the worker, nil when the
+	// encrypted file is missing.
+	Accounts []*DriveClient
+
+	drives    map[string][]int
+	available []int
+
+	mu     sync.Mutex
+	picker *AccountPicker
+	rng    *rand.Rand
+	// driveIDs caches the shared drive of files and folders, "" for those
+	// outside shared drives
+	driveIDs map[string]string
+}
+
+// driveCacheSize bounds the number of files whose drive is remembered.
+const driveCacheSize = 10000
+
+// NewServer loads the account pool in the order of the worker.
+func NewServer() (s *Server, err error) {
+	params := RotationParams{Accounts: int(Config.AccountsCount), Rotation: Config.AccountRotation, Candidates: Config.AccountCandidates}
+	if params.Rotation == 0 {
+		params.Rotation = 60
+	}
+	if params.Candidates == 0 {
+		params.Candidates = 10
+	}
+	s = &Server{
+		drives: AccountDriveMap(),
+		picker: &AccountPicker{Secret: Config.SecretKey, Params: params, Strategy: AccountStrategy()},
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	var missing []string
+	for i := 0; i < params.Accounts; i++ {
+		account := new(Account)
+		accountPath := filepath.Join("accounts", WorkerAccountFile(i))
+		if _, e := os.Stat(accountPath); os.IsNotExist(e) {
+			s.Accounts = append(s.Accounts, nil)
+			missing = append(missing, accountPath)
+			continue
+		}
+		if err = ReadAccountByPath(accountPath, account); err != nil {
+			return
+		}
+		s.Accounts = append(s.Accounts, NewDriveClient(account))
+		s.available = append(s.available, i)
+	}
+	if len(s.available) == 0 {
+		return nil, fmt.Errorf("no accounts found under accounts/, please run the setup wizard first")
+	}
+	if len(missing) > 0 {
+		log.Printf("left out of the rotation, as they are missing: %s", strings.Join(missing, ", "))
+	}
+	if len(s.available) == len(s.Accounts) {
+		s.available = nil
+	}
+	if s.picker.Strategy == StrategyWeighted {
+		if s.picker.Weights, err = WorkerAccountWeights(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// pick returns the client of an account picked from pool, or from the whole
+// pool when nil, for the signed in user.
+func (s *Server) pick(pool []int, user string) *DriveClient {
+	if s.available != nil {
+		pool = intersectPool(s.available, pool)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Accounts[s.picker.PickFrom(pool, time.Now().UnixNano()/int64(time.Millisecond), user, s.rng)]
+}
+
+// client returns the client of an account decoded from a page token, reusing
+// the cached access token of the pool.
+func (s *Server) client(account *Account) *DriveClient {
+	for _, c := range s.Accounts {
+		if c != nil && c.Account.Key() == account.Key() {
+			return c
+		}
+	}
+	return NewDriveClient(account)
+}
+
+// intersectPool keeps the accounts of pool that are also in available, or
+// returns available when pool is nil or would end up empty.
+func intersectPool(available []int, pool []int) []int {
+	if pool == nil {
+		return available
+	}
+	var kept []int
+	for _, i := range pool {
+		for _, j := range available {
+			if i == j {
+				kept = append(kept, i)
+				break
+			}
+		}
+	}
+	if len(kept) == 0 {
+		return available
+	}
+	return kept
+}
+
+// ServeHTTP is a port of handleRequest of the worker.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := &serverRequest{Server: s, w: w, r: r}
+	if err := req.serve(); err != nil {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serverRequest holds the state of a single request, as the GoogleDrive
+// instance of the worker.
+type serverRequest struct {
+	*Server
+	w    http.ResponseWriter
+	r    *http.Request
+	form map[string][]string
+	user *User
+	pool []int
+	acl  *folderACL
+	// scope is the folder or file a scoped token is restricted to
+	scope    string
+	scopeACL *folderACL
+}
+
+func (req *serverRequest) serve() (err error) {
+	r := req.r
+	if r.Method == "POST" && r.Header.Get("Content-Type") != "" {
+		if err = r.ParseMultipartForm(32 << 20); err == http.ErrNotMultipart {
+			err = r.ParseForm()
+		}
+		if err != nil {
+			return
+		}
+		req.form = r.PostForm
+	}
+
+	if t, ok := req.param("t", true); ok {
+		if err = req.authenticate(t); err != nil {
+			return
+		}
+	}
+	req.acl = &folderACL{req: req, user: req.user, cache: map[string]bool{}}
+	if req.user != nil && req.scope != "" {
+		scoped := *req.user
+		scoped.FoldersAllowList = []string{req.scope}
+		scoped.DrivesAllowList = []string{}
+		req.scopeACL = &folderACL{req: req, user: &scoped, cache: map[string]bool{}}
+	}
+
+	switch p := r.URL.Path; {
+	case p == "/login":
+		if done, err := req.login(); done || err != nil {
+			return err
+		}
+	case p == "/logout":
+		req.redirect("t=deleted; path=/; expires=Thu, 01 Jan 1970 00:00:00 GMT")
+		return
+	case p == "/api/list" && req.can(CapabilityList):
+		if done, err := req.list(); done || err != nil {
+			return err
+		}
+	case p == "/api/search" && req.can(CapabilitySearch):
+		return req.search()
+	case p == "/api/indexSearch" && req.can(CapabilitySearch):
+		if done, err := req.indexSearch(); done || err != nil {
+			return err
+		}
+	case p == "/api/file" && req.can(CapabilityList):
+		if done, err := req.file(); done || err != nil {
+			return err
+		}
+	case p == "/api/copyFileInit" && req.can(CapabilityCopy):
+		if done, err := req.copyFileInit(); done || err != nil {
+			return err
+		}
+	case p == "/api/copyFileExec" && req.can(CapabilityCopy):
+		if done, err := req.copyFileExec(); done || err != nil {
+			return err
+		}
+	case p == "/api/copyFileStat" && req.can(CapabilityCopy):
+		if done, err := req.copyFileStat(); done || err != nil {
+			return err
+		}
+	case p == "/api/mkdir" && req.can(CapabilityCopy):
+		if done, err := req.mkdir(); done || err != nil {
+			return err
+		}
+	case p == "/api/scopedToken" && req.can(CapabilityDownload):
+		if done, err := req.scopedToken(); done || err != nil {
+			return err
+		}
+	case strings.HasPrefix(p, "/file/") && req.can(CapabilityDownload):
+		if done, err := req.download(); done || err != nil {
+			return err
+		}
+	}
+	return req.static()
+}
+
+// param mirrors getParam of the worker: the query overrides the form, and
+// the cookie, when considered, overrides both.
+func (req *serverRequest) param(key string, cookie bool) (val string, ok bool) {
+	if vs, found := req.form[key]; found && len(vs) > 0 {
+		val, ok = vs[0], true
+	}
+	if vs, found := req.r.URL.Query()[key]; found && len(vs) > 0 {
+		val, ok = vs[0], true
+	}
+	if cookie {
+		if c, e := req.r.Cookie(key); e == nil && c.Value != "" {
+			val, ok = c.Value, true
+		}
+	}
+	return
+}
+
+func (req *serverRequest) can(capability string) bool {
+	return req.user != nil && req.user.HasCapability(capability)
+}
+
+// authenticate signs in the user of a token issued by /login, or of a
+// scoped token issued by /api/scopedToken.
+func (req *serverRequest) authenticate(t string) (err error) {
+	var claimed struct {
+		Name  *string `json:"name"`
+		Pass  *string `json:"pass"`
+		Scope *string `json:"scope"`
+		Exp   float64 `json:"exp"`
+	}
+	namespace := "userToken"
+	if strings.HasPrefix(t, "s.") {
+		namespace, t = "scopedToken", t[2:]
+	}
+	// stale or foreign tokens are ignored, leaving the request signed out
+	plaintext, e := DecryptWorkerToken(namespace, t)
+	if e != nil || json.Unmarshal([]byte(plaintext), &claimed) != nil || claimed.Name == nil || claimed.Pass == nil {
+		return
+	}
+	if namespace == "scopedToken" {
+		// scoped tokens only download files under their scope until they expire
+		if claimed.Scope == nil || claimed.Exp <= float64(time.Now().Unix()) || !strings.HasPrefix(req.r.URL.Path, "/file/") {
+			return
+		}
+		req.scope = *claimed.Scope
+	}
+	user := new(User)
+	if err = ReadUser(*claimed.Name, user); err == ErrUserNotExists {
+		return nil
+	} else if err != nil {
+		return
+	}
+	if user.Name == *claimed.Name && user.Pass == *claimed.Pass && activeUser(user) {
+		req.user = user
+	}
+	return
+}
+
+func activeUser(user *User) bool {
+	return !user.Disabled && !user.Expired(time.Now())
+}
+
+// validCodeForUser checks the one-time code of user, spending it when it is
+// a backup code.
+func (req *serverRequest) validCodeForUser(code string, user *User) (valid bool, err error) {
+	if user.TOTPSecret == "" {
+		return true, nil
+	}
+	if code == "" {
+		return false, nil
+	}
+	if ValidateTOTP(user.TOTPSecret, code, time.Now()) {
+		return true, nil
+	}
+	return req.spendBackupCode(user.Name, code)
+}
+
+// spendBackupCode removes a backup code from the saved user, so that it is
+// accepted only once.
+func (req *serverRequest) spendBackupCode(name string, code string) (spent bool, err error) {
+	req.Server.mu.Lock()
+	defer req.Server.mu.Unlock()
+	// read the user again, as another login may have spent the code meanwhile
+	user := new(User)
+	if err = ReadUser(name, user); err != nil {
+		return
+	}
+	hash := HashBackupCode(code)
+	for i, h := range user.TOTPBackupCodes {
+		if h == hash {
+			user.TOTPBackupCodes = append(user.TOTPBackupCodes[:i:i], user.TOTPBackupCodes[i+1:]...)
+			return true, SaveUser(user)
+		}
+	}
+	return
+}
+
+// validTargetForUser checks the drive of a file or folder against the drive
+// lists of the user, unless folder-level access control restricts the user
+// instead.
+func (req *serverRequest) validTargetForUser(id string) bool {
+	if req.acl.enabled() {
+		return true
+	}
+	drive := req.driveOf(id)
+	if drive == "" {
+		drive = id
+	}
+	return validDriveForUser(drive, req.user, true)
+}
+
+// validDriveForUser mirrors the drive lists check of the worker.
+func validDriveForUser(id string, user *User, enforceAllowList bool) bool {
+	if enforceAllowList && user.DrivesAllowList != nil && !containsString(user.DrivesAllowList, id) {
+		return false
+	}
+	return !containsString(user.DrivesBlockList, id)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (req *serverRequest) login() (done bool, err error) {
+	name, _ := req.param("name", false)
+	pass, hasPass := req.param("pass", false)
+	code, _ := req.param("code", false)
+	if name == "" {
+		return
+	}
+	user := new(User)
+	if err = ReadUser(name, user); err == ErrUserNotExists {
+		return false, nil
+	} else if err != nil {
+		return
+	}
+	if user.Name != name || !hasPass || user.Pass != pass || !activeUser(user) {
+		return
+	}
+	var valid bool
+	if valid, err = req.validCodeForUser(code, user); err != nil || !valid {
+		return
+	}
+	var t string
+	if t, err = UserToken(user); err != nil {
+		return
+	}
+	req.redirect("t=" + t)
+	return true, nil
+}
+
+// redirect answers with a redirect to the site root, setting cookie.
+func (req *serverRequest) redirect(cookie string) {
+	scheme := "http"
+	if req.r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := req.r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	req.w.Header().Set("Location", scheme+"://"+req.r.Host)
+	req.w.Header().Set("Set-Cookie", cookie)
+	req.w.WriteHeader(http.StatusTemporaryRedirect)
+}
+
+// UserToken returns the login token of user, as issued by /login.
+func UserToken(user *User) (string, error) {
+	b, err := workerJSON(struct {
+		Name string `json:"name"`
+		Pass string `json:"pass"`
+	}{user.Name, user.Pass})
+	if err != nil {
+		return "", err
+	}
+	return EncryptWorkerToken("userToken", string(b))
+}
+
+// EncryptWorkerToken encrypts s the way the worker encrypts strings into
+// tokens, which keeps the low byte of each UTF-16 code unit.
+func EncryptWorkerToken(namespace string, s string) (token string, err error) {
+	var b []byte
+	if b, err = GCMEncrypt(Config.SecretKey, namespace, jsStr2Buf(s)); err != nil {
+		return
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// DecryptWorkerToken decrypts a token of the worker.
+func DecryptWorkerToken(namespace string, token string) (s string, err error) {
+	var b []byte
+	if b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(token, "=")); err != nil {
+		return "", fmt.Errorf("invalid %s: %w", namespace, err)
+	}
+	if len(b) < 12 {
+		return "", fmt.Errorf("invalid %s: too short", namespace)
+	}
+	if b, err = GCMDecrypt(Config.SecretKey, namespace, b); err != nil {
+		return "", fmt.Errorf("invalid %s: %w", namespace, err)
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes), nil
+}
+
+// workerJSON encodes v as JSON.stringify does.
+func workerJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+func (req *serverRequest) writeJSON(v interface{}) (err error) {
+	var b []byte
+	if b, err = workerJSON(v); err != nil {
+		return
+	}
+	req.w.Header().Set("Content-Type", "application/json")
+	_, err = req.w.Write(b)
+	return
+}
+
+// usePoolOf restricts the accounts to the pools of drives, as the worker.
+func (req *serverRequest) usePoolOf(drives ...string) {
+	var pool []int
+	for _, drive := range drives {
+		if accounts, ok := req.drives[drive]; ok && drive != "" {
+			if pool == nil {
+				pool = accounts
+				continue
+			}
+			var kept []int
+			for _, i := range pool {
+				for _, j := range accounts {
+					if i == j {
+						kept = append(kept, i)
+						break
+					}
+				}
+			}
+			pool = kept
+		}
+	}
+	if len(pool) == 0 {
+		pool = nil
+	}
+	req.pool = pool
+}
+
+// poolDriveOf returns the drive of a file or folder when accounts are pooled by
+// drive, to pick accounts from its pool.
+func (req *serverRequest) poolDriveOf(id string) string {
+	if len(req.drives) == 0 {
+		return ""
+	}
+	return req.driveOf(id)
+}
+
+// driveOf finds the shared drive of a file or folder, usually with a single
+// request, remembering it for the next requests.
+func (req *serverRequest) driveOf(id string) (drive string) {
+	if _, ok := req.drives[id]; ok {
+		return id
+	}
+	req.Server.mu.Lock()
+	drive, ok := req.Server.driveIDs[id]
+	req.Server.mu.Unlock()
+	if ok {
+		return
+	}
+	var file struct {
+		DriveID string `json:"driveId"`
+	}
+	query := map[string][]string{"supportsAllDrives": {"true"}, "fields": {"driveId"}}
+	// accounts outside the pool of the drive cannot see the file, so an
+	// account of each pool is asked in turn until one can
+	pools := [][]int{req.pool}
+	drives := make([]string, 0, len(req.drives))
+	for d := range req.drives {
+		drives = append(drives, d)
+	}
+	sort.Strings(drives)
+	for _, d := range drives {
+		if !containsPool(pools, req.drives[d]) {
+			pools = append(pools, req.drives[d])
+		}
+	}
+	var err error
+	for _, pool := range pools {
+		err = req.Server.pick(pool, req.userName()).Do("GET", "/drive/v3/files/"+escapeID(id), query, nil, &file)
+		if e, ok := err.(*DriveError); !ok || e.Code != http.StatusNotFound {
+			break
+		}
+	}
+	if err != nil {
+		// failures are not remembered, as they may be transient
+		return
+	}
+	req.Server.mu.Lock()
+	defer req.Server.mu.Unlock()
+	if req.Server.driveIDs == nil || len(req.Server.driveIDs) >= driveCacheSize {
+		req.Server.driveIDs = map[string]string{}
+	}
+	req.Server.driveIDs[id] = file.DriveID
+	return file.DriveID
+}
+
+func containsPool(pools [][]int, pool []int) bool {
+	for _, p := range pools {
+		if p != nil && fmt.Sprint(p) == fmt.Sprint(pool) {
+			return true
+		}
+	}
+	return false
+}
+
+func (req *serverRequest) userName() string {
+	if req.user == nil {
+		return ""
+	}
+	return req.user.Name
+}
+
+// pick returns the client of an account for the request.
+func (req *serverRequest) pick() *DriveClient {
+	return req.Server.pick(req.pool, req.userName())
+}
+
+// static serves the embedded UI, mapping the client side routes to
+// index.html as the worker does.
+func (req *serverRequest) static() (err error) {
+	p := req.r.URL.Path
+	if p == "/" || strings.HasPrefix(p, "/folder/") || p == "/search" {
+		p = "/index.html"
+	}
+	b, e := dist.StaticFs.ReadFile("static" + path.Clean(p))
+	if e != nil {
+		http.NotFound(req.w, req.r)
+		return
+	}
+	contentType := mime.TypeByExtension(path.Ext(p))
+	switch {
+	case strings.HasSuffix(p, ".html"):
+		contentType = "text/html; charset=utf-8"
+	case strings.HasSuffix(p, ".js"):
+		contentType = "application/javascript"
+	case strings.HasSuffix(p, ".css"):
+		contentType = "text/css"
+	case strings.HasSuffix(p, ".ico"):
+		contentType = "image/x-icon"
+	}
+	if contentType != "" {
+		req.w.Header().Set("Content-Type", contentType)
+	}
+	_, err = req.w.Write(b)
+	return
+}
@@ -0,0 +1,769 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxFolderDepth gives up walking parents beyond this depth, as the worker.
+const maxFolderDepth = 64
+
+// folderMimeType is the MIME type of Drive folders.
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// driveFileFields are the fields of the files listed by the worker.
+const driveFileFields = "nextPageToken,files(id,name,mimeType,size,modifiedTime,parents,md5Checksum)"
+
+// listPageToken is the decrypted page token of /api/list. It carries the
+// account, so that the following pages are listed by the same account.
+type listPageToken struct {
+	Account   *Account `json:"account"`
+	PageToken string   `json:"pageToken"`
+}
+
+// searchPageToken is the decrypted page token of /api/search, with the next
+// page token of each searched drive, or of "global" for all drives.
+type searchPageToken struct {
+	Account      *Account          `json:"account"`
+	PageTokenMap map[string]string `json:"pageTokenMap"`
+}
+
+// fileList is the response of /api/list and /api/search. Nil lists are left
+// out, as undefined properties by JSON.stringify.
+type fileList struct {
+	NextPageToken string
+	Files         []map[string]interface{}
+	Drives        []map[string]interface{}
+}
+
+func (list fileList) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{}
+	if list.NextPageToken != "" {
+		m["nextPageToken"] = list.NextPageToken
+	}
+	if list.Files != nil {
+		m["files"] = list.Files
+	}
+	if list.Drives != nil {
+		m["drives"] = list.Drives
+	}
+	return json.Marshal(m)
+}
+
+func escapeID(id string) string {
+	return url.PathEscape(id)
+}
+
+// decodePageToken decrypts an encrypted page token into v.
+func decodePageToken(token string, v interface{}) (err error) {
+	var plaintext string
+	if plaintext, err = DecryptWorkerToken("pageToken", token); err != nil {
+		return
+	}
+	if err = json.Unmarshal([]byte(plaintext), v); err != nil {
+		return fmt.Errorf("invalid pageToken: %w", err)
+	}
+	return
+}
+
+// encodePageToken encrypts a page token as the worker.
+func encodePageToken(v interface{}) (token string, err error) {
+	var b []byte
+	if b, err = workerJSON(v); err != nil {
+		return
+	}
+	return EncryptWorkerToken("pageToken", string(b))
+}
+
+func (req *serverRequest) list() (done bool, err error) {
+	parent, _ := req.param("parent", false)
+	orderBy, _ := req.param("orderBy", false)
+	pageToken, _ := req.param("pageToken", false)
+	if parent != "" && !(validDriveForUser(parent, req.user, false) && req.acl.allowed(parent, nil, 0)) {
+		return
+	}
+	if parent != "" {
+		req.usePoolOf(req.poolDriveOf(parent))
+	}
+	var list *fileList
+	if list, err = req.ls(parent, orderBy, pageToken); err != nil {
+		return
+	}
+	if list.Drives != nil {
+		drives := []map[string]interface{}{}
+		for _, drive := range list.Drives {
+			id, _ := drive["id"].(string)
+			if validDriveForUser(id, req.user, parent == "") && (parent != "" || !req.acl.enabled() || req.acl.isRoot(id)) {
+				drives = append(drives, drive)
+			}
+		}
+		list.Drives = drives
+	}
+	if parent == "" && pageToken == "" && req.acl.enabled() {
+		list.Files = req.acl.rootFolders()
+	}
+	return true, req.writeJSON(list)
+}
+
+// ls lists the children of parent, or the shared drives without parent.
+func (req *serverRequest) ls(parent string, orderBy string, encryptedPageToken string) (list *fileList, err error) {
+	var client *DriveClient
+	var token listPageToken
+	if encryptedPageToken != "" {
+		if err = decodePageToken(encryptedPageToken, &token); err != nil {
+			return
+		}
+		if token.Account == nil {
+			return nil, fmt.Errorf("invalid pageToken: no account")
+		}
+		client = req.client(token.Account)
+	} else {
+		client = req.pick()
+	}
+	query := url.Values{}
+	apiPath := "/drive/v3/drives"
+	if parent != "" {
+		apiPath = "/drive/v3/files"
+		query.Set("includeItemsFromAllDrives", "true")
+		query.Set("supportsAllDrives", "true")
+		query.Set("q", "'"+parent+"' in parents and trashed = false")
+		query.Set("fields", driveFileFields)
+		if orderBy == "" {
+			orderBy = "folder,name,modifiedTime desc"
+		}
+		query.Set("orderBy", orderBy)
+	}
+	query.Set("pageSize", "100")
+	if token.PageToken != "" {
+		query.Set("pageToken", token.PageToken)
+	}
+	var response struct {
+		NextPageToken string                   `json:"nextPageToken"`
+		Files         []map[string]interface{} `json:"files"`
+		Drives        []map[string]interface{} `json:"drives"`
+	}
+	if err = client.Do("GET", apiPath, query, nil, &response); err != nil {
+		return
+	}
+	list = &fileList{Files: response.Files, Drives: response.Drives}
+	if parent == "" && list.Drives == nil {
+		list.Drives = []map[string]interface{}{}
+	}
+	if response.NextPageToken != "" {
+		list.NextPageToken, err = encodePageToken(listPageToken{Account: client.Account, PageToken: response.NextPageToken})
+	}
+	return
+}
+
+func (req *serverRequest) search() (err error) {
+	user := req.user
+	q, _ := req.param("q", false)
+	pageToken, _ := req.param("pageToken", false)
+	var drives []string
+	if req.acl.enabled() {
+		if drives = req.acl.searchDrives(); len(drives) == 0 {
+			return req.writeJSON(fileList{Files: []map[string]interface{}{}})
+		}
+	} else if len(user.DrivesBlockList) > 0 {
+		var all *fileList
+		if all, err = req.ls("", "", ""); err != nil {
+			return
+		}
+		for _, drive := range all.Drives {
+			if id, _ := drive["id"].(string); !containsString(user.DrivesBlockList, id) {
+				drives = append(drives, id)
+			}
+		}
+	} else if len(user.DrivesAllowList) > 0 {
+		drives = append(drives, user.DrivesAllowList...)
+	}
+	req.usePoolOf(drives...)
+	var list *fileList
+	if list, err = req.searchDrives(q, drives, pageToken); err != nil {
+		return
+	}
+	if req.acl.enabled() {
+		files := []map[string]interface{}{}
+		for _, file := range list.Files {
+			id, _ := file["id"].(string)
+			if req.acl.allowed(id, stringList(file["parents"]), 0) {
+				files = append(files, file)
+			}
+		}
+		list.Files = files
+	}
+	return req.writeJSON(list)
+}
+
+// indexSearch searches the local search index as /api/indexSearch of the
+// worker searches the deployed one.
+func (req *serverRequest) indexSearch() (done bool, err error) {
+	var manifest *IndexManifest
+	if manifest, err = ReadIndexManifest(); err != nil {
+		return
+	}
+	if len(manifest.Drives) == 0 {
+		http.Error(req.w, "no search index deployed", http.StatusServiceUnavailable)
+		return true, nil
+	}
+	user := req.user
+	q, _ := req.param("q", false)
+	limit := 100
+	if s, _ := req.param("limit", false); s != "" {
+		if n, e := strconv.ParseFloat(s, 64); e == nil && n != 0 {
+			limit = int(n)
+		}
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+	var searchDrives []string
+	if req.acl.enabled() {
+		searchDrives = req.acl.searchDrives()
+	}
+	allowed := func(ids []string) bool {
+		if !req.acl.enabled() {
+			return true
+		}
+		for _, id := range ids {
+			if req.acl.isRoot(id) {
+				return true
+			}
+		}
+		return false
+	}
+	terms := strings.Fields(strings.ToLower(q))
+	files := []IndexMatch{}
+	for _, drive := range manifest.Drives {
+		if !validDriveForUser(drive.ID, user, !req.acl.enabled()) || req.acl.enabled() && !containsString(searchDrives, drive.ID) {
+			continue
+		}
+		if len(terms) == 0 || len(files) >= limit {
+			break
+		}
+		var shard *IndexShard
+		if shard, err = LoadIndexShard(drive.ID); err != nil {
+			return
+		}
+		files = append(files, shard.Search(terms, limit-len(files), allowed)...)
+	}
+	return true, req.writeJSON(map[string]interface{}{"files": files})
+}
+
+// searchQuery builds the full text query of the worker, which only escapes
+// the first backslash and quote of q.
+func searchQuery(q string) string {
+	q = strings.Replace(q, `\`, `\\`, 1)
+	q = strings.Replace(q, `'`, `\'`, 1)
+	var clauses []string
+	for _, term := range regexp.MustCompile(`\s+`).Split(q, -1) {
+		if term != "" {
+			clauses = append(clauses, "fullText contains '"+term+"'")
+		}
+	}
+	return strings.Join(append(clauses, "trashed = false"), " and ")
+}
+
+// searchDrives searches drives in parallel, or all drives when empty. Drives
+// failing to answer are left out of the results, as the worker does.
+func (req *serverRequest) searchDrives(q string, drives []string, encryptedPageToken string) (list *fileList, err error) {
+	var client *DriveClient
+	token := searchPageToken{PageTokenMap: map[string]string{}}
+	if encryptedPageToken != "" {
+		if err = decodePageToken(encryptedPageToken, &token); err != nil {
+			return
+		}
+		if token.PageTokenMap == nil {
+			token.PageTokenMap = map[string]string{}
+		}
+		if token.Account == nil {
+			return nil, fmt.Errorf("invalid pageToken: no account")
+		}
+		client = req.client(token.Account)
+	} else {
+		client = req.pick()
+	}
+	query := url.Values{}
+	query.Set("includeItemsFromAllDrives", "true")
+	query.Set("supportsAllDrives", "true")
+	query.Set("fields", driveFileFields)
+	query.Set("pageSize", "100")
+	query.Set("q", searchQuery(q))
+
+	keys := drives
+	if len(keys) == 0 {
+		keys = []string{""}
+	}
+	results := make([][]map[string]interface{}, len(keys))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, drive := range keys {
+		key := drive
+		driveQuery := url.Values{}
+		for k, v := range query {
+			driveQuery[k] = v
+		}
+		if drive != "" {
+			driveQuery.Set("driveId", drive)
+			driveQuery.Set("corpora", "drive")
+		} else {
+			key = "global"
+			driveQuery.Set("corpora", "allDrives")
+		}
+		mu.Lock()
+		if t := token.PageTokenMap[key]; t != "" {
+			driveQuery.Set("pageToken", t)
+		}
+		mu.Unlock()
+		wg.Add(1)
+		go func(i int, key string, q url.Values) {
+			defer wg.Done()
+			var response struct {
+				NextPageToken string                   `json:"nextPageToken"`
+				Files         []map[string]interface{} `json:"files"`
+			}
+			e := client.Do("GET", "/drive/v3/files", q, nil, &response)
+			mu.Lock()
+			defer mu.Unlock()
+			if e == nil && response.NextPageToken != "" {
+				token.PageTokenMap[key] = response.NextPageToken
+			} else {
+				delete(token.PageTokenMap, key)
+			}
+			results[i] = response.Files
+		}(i, key, driveQuery)
+	}
+	wg.Wait()
+
+	list = &fileList{Files: []map[string]interface{}{}}
+	for _, files := range results {
+		list.Files = append(list.Files, files...)
+	}
+	if len(token.PageTokenMap) > 0 {
+		token.Account = client.Account
+		list.NextPageToken, err = encodePageToken(token)
+	}
+	return
+}
+
+func (req *serverRequest) file() (done bool, err error) {
+	id, _ := req.param("id", false)
+	if id != "" && !(validDriveForUser(id, req.user, false) && req.acl.allowed(id, nil, 0)) {
+		return
+	}
+	if id != "" {
+		req.usePoolOf(req.poolDriveOf(id))
+	}
+	var file map[string]interface{}
+	if file, err = req.getFile(req.pick(), id); err != nil {
+		// the worker relays the error of the Drive API as the file
+		if driveErr, ok := err.(*DriveError); ok {
+			return true, req.writeJSON(map[string]interface{}{"error": driveErr})
+		}
+		return
+	}
+	for _, parent := range stringList(file["parents"]) {
+		if !validDriveForUser(parent, req.user, false) {
+			return
+		}
+	}
+	if req.acl.isRoot(id) {
+		delete(file, "parents")
+	}
+	return true, req.writeJSON(file)
+}
+
+// getFile returns the metadata of a file, or of a shared drive when id is
+// one, in which case the drive name and kind replace the root folder's.
+func (req *serverRequest) getFile(client *DriveClient, id string) (file map[string]interface{}, err error) {
+	var drive map[string]interface{}
+	var driveErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		query := url.Values{}
+		query.Set("fields", "id,name,kind")
+		driveErr = client.Do("GET", "/drive/v3/drives/"+escapeID(id), query, nil, &drive)
+	}()
+	query := url.Values{}
+	query.Set("supportsAllDrives", "true")
+	query.Set("fields", "id,name,kind,mimeType,size,modifiedTime,parents,md5Checksum,driveId")
+	err = client.Do("GET", "/drive/v3/files/"+escapeID(id), query, nil, &file)
+	wg.Wait()
+	if err != nil {
+		return
+	}
+	if driveErr == nil {
+		for _, key := range []string{"kind", "name"} {
+			if v, ok := drive[key]; ok {
+				file[key] = v
+			} else {
+				delete(file, key)
+			}
+		}
+	}
+	return
+}
+
+var filePathPattern = regexp.MustCompile(`^/file/([^/]+)`)
+
+// download proxies the content of a file, passing the Range header through.
+func (req *serverRequest) download() (done bool, err error) {
+	m := filePathPattern.FindStringSubmatch(req.r.URL.Path)
+	if m == nil {
+		return
+	}
+	id := m[1]
+	if !req.acl.allowed(id, nil, 0) || req.scopeACL != nil && !req.scopeACL.allowed(id, nil, 0) {
+		return
+	}
+	req.usePoolOf(req.poolDriveOf(id))
+	var upstream *http.Request
+	if upstream, err = http.NewRequest("GET", DriveAPIURL()+"/drive/v3/files/"+escapeID(id)+"?alt=media", nil); err != nil {
+		return
+	}
+	if r := req.r.Header.Get("Range"); r != "" {
+		upstream.Header.Set("Range", r)
+	}
+	var resp *http.Response
+	if resp, err = req.pick().Send(upstream); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	header := req.w.Header()
+	for k, vs := range resp.Header {
+		switch http.CanonicalHeaderKey(k) {
+		case "Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade", "Trailer":
+			continue
+		}
+		header[k] = vs
+	}
+	req.w.WriteHeader(resp.StatusCode)
+	io.Copy(req.w, resp.Body)
+	return true, nil
+}
+
+// lifetime of scoped tokens, by default and at most
+const (
+	scopedTokenTTL    = 7 * 24 * time.Hour
+	scopedTokenMaxTTL = 30 * 24 * time.Hour
+)
+
+// scopedToken issues a token downloading the files under a folder, or a
+// single file, until it expires, for playlists and download managers.
+func (req *serverRequest) scopedToken() (done bool, err error) {
+	id, _ := req.param("scope", false)
+	ttl := scopedTokenTTL
+	if s, _ := req.param("ttl", false); s != "" {
+		if n, e := strconv.ParseFloat(s, 64); e == nil && n != 0 {
+			ttl = time.Duration(n * float64(time.Second))
+		}
+	}
+	if ttl > scopedTokenMaxTTL {
+		ttl = scopedTokenMaxTTL
+	}
+	if id == "" {
+		return
+	}
+	if !req.validTargetForUser(id) || !req.acl.allowed(id, nil, 0) {
+		return
+	}
+	claims := struct {
+		Name  string `json:"name"`
+		Pass  string `json:"pass"`
+		Scope string `json:"scope"`
+		Exp   int64  `json:"exp"`
+	}{req.user.Name, req.user.Pass, id, time.Now().Add(ttl).Unix()}
+	var b []byte
+	if b, err = workerJSON(claims); err != nil {
+		return
+	}
+	var token string
+	if token, err = EncryptWorkerToken("scopedToken", string(b)); err != nil {
+		return
+	}
+	return true, req.writeJSON(map[string]interface{}{"token": "s." + token, "expires": claims.Exp})
+}
+
+// stringList converts a decoded JSON array of strings.
+func stringList(v interface{}) (list []string) {
+	items, _ := v.([]interface{})
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return
+}
+
+// folderACL is a port of FolderACL of the worker, restricting a user with a
+// folders allow list to the subtrees of those folders, plus the drives in
+// the drives allow list, by walking up parents.
+type folderACL struct {
+	req     *serverRequest
+	user    *User
+	cache   map[string]bool
+	clients map[string]*DriveClient
+	folders []map[string]interface{}
+	loaded  bool
+}
+
+func (acl *folderACL) enabled() bool {
+	return acl.user != nil && len(acl.user.FoldersAllowList) > 0
+}
+
+func (acl *folderACL) isRoot(id string) bool {
+	if !acl.enabled() {
+		return false
+	}
+	return containsString(acl.user.FoldersAllowList, id) || containsString(acl.user.DrivesAllowList, id)
+}
+
+func (acl *folderACL) allowed(id string, parents []string, depth int) bool {
+	return acl.allowedIn("", id, parents, depth)
+}
+
+// allowedIn walks up the parents of id with an account of the pool of drive,
+// found from id unless parents are given.
+func (acl *folderACL) allowedIn(drive string, id string, parents []string, depth int) bool {
+	if !acl.enabled() || acl.isRoot(id) {
+		return true
+	}
+	if depth >= maxFolderDepth {
+		return false
+	}
+	if allowed, ok := acl.cache[id]; ok {
+		return allowed
+	}
+	// guards against cycles while walking up
+	acl.cache[id] = false
+	if parents == nil {
+		var file struct {
+			Parents []string `json:"parents"`
+		}
+		query := url.Values{}
+		query.Set("supportsAllDrives", "true")
+		query.Set("fields", "id,parents")
+		if depth == 0 {
+			drive = acl.req.poolDriveOf(id)
+		}
+		if acl.pick(drive).Do("GET", "/drive/v3/files/"+escapeID(id), query, nil, &file) != nil {
+			return false
+		}
+		parents = file.Parents
+	}
+	for _, parent := range parents {
+		if acl.allowedIn(drive, parent, nil, depth+1) {
+			acl.cache[id] = true
+			return true
+		}
+	}
+	return false
+}
+
+// rootFolders returns the metadata of the allowed folders, detached from
+// their parents so that the breadcrumbs stop there.
+func (acl *folderACL) rootFolders() []map[string]interface{} {
+	if !acl.loaded {
+		acl.loaded = true
+		acl.folders = []map[string]interface{}{}
+		for _, id := range acl.user.FoldersAllowList {
+			if file, err := acl.req.getFile(acl.pick(acl.req.poolDriveOf(id)), id); err == nil {
+				delete(file, "parents")
+				acl.folders = append(acl.folders, file)
+			}
+		}
+	}
+	return acl.folders
+}
+
+// searchDrives returns the drives to search in: the drives allow list and the
+// shared drives of the allowed folders, as folders outside of shared drives
+// are not served.
+func (acl *folderACL) searchDrives() []string {
+	drives := append([]string{}, acl.user.DrivesAllowList...)
+	for _, folder := range acl.rootFolders() {
+		if driveID, _ := folder["driveId"].(string); driveID != "" && !containsString(drives, driveID) {
+			drives = append(drives, driveID)
+		}
+	}
+	return drives
+}
+
+// pick picks an account of the pool of drive, or of the current pool when the
+// drive is unknown, once per request.
+func (acl *folderACL) pick(drive string) *DriveClient {
+	if client, ok := acl.clients[drive]; ok {
+		return client
+	}
+	pool := acl.req.pool
+	if accounts, ok := acl.req.drives[drive]; ok && drive != "" {
+		pool = accounts
+	}
+	if acl.clients == nil {
+		acl.clients = map[string]*DriveClient{}
+	}
+	acl.clients[drive] = acl.req.Server.pick(pool, acl.req.userName())
+	return acl.clients[drive]
+}
+
+// uploadRangePattern matches the bytes received by a resumable upload.
+var uploadRangePattern = regexp.MustCompile(`bytes=0-(\d+)`)
+
+// uploadSessionURL is the resumable upload session of a copy, identified by
+// the upload ID handed out as token.
+func uploadSessionURL(token string) string {
+	return DriveAPIURL() + "/upload/drive/v3/files?uploadType=resumable&supportsAllDrives=true&upload_id=" + url.QueryEscape(token)
+}
+
+// relay copies an upstream response to the client.
+func (req *serverRequest) relay(resp *http.Response) {
+	header := req.w.Header()
+	for k, vs := range resp.Header {
+		switch http.CanonicalHeaderKey(k) {
+		case "Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade", "Trailer":
+			continue
+		}
+		header[k] = vs
+	}
+	req.w.WriteHeader(resp.StatusCode)
+	io.Copy(req.w, resp.Body)
+}
+
+// copyFileInit starts a resumable upload of a copy of src into dst.
+func (req *serverRequest) copyFileInit() (done bool, err error) {
+	src, _ := req.param("src", false)
+	dst, _ := req.param("dst", false)
+	if src == "" || dst == "" || !req.acl.allowed(src, nil, 0) || !req.validTargetForUser(dst) || !req.acl.allowed(dst, nil, 0) {
+		return
+	}
+	req.usePoolOf(req.poolDriveOf(src), req.poolDriveOf(dst))
+	client := req.pick()
+	var file map[string]interface{}
+	if file, err = req.getFile(client, src); err != nil {
+		return
+	}
+	body, _ := workerJSON(map[string]interface{}{"name": file["name"], "parents": []string{dst}})
+	var upload *http.Request
+	if upload, err = http.NewRequest("POST", DriveAPIURL()+"/upload/drive/v3/files?uploadType=resumable&supportsAllDrives=true", strings.NewReader(string(body))); err != nil {
+		return
+	}
+	upload.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	upload.Header.Set("X-Upload-Content-Type", fmt.Sprint(file["mimeType"]))
+	upload.Header.Set("X-Upload-Content-Length", fmt.Sprint(file["size"]))
+	var resp *http.Response
+	if resp, err = client.Send(upload); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if err = CheckDriveResponse(resp); err != nil {
+		return
+	}
+	var location *url.URL
+	if location, err = url.Parse(resp.Header.Get("Location")); err != nil {
+		return
+	}
+	file["token"] = location.Query().Get("upload_id")
+	return true, req.writeJSON(file)
+}
+
+// copyFileExec streams the content of src into the upload of a copy.
+func (req *serverRequest) copyFileExec() (done bool, err error) {
+	src, _ := req.param("src", false)
+	token, _ := req.param("token", false)
+	if src == "" || token == "" || !req.acl.allowed(src, nil, 0) {
+		return
+	}
+	req.usePoolOf(req.poolDriveOf(src))
+	var download *http.Request
+	if download, err = http.NewRequest("GET", DriveAPIURL()+"/drive/v3/files/"+escapeID(src)+"?alt=media", nil); err != nil {
+		return
+	}
+	var data *http.Response
+	if data, err = req.pick().Send(download); err != nil {
+		return
+	}
+	defer data.Body.Close()
+	var upload *http.Request
+	if upload, err = http.NewRequest("PUT", uploadSessionURL(token), data.Body); err != nil {
+		return
+	}
+	upload.ContentLength = data.ContentLength
+	upload.Header.Set("Content-Type", data.Header.Get("Content-Type"))
+	var resp *http.Response
+	if resp, err = http.DefaultClient.Do(upload); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	req.relay(resp)
+	return true, nil
+}
+
+// copyFileStat reports the progress of the upload of a copy.
+func (req *serverRequest) copyFileStat() (done bool, err error) {
+	token, _ := req.param("token", false)
+	if token == "" {
+		return
+	}
+	var stat *http.Request
+	if stat, err = http.NewRequest("PUT", uploadSessionURL(token), nil); err != nil {
+		return
+	}
+	stat.Header.Set("Content-Range", "bytes */*")
+	var resp *http.Response
+	if resp, err = http.DefaultClient.Do(stat); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		file := map[string]interface{}{}
+		if err = json.NewDecoder(resp.Body).Decode(&file); err != nil {
+			return
+		}
+		file["status"] = "uploaded"
+		return true, req.writeJSON(file)
+	case http.StatusNotFound:
+		return true, req.writeJSON(map[string]interface{}{"status": "expired"})
+	case http.StatusPermanentRedirect:
+		var uploaded int64
+		if m := uploadRangePattern.FindStringSubmatch(resp.Header.Get("Range")); m != nil {
+			uploaded, _ = strconv.ParseInt(m[1], 10, 64)
+		}
+		return true, req.writeJSON(map[string]interface{}{"status": "uploading", "uploaded": uploaded})
+	}
+	return true, req.writeJSON(map[string]interface{}{"status": "error", "message": fmt.Sprintf("unexpected API response status: %d", resp.StatusCode)})
+}
+
+// mkdir creates a folder named name in parent.
+func (req *serverRequest) mkdir() (done bool, err error) {
+	parent, _ := req.param("parent", false)
+	name, _ := req.param("name", false)
+	if parent == "" || name == "" || !req.validTargetForUser(parent) || !req.acl.allowed(parent, nil, 0) {
+		return
+	}
+	req.usePoolOf(req.poolDriveOf(parent))
+	body, _ := workerJSON(map[string]interface{}{"name": name, "parents": []string{parent}, "mimeType": folderMimeType})
+	var create *http.Request
+	if create, err = http.NewRequest("POST", DriveAPIURL()+"/drive/v3/files?supportsAllDrives=true&fields="+url.QueryEscape("id,name,mimeType,modifiedTime,parents,driveId"), strings.NewReader(string(body))); err != nil {
+		return
+	}
+	create.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	var resp *http.Response
+	if resp, err = req.pick().Send(create); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	resp.Header.Set("Content-Type", "application/json")
+	req.relay(resp)
+	return true, nil
+}
@@ -0,0 +1,215 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Account selection strategies of the worker.
+const (
+	StrategyWindow   = "window"
+	StrategyShuffle  = "shuffle"
+	StrategyWeighted = "weighted"
+	StrategySticky   = "sticky"
+)
+
+// AccountStrategies describes each account selection strategy.
+var AccountStrategies = map[string]string{
+	StrategyWindow:   "a window of account candidates rotating every rotation interval, then a random pick",
+	StrategyShuffle:  "a uniform random pick over the whole pool",
+	StrategyWeighted: "a random pick weighted by account type or tag",
+	StrategySticky:   "a fixed window of account candidates per user, then a random pick",
+}
+
+// AccountTagPrefix prefixes the tag keys of account weights.
+const AccountTagPrefix = "tag:"
+
+// AccountStrategy returns the configured strategy, defaulting to window.
+func AccountStrategy() string {
+	if Config.AccountStrategy == "" {
+		return StrategyWindow
+	}
+	return Config.AccountStrategy
+}
+
+// WorkerAccountFile returns the file of the pool fetched by the worker as its
+// i-th account, the worker numbering account URLs from 1.
+func WorkerAccountFile(i int) string {
+	return strconv.Itoa(i + 1)
+}
+
+// ParseAccountWeights parses a comma separated list of key=weight, where key
+// is an account type or tag:<name>.
+func ParseAccountWeights(s string) (weights map[string]float64, err error) {
+	weights = map[string]float64{}
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		i := strings.Index(field, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid weight %q, expected key=weight", field)
+		}
+		var w float64
+		if w, err = strconv.ParseFloat(strings.TrimSpace(field[i+1:]), 64); err != nil {
+			return nil, fmt.Errorf("invalid weight %q: %w", field, err)
+		}
+		weights[strings.TrimSpace(field[:i])] = w
+	}
+	return
+}
+
+// FormatAccountWeights formats weights as parsed by ParseAccountWeights.
+func FormatAccountWeights(weights map[string]float64) string {
+	var fields []string
+	for key, w := range weights {
+		fields = append(fields, fmt.Sprintf("%s=%g", key, w))
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, ",")
+}
+
+// ValidateAccountStrategy checks the strategy and its parameters.
+func ValidateAccountStrategy(strategy string, weights map[string]float64) error {
+	if _, ok := AccountStrategies[strategy]; !ok {
+		return fmt.Errorf("unknown account strategy %q", strategy)
+	}
+	if strategy != StrategyWeighted {
+		if len(weights) > 0 {
+			return fmt.Errorf("weights only apply to the %s strategy", StrategyWeighted)
+		}
+		if Config.AccountCandidates == 0 || (strategy == StrategyWindow && Config.AccountRotation == 0) {
+			return fmt.Errorf("the %s strategy needs account rotation and candidates to be set", strategy)
+		}
+		return nil
+	}
+	if len(weights) == 0 {
+		return fmt.Errorf("the %s strategy needs weights, e.g. %s=1,%s=3,%sfast=5", strategy, AccountTypeService, AccountTypeUser, AccountTagPrefix)
+	}
+	positive := false
+	for key, w := range weights {
+		if key != AccountTypeUser && key != AccountTypeService && (!strings.HasPrefix(key, AccountTagPrefix) || key == AccountTagPrefix) {
+			return fmt.Errorf("invalid weight key %q, expected %s, %s or %s<name>", key, AccountTypeUser, AccountTypeService, AccountTagPrefix)
+		}
+		if w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return fmt.Errorf("invalid weight %g of %s, expected a non-negative number", w, key)
+		}
+		if w > 0 {
+			positive = true
+		}
+	}
+	if !positive {
+		return fmt.Errorf("at least one weight must be positive")
+	}
+	return nil
+}
+
+// SetAccountStrategy validates and saves the strategy and its parameters.
+func SetAccountStrategy(strategy string, weights map[string]float64) (err error) {
+	if err = ValidateAccountStrategy(strategy, weights); err != nil {
+		return
+	}
+	Config.AccountStrategy = strategy
+	Config.AccountWeights = weights
+	if len(weights) == 0 {
+		Config.AccountWeights = nil
+	}
+	return SaveConfigFile()
+}
+
+// AccountWeight returns the weight of account: the largest weight of its
+// tags, else the weight of its type, else 1.
+func AccountWeight(account *Account, weights map[string]float64) float64 {
+	found := false
+	max := 0.0
+	for _, tag := range Config.AccountTags[account.File] {
+		if w, ok := weights[AccountTagPrefix+tag]; ok && (!found || w > max) {
+			found, max = true, w
+		}
+	}
+	if found {
+		return max
+	}
+	if w, ok := weights[account.Type]; ok {
+		return w
+	}
+	return 1
+}
+
+// WorkerAccountWeights returns the weight of each account in the order of the
+// worker. Accounts the worker cannot fetch get no weight.
+func WorkerAccountWeights() (weights []float64, err error) {
+	total := 0.0
+	for i := 0; i < int(Config.AccountsCount); i++ {
+		var account Account
+		accountPath := filepath.Join("accounts", WorkerAccountFile(i))
+		if _, e := os.Stat(accountPath); os.IsNotExist(e) {
+			weights = append(weights, 0)
+			continue
+		}
+		if err = ReadAccountByPath(accountPath, &account); err != nil {
+			return
+		}
+		w := AccountWeight(&account, Config.AccountWeights)
+		weights = append(weights, w)
+		total += w
+	}
+	if total == 0 {
+		err = fmt.Errorf("no account of the pool has a positive weight")
+	}
+	return
+}
+
+// ParseAccountTags parses a comma separated list of tags.
+func ParseAccountTags(s string) (tags []string) {
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return
+}
+
+// SetAccountTags sets the tags of an account of the pool, removing them when
+// tags is empty.
+func SetAccountTags(file string, tags []string) (err error) {
+	if _, err = os.Stat(filepath.Join("accounts", file)); err != nil {
+		return fmt.Errorf("no account %s in the pool: %w", file, err)
+	}
+	if len(tags) == 0 {
+		delete(Config.AccountTags, file)
+	} else {
+		if Config.AccountTags == nil {
+			Config.AccountTags = map[string][]string{}
+		}
+		Config.AccountTags[file] = tags
+	}
+	return SaveConfigFile()
+}
+
+// ListAccountTags prints the tags of every tagged account.
+func ListAccountTags() {
+	var files []string
+	for file := range Config.AccountTags {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		a, errA := strconv.Atoi(files[i])
+		b, errB := strconv.Atoi(files[j])
+		if errA != nil || errB != nil {
+			return files[i] < files[j]
+		}
+		return a < b
+	})
+	if len(files) == 0 {
+		fmt.Println("No account is tagged.")
+	}
+	for _, file := range files {
+		fmt.Printf("%s: %s\n", file, strings.Join(Config.AccountTags[file], ","))
+	}
+}
@@ -48,7 +48,7 @@ func LoadConfigFile() (err error) {
         return
     }
 
-    fmt.Printf("Loading existing config from %s\n", Config.ConfigFile)
+    fmt.Fprintf(os.Stderr, "Loading existing config from %s\n", Config.ConfigFile)
 
     b, err := ioutil.ReadFile(Config.ConfigFile)
     if err != nil {
@@ -72,21 +72,39 @@ func LoadConfigFile() (err error) {
     return
 }
 
+// ConfigProblem is a setting missing from the config file.
+type ConfigProblem struct {
+    Field   string `json:"field"`
+    Problem string `json:"problem"`
+}
+
+// ConfigProblems returns the settings the config file is missing, all of
+// which the setup wizard asks for.
+func ConfigProblems() (problems []ConfigProblem) {
+    check := func(ok bool, field string, problem string) {
+        if !ok {
+            problems = append(problems, ConfigProblem{Field: field, Problem: problem})
+        }
+    }
+    check(Config.CloudflareEmail != "", "cf_email", "no Cloudflare account email")
+    check(Config.CloudflareKey != "", "cf_key", "no Cloudflare API key")
+    check(Config.CloudflareAccount != "", "cf_account", "no Cloudflare account selected")
+    check(Config.CloudflareWorker != "", "cf_worker", "no Cloudflare Worker name")
+    check(Config.GistToken != "", "gist_token", "no GitHub token to push Gists with")
+    check(Config.GistUser != "", "gist_user", "no GitHub user owning the Gists")
+    check(Config.GistID.Accounts != "", "gist_id.accounts", "no Gist for the accounts")
+    check(Config.GistID.Static != "", "gist_id.static", "no Gist for the static files")
+    check(Config.GistID.Users != "", "gist_id.users", "no Gist for the users")
+    check(Config.SecretKey != "", "secret_key", "no secret key")
+    check(Config.AccountRotation != 0, "account_rotation", "no account rotation period")
+    check(Config.AccountCandidates != 0, "account_candidates", "no number of account candidates")
+    check(Config.AccountsJSONDir != "", "accounts_json_dir", "no directory of account JSON files")
+    check(Config.AccountsCount != 0, "accounts_count", "no accounts imported")
+    return
+}
+
 func ValidateConfig() bool {
-    return Config.CloudflareEmail != "" &&
-        Config.CloudflareKey != "" &&
-        Config.CloudflareAccount != "" &&
-        Config.CloudflareWorker != "" &&
-        Config.GistToken != "" &&
-        Config.GistUser != "" &&
-        Config.GistID.Accounts != "" &&
-        Config.GistID.Static != "" &&
-        Config.GistID.Users != "" &&
-        Config.SecretKey != "" &&
-        Config.AccountRotation != 0 &&
-        Config.AccountCandidates != 0 &&
-        Config.AccountsJSONDir != "" &&
-        Config.AccountsCount != 0
+    return len(ConfigProblems()) == 0
 }
 
 func SetupProxy() (err error) {
@@ -384,7 +402,7 @@ func CreateNewGist(name string, gistID *string) (err error) {
     }
     if Config.Debug {
         b, _ := json.MarshalIndent(gist, "", "    ")
-        log.Printf("Created new Gist for %s:\n", name, string(b))
+        log.Printf("Created new Gist for %s:\n%s", name, string(b))
     }
     *gistID = *gist.ID
     return SaveConfigFile()
@@ -637,10 +655,16 @@ func ProcessAccountsJSONDir() (err error) {
         var inPath string
         var inBytes []byte
         var outBytes []byte
+        var before map[string]string
         if files, err = ioutil.ReadDir(Config.AccountsJSONDir); err != nil {
             return
         }
 
+        if before, err = accountFileKeys(); err != nil {
+            fmt.Printf("Cannot read the current accounts, their tags and drives will be reset: %v\n", err)
+            before, err = nil, nil
+        }
+
         if _, err = os.Stat("accounts"); os.IsNotExist(err) {
             if err = os.MkdirAll("accounts", 0700); err != nil {
                 return
@@ -666,6 +690,9 @@ func ProcessAccountsJSONDir() (err error) {
                 Config.AccountsCount++
             }
         }
+        if err = remapAccountFiles(before); err != nil {
+            return
+        }
         err = SaveConfigFile()
     }
     return
@@ -729,7 +756,6 @@ func ConfigureUserAccess(user *User) (err error) {
             }
         } else {
             var line string
-            var drives []string
             fmt.Println("The user currently has global access to all drives.")
             fmt.Println("Please specify what do you want to do with it:")
             fmt.Println("    (1) Confirm                         (default)")
@@ -740,39 +766,225 @@ func ConfigureUserAccess(user *User) (err error) {
             if line == "1" || line == "" {
                 confirmed = true
             } else if line == "2" {
-                fmt.Println("(Use comma to separate between drive IDs.)")
-                fmt.Printf("Enter allow-list access control list of drives: ")
-                fmt.Scanln(&line)
-                drives = strings.Split(line, ",")
-                for i, drive := range drives {
-                    drives[i] = strings.TrimSpace(drive)
-                }
-                user.DrivesAllowList = drives
+                user.DrivesAllowList = EnterDriveList("Enter allow-list access control list of drives: ")
             } else if line == "3" {
-                fmt.Println("(Use comma to separate between drive IDs.)")
-                fmt.Printf("Enter block-list access control list of drives: ")
-                fmt.Scanln(&line)
-                drives = strings.Split(line, ",")
-                for i, drive := range drives {
-                    drives[i] = strings.TrimSpace(drive)
-                }
-                user.DrivesBlockList = drives
+                user.DrivesBlockList = EnterDriveList("Enter block-list access control list of drives: ")
             }
         }
         if confirmed {
             break
         }
     }
+    if err = ConfigureUserFolders(user); err != nil {
+        return
+    }
+    if err = ConfigureUserCapabilities(user); err != nil {
+        return
+    }
+    return ConfigureUserStatus(user)
+}
+
+func ConfigureUserFolders(user *User) (err error) {
+    var line string
+    if user.FoldersAllowListStr != "" {
+        if user.FoldersAllowList, err = ParseDriveIDs(user.FoldersAllowListStr); err != nil {
+            return
+        }
+        return ValidateFolders(user.FoldersAllowList)
+    }
+    if len(user.FoldersAllowList) == 0 {
+        fmt.Println("The user has no folder-level access control list.")
+    } else {
+        fmt.Println("The user is restricted to following folders and their subfolders:")
+        for i, folder := range user.FoldersAllowList {
+            fmt.Printf("    (%d) %s\n", i+1, folder)
+        }
+    }
+    if PromptYesNoWithDefault("Is it correct?", true) {
+        return
+    }
+    for {
+        fmt.Println("(Use comma to separate between folder IDs, leave empty to remove the list.)")
+        fmt.Println("(Drives in the allow-list stay accessible in addition to these folders.)")
+        fmt.Printf("Enter allow-list access control list of folders: ")
+        line = ""
+        fmt.Scanln(&line)
+        if user.FoldersAllowList, err = ParseDriveIDs(line); err == nil {
+            if err = ValidateFolders(user.FoldersAllowList); err == nil {
+                return
+            }
+        }
+        fmt.Println(err)
+    }
+}
+
+var driveIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{10,}$`)
+
+// ParseDriveIDs parses a comma separated list of Google Drive file, folder or
+// shared drive IDs.
+func ParseDriveIDs(s string) (ids []string, err error) {
+    for _, id := range strings.Split(s, ",") {
+        id = strings.TrimSpace(id)
+        if id == "" {
+            continue
+        }
+        if !driveIDPattern.MatchString(id) {
+            return nil, fmt.Errorf("invalid Google Drive ID: %q", id)
+        }
+        ids = append(ids, id)
+    }
+    return
+}
+
+func ConfigureUserCapabilities(user *User) (err error) {
+    if user.CapabilitiesStr != "" {
+        user.Capabilities, err = ParseCapabilities(user.CapabilitiesStr)
+        return
+    }
+    fmt.Printf("The user currently has capabilities: %s\n", strings.Join(user.EffectiveCapabilities(), ","))
+    if PromptYesNoWithDefault("Is it correct?", true) {
+        return
+    }
+    fmt.Println("Please specify the capabilities of the user:")
+    for i, preset := range CapabilityPresets {
+        fmt.Printf("    (%d) %-10s %s\n", i+1, preset.Name, preset.Description)
+    }
+    fmt.Printf("    (%d) Enter a custom list of capabilities\n", len(CapabilityPresets)+1)
+    for {
+        var line string
+        var selection uint64
+        fmt.Printf("Please enter your choice: ")
+        fmt.Scanln(&line)
+        if selection, err = strconv.ParseUint(line, 10, 64); err != nil || selection < 1 || selection > uint64(len(CapabilityPresets)+1) {
+            err = nil
+            continue
+        }
+        if selection <= uint64(len(CapabilityPresets)) {
+            user.Capabilities = CapabilityPresets[selection-1].Capabilities
+            return
+        }
+        for {
+            fmt.Printf("(Use comma to separate between %s.)\n", strings.Join(AllCapabilities, ", "))
+            fmt.Printf("Capabilities of the user: ")
+            line = ""
+            fmt.Scanln(&line)
+            if user.Capabilities, err = ParseCapabilities(line); err == nil {
+                return
+            }
+            fmt.Println(err)
+        }
+    }
+}
+
+// ParseCapabilities parses a preset name or a comma separated list of capabilities.
+func ParseCapabilities(s string) (capabilities []string, err error) {
+    s = strings.TrimSpace(s)
+    for _, preset := range CapabilityPresets {
+        if s == preset.Name {
+            return preset.Capabilities, nil
+        }
+    }
+    for _, c := range strings.Split(s, ",") {
+        c = strings.TrimSpace(c)
+        valid := false
+        for _, capability := range AllCapabilities {
+            if c == capability {
+                valid = true
+                break
+            }
+        }
+        if !valid {
+            return nil, fmt.Errorf("unknown capability: %q", c)
+        }
+        capabilities = append(capabilities, c)
+    }
+    return
+}
+
+func ConfigureUserStatus(user *User) (err error) {
+    var line string
+    if user.ExpiresAtStr != "" || user.DisabledStr != "" {
+        if user.ExpiresAtStr != "" {
+            if user.ExpiresAt, err = ParseUserExpiry(user.ExpiresAtStr, time.Now()); err != nil {
+                return
+            }
+        }
+        if user.DisabledStr != "" {
+            if user.Disabled, err = strconv.ParseBool(user.DisabledStr); err != nil {
+                return fmt.Errorf("invalid disabled flag %q: %w", user.DisabledStr, err)
+            }
+        }
+        return
+    }
+    fmt.Printf("The user is currently %s.\n", FormatUserStatus(user, time.Now()))
+    if PromptYesNoWithDefault("Is it correct?", true) {
+        return
+    }
+    for {
+        fmt.Println("(YYYY-MM-DD to allow access through that day, RFC 3339 time, duration like 30d,")
+        fmt.Println("or empty to never expire)")
+        fmt.Printf("Expiry date of the user: ")
+        line = ""
+        fmt.Scanln(&line)
+        if user.ExpiresAt, err = ParseUserExpiry(line, time.Now()); err == nil {
+            break
+        }
+        fmt.Println(err)
+    }
+    user.Disabled = PromptYesNoWithDefault("Disable the user?", user.Disabled)
+    return
+}
+
+// ParseUserExpiry parses s into a Unix time relative to now. Empty or "never"
+// means the user does not expire.
+func ParseUserExpiry(s string, now time.Time) (expiresAt int64, err error) {
+    var t time.Time
+    var d time.Duration
+    s = strings.TrimSpace(s)
+    if s == "" || strings.EqualFold(s, "never") {
+        return
+    }
+    if m := regexp.MustCompile(`^(\d+)d$`).FindStringSubmatch(s); m != nil {
+        days, _ := strconv.ParseInt(m[1], 10, 64)
+        return now.Add(time.Duration(days) * 24 * time.Hour).Unix(), nil
+    }
+    if d, err = time.ParseDuration(s); err == nil {
+        return now.Add(d).Unix(), nil
+    }
+    if t, err = time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+        return t.AddDate(0, 0, 1).Unix(), nil
+    }
+    if t, err = time.Parse(time.RFC3339, s); err == nil {
+        return t.Unix(), nil
+    }
+    err = fmt.Errorf("unknown expiry format: %s", s)
     return
 }
 
+func FormatUserStatus(user *User, now time.Time) (status string) {
+    if user.Disabled {
+        status = "disabled"
+    } else {
+        status = "enabled"
+    }
+    if user.ExpiresAt == 0 {
+        return status + ", never expires"
+    }
+    expiresAt := time.Unix(user.ExpiresAt, 0).Format(time.RFC3339)
+    if user.Expired(now) {
+        return status + ", EXPIRED since " + expiresAt
+    }
+    return status + ", expires at " + expiresAt
+}
+
 func ConfigureUserAccessList(targetListName string, targetList *[]string, counterListName string, counterList *[]string) (confirmed bool, err error) {
     var line string
     var drives []string
     *counterList = nil
     fmt.Printf("The user currently has following drives in its %s access list:\n", targetListName)
+    ResolveDriveNames(*targetList)
     for i, drive := range *targetList {
-        fmt.Printf("    (%d) %s\n", i+1, drive)
+        fmt.Printf("    (%d) %s\n", i+1, FormatDriveID(drive))
     }
     fmt.Println("Please specify what do you want to do with it:")
     fmt.Println("    (1) Confirm                         (default)")
@@ -786,13 +998,9 @@ func ConfigureUserAccessList(targetListName string, targetList *[]string, counte
     if line == "1" || line == "" {
         confirmed = true
     } else if line == "2" {
-        fmt.Println("(Use comma to separate between drive IDs.)")
-        fmt.Printf("Append drives to %s access list: ", targetListName)
-        fmt.Scanln(&line)
-        drives = strings.Split(line, ",")
+        drives = EnterDriveList(fmt.Sprintf("Append drives to %s access list: ", targetListName))
         for _, drive := range drives {
             found := false
-            drive = strings.TrimSpace(drive)
             for _, d := range *targetList {
                 if d == drive {
                     found = true
@@ -838,14 +1046,7 @@ func ConfigureUserAccessList(targetListName string, targetList *[]string, counte
         }
         *targetList = drives
     } else if line == "4" {
-        fmt.Println("(Use comma to separate between drive IDs.)")
-        fmt.Printf("New %s access list of drives: ", targetListName)
-        fmt.Scanln(&line)
-        drives = strings.Split(line, ",")
-        for i, drive := range drives {
-            drives[i] = strings.TrimSpace(drive)
-        }
-        *targetList = drives
+        *targetList = EnterDriveList(fmt.Sprintf("New %s access list of drives: ", targetListName))
     } else if line == "5" {
         fmt.Printf("Converting from %s access list into %s access list...\n", targetListName, counterListName)
         *counterList = *targetList
@@ -864,6 +1065,9 @@ func SaveUser(user *User) (err error) {
     if userPath, err = ComputeUserPath(user.Name); err != nil {
         return
     }
+    if err = ExpandUserDriveGroups(user); err != nil {
+        return
+    }
     fmt.Printf("Saving user to %s ...\n", userPath)
     if b, err = json.Marshal(&user); err != nil {
         return
@@ -966,21 +1170,57 @@ func CopyStaticFiles() (err error) {
     return
 }
 
-func DeployWorker() (err error) {
+// GistRawURL returns the URL the worker fetches the files of a Gist under.
+func GistRawURL(gistID string) string {
+    return fmt.Sprintf("https://gist.githubusercontent.com/%s/%s/raw/", Config.GistUser, gistID)
+}
+
+// RenderWorker returns the worker script with the settings of the config
+// file filled in.
+func RenderWorker() (script string, err error) {
     b, err := dist.StaticFs.ReadFile("worker.js")
     if err != nil {
         return
     }
+    weights := []float64{}
+    if AccountStrategy() == StrategyWeighted {
+        if weights, err = WorkerAccountWeights(); err != nil {
+            return
+        }
+    }
+    weightsJSON, err := json.Marshal(weights)
+    if err != nil {
+        return
+    }
+    drivesJSON, err := json.Marshal(AccountDriveMap())
+    if err != nil {
+        return
+    }
+    indexURL := ""
+    if Config.GistID.Index != "" {
+        indexURL = GistRawURL(Config.GistID.Index)
+    }
     r := strings.NewReplacer(
         "__SECRET__", Config.SecretKey,
         "__ACCOUNTS_COUNT__", strconv.FormatUint(Config.AccountsCount, 10),
         "__ACCOUNT_ROTATION__", strconv.FormatUint(Config.AccountRotation, 10),
         "__ACCOUNT_CANDIDATES__", strconv.FormatUint(Config.AccountCandidates, 10),
-        "__USERS_URL__", fmt.Sprintf("https://gist.githubusercontent.com/%s/%s/raw/", Config.GistUser, Config.GistID.Users),
-        "__STATIC_URL__", fmt.Sprintf("https://gist.githubusercontent.com/%s/%s/raw/", Config.GistUser, Config.GistID.Static),
-        "__ACCOUNTS_URL__", fmt.Sprintf("https://gist.githubusercontent.com/%s/%s/raw/", Config.GistUser, Config.GistID.Accounts),
+        "__ACCOUNT_STRATEGY__", AccountStrategy(),
+        "__ACCOUNT_WEIGHTS__", string(weightsJSON),
+        "__ACCOUNT_DRIVES__", string(drivesJSON),
+        "__USERS_URL__", GistRawURL(Config.GistID.Users),
+        "__STATIC_URL__", GistRawURL(Config.GistID.Static),
+        "__ACCOUNTS_URL__", GistRawURL(Config.GistID.Accounts),
+        "__INDEX_URL__", indexURL,
     )
-    script := r.Replace(string(b))
+    return r.Replace(string(b)), nil
+}
+
+func DeployWorker() (err error) {
+    script, err := RenderWorker()
+    if err != nil {
+        return
+    }
     fmt.Printf("Deploying Cloudflare Worker %s...\n", Config.CloudflareWorker)
     if _, err = Cf.UploadWorker(&cloudflare.WorkerRequestParams{
         ScriptName: Config.CloudflareWorker,
@@ -1032,6 +1272,29 @@ func ReadUserByPath(userPath string, user *User) (err error) {
     return
 }
 
+// ForEachUser reads every user file in order and calls fn with its path and
+// the user, stopping at the first error.
+func ForEachUser(fn func(userPath string, user *User) error) (err error) {
+    var fis []os.FileInfo
+    if fis, err = ioutil.ReadDir("users"); err != nil {
+        return
+    }
+    for _, info := range fis {
+        var user User
+        if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+            continue
+        }
+        userPath := filepath.Join("users", info.Name())
+        if err = ReadUserByPath(userPath, &user); err != nil {
+            return
+        }
+        if err = fn(userPath, &user); err != nil {
+            return
+        }
+    }
+    return
+}
+
 func ReadUser(name string, user *User) (err error) {
     var userPath string
     if userPath, err = ComputeUserPath(name); err != nil {
@@ -1049,8 +1312,14 @@ func LoadOldNewUsers(name string, oldUser, newUser *User) (err error) {
         return
     }
     fmt.Printf("Editing existing user %s ...\n", name)
-    newUser.DrivesAllowList = oldUser.DrivesAllowList
-    newUser.DrivesBlockList = oldUser.DrivesBlockList
+    newUser.DrivesAllowList = UserDriveListSource(oldUser.DrivesAllowList, oldUser.DrivesAllowListRefs)
+    newUser.DrivesBlockList = UserDriveListSource(oldUser.DrivesBlockList, oldUser.DrivesBlockListRefs)
+    newUser.FoldersAllowList = oldUser.FoldersAllowList
+    newUser.TOTPSecret = oldUser.TOTPSecret
+    newUser.TOTPBackupCodes = oldUser.TOTPBackupCodes
+    newUser.ExpiresAt = oldUser.ExpiresAt
+    newUser.Disabled = oldUser.Disabled
+    newUser.Capabilities = oldUser.Capabilities
     return
 }
 
@@ -1079,35 +1348,103 @@ func EnterUserPassword(oldUser, newUser *User) (err error) {
 }
 
 func ListUsers() (err error) {
-    var fis []os.FileInfo
-    if fis, err = ioutil.ReadDir("users"); err != nil {
-        return err
-    }
     index := 0
-    for _, info := range fis {
-        var user User
-        if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
-            continue
-        }
-        if err = ReadUserByPath(filepath.Join("users", info.Name()), &user); err != nil {
-            return err
-        }
+    return ForEachUser(func(userPath string, user *User) error {
         index = index + 1
         fmt.Printf("User #%d:\n", index)
         fmt.Printf("      Username: %s\n", user.Name)
         fmt.Printf("      Password: %s\n", user.Pass)
-        if len(user.DrivesBlockList) == 0 && len(user.DrivesAllowList) == 0 {
+        fmt.Printf("        Status: %s\n", FormatUserStatus(user, time.Now()))
+        fmt.Printf("  Capabilities: %s\n", strings.Join(user.EffectiveCapabilities(), ","))
+        if len(user.DrivesBlockList) == 0 && len(user.DrivesAllowList) == 0 && len(user.FoldersAllowList) > 0 {
+            fmt.Printf("    Permission: Folder-Allow-List\n")
+        } else if len(user.DrivesBlockList) == 0 && len(user.DrivesAllowList) == 0 {
             fmt.Printf("    Permission: Full-Access (Admin)\n")
         } else if len(user.DrivesBlockList) > 0 {
             fmt.Printf("    Permission: Block-List\n")
-            fmt.Printf("    Block-List: %s\n", strings.Join(user.DrivesBlockList, ","))
+            ResolveDriveNames(user.DrivesBlockList)
+            fmt.Printf("    Block-List: %s\n", FormatUserDriveList(user.DrivesBlockList, user.DrivesBlockListRefs))
         } else if len(user.DrivesAllowList) > 0 {
             fmt.Printf("    Permission: Allow-List\n")
-            fmt.Printf("    Allow-List: %s\n", strings.Join(user.DrivesAllowList, ","))
+            ResolveDriveNames(user.DrivesAllowList)
+            fmt.Printf("    Allow-List: %s\n", FormatUserDriveList(user.DrivesAllowList, user.DrivesAllowListRefs))
+        }
+        if len(user.FoldersAllowList) > 0 {
+            fmt.Printf("       Folders: %s\n", strings.Join(user.FoldersAllowList, ","))
         }
-        fmt.Printf("      Filename: %s\n", info.Name())
+        if user.TOTPSecret != "" {
+            fmt.Printf("          TOTP: Enabled (%d backup codes)\n", len(user.TOTPBackupCodes))
+        }
+        fmt.Printf("      Filename: %s\n", filepath.Base(userPath))
         fmt.Println()
+        return nil
+    })
+}
+
+func PruneUsers(dryRun bool) (pruned int, err error) {
+    now := time.Now()
+    err = ForEachUser(func(userPath string, user *User) error {
+        if !user.Expired(now) {
+            return nil
+        }
+        fmt.Printf("Pruning user %s (%s) ...\n", user.Name, FormatUserStatus(user, now))
+        if !dryRun {
+            if err := os.Remove(userPath); err != nil {
+                return err
+            }
+        }
+        pruned++
+        return nil
+    })
+    if err != nil {
+        return
+    }
+    fmt.Printf("%d expired users pruned.\n", pruned)
+    return
+}
+
+func ResetUserTOTP(user *User) (err error) {
+    if user.TOTPSecret, err = GenerateTOTPSecret(); err != nil {
+        return
+    }
+    if len(user.TOTPBackupCodes) > 0 {
+        fmt.Println("Previous backup codes are revoked.")
+        user.TOTPBackupCodes = nil
+    }
+    return ShowUserTOTP(user)
+}
+
+func ShowUserTOTP(user *User) (err error) {
+    if user.TOTPSecret == "" {
+        return ErrTOTPNotEnabled
+    }
+    uri := TOTPURI(user.Name, user.TOTPSecret)
+    fmt.Printf("Two-factor authentication for user %s.\n", user.Name)
+    fmt.Println("Scan the QR code below with an authenticator app, or import this URI:")
+    fmt.Println(uri)
+    fmt.Println()
+    if err = PrintQRCode(os.Stdout, uri); err != nil {
+        return
+    }
+    fmt.Println()
+    return
+}
+
+func ResetUserBackupCodes(user *User, n int) (err error) {
+    var codes []string
+    if user.TOTPSecret == "" {
+        return ErrTOTPNotEnabled
+    }
+    if codes, user.TOTPBackupCodes, err = GenerateBackupCodes(n); err != nil {
+        return
+    }
+    fmt.Printf("Backup codes for user %s (each replaces a one-time code at login):\n", user.Name)
+    for _, code := range codes {
+        fmt.Printf("    %s\n", code)
     }
+    fmt.Println("Store them safely, they will not be shown again. Each code is accepted once, but")
+    fmt.Println("the deployed worker only remembers used codes in the cache of each data center, for")
+    fmt.Println("a year at most, so generate a new set once some have been used.")
     return
 }
 
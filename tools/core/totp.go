@@ -0,0 +1,98 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters, as defined by RFC 6238 and expected by authenticator apps.
+const (
+	TOTPDigits = 6
+	TOTPPeriod = 30
+	TOTPSkew   = 1
+	TOTPIssuer = "gdir"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random 160-bit secret in base32.
+func GenerateTOTPSecret() (secret string, err error) {
+	b := make([]byte, 20)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	secret = totpEncoding.EncodeToString(b)
+	return
+}
+
+// TOTPCode computes the code of secret for the time step containing t.
+func TOTPCode(secret string, t time.Time) (code string, err error) {
+	var key []byte
+	if key, err = totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "="))); err != nil {
+		return
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/TOTPPeriod))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	code = fmt.Sprintf("%0*d", TOTPDigits, value%1000000)
+	return
+}
+
+// ValidateTOTP checks code against secret, allowing TOTPSkew steps of clock drift.
+func ValidateTOTP(secret string, code string, t time.Time) bool {
+	for i := -TOTPSkew; i <= TOTPSkew; i++ {
+		expected, err := TOTPCode(secret, t.Add(time.Duration(i*TOTPPeriod)*time.Second))
+		if err != nil {
+			return false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return true
+		}
+	}
+	return false
+}
+
+// TOTPURI returns the otpauth:// URI that authenticator apps import.
+func TOTPURI(name string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTPIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", TOTPDigits))
+	v.Set("period", fmt.Sprintf("%d", TOTPPeriod))
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", TOTPIssuer, url.PathEscape(name), v.Encode())
+}
+
+// GenerateBackupCodes returns n random backup codes and the hashes to store
+// in the user record.
+func GenerateBackupCodes(n int) (codes []string, hashes []string, err error) {
+	for i := 0; i < n; i++ {
+		b := make([]byte, 5)
+		if _, err = rand.Read(b); err != nil {
+			return
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes = append(codes, code)
+		hashes = append(hashes, HashBackupCode(code))
+	}
+	return
+}
+
+// HashBackupCode hashes a backup code the same way the worker does.
+func HashBackupCode(code string) string {
+	hash := sha256.Sum256([]byte(Config.SecretKey + ":totp-backup:" + strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(hash[:])
+}
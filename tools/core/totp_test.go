@@ -0,0 +1,87 @@
+package core
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 seed of the test vectors of RFC 6238 appendix B.
+var rfc6238Secret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// the RFC lists 8 digit codes, the last 6 digits are the 6 digit codes
+	for _, v := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	} {
+		code, err := TOTPCode(rfc6238Secret, time.Unix(v.unix, 0))
+		if err != nil {
+			t.Fatalf("TOTPCode at %d: %v", v.unix, err)
+		}
+		if want := v.code[len(v.code)-TOTPDigits:]; code != want {
+			t.Errorf("TOTPCode at %d = %s, want %s", v.unix, code, want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	for _, v := range []struct {
+		code  string
+		valid bool
+	}{
+		{"050471", true},  // current step
+		{"081804", true},  // previous step, within the skew
+		{"287082", false}, // long expired
+		{"000000", false},
+		{"", false},
+	} {
+		if valid := ValidateTOTP(rfc6238Secret, v.code, now); valid != v.valid {
+			t.Errorf("ValidateTOTP(%q) = %v, want %v", v.code, valid, v.valid)
+		}
+	}
+}
+
+func TestTOTPCodeLowercaseSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	upper, err := TOTPCode(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lower, err := TOTPCode(strings.ToLower(secret), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upper != lower {
+		t.Errorf("codes differ by the case of the secret: %s and %s", upper, lower)
+	}
+}
+
+func TestHashBackupCode(t *testing.T) {
+	codes, hashes, err := GenerateBackupCodes(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, code := range codes {
+		if HashBackupCode(code) != hashes[i] {
+			t.Errorf("hash of backup code %d differs from the generated one", i)
+		}
+		// codes are accepted as typed, with spaces and in upper case
+		if HashBackupCode(" "+strings.ToUpper(code)+" ") != hashes[i] {
+			t.Errorf("hash of backup code %d depends on its case or spaces", i)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// DefaultDailyBudget is the amount of data an account may copy into shared
+// drives per day before Google refuses more.
+const DefaultDailyBudget = 750 << 30
+
+// TransferQuotaFile records the bytes copied by each account of the pool
+// today, so that the daily budget holds across runs.
+const TransferQuotaFile = "transfer-quota.json"
+
+// ErrBudgetExhausted is returned once every account has used up its daily
+// budget.
+var ErrBudgetExhausted = errors.New("every account has used up its daily budget, try again tomorrow")
+
+// accountUsage is the data copied by an account on Day, in UTC.
+type accountUsage struct {
+	Day       string `json:"day"`
+	Bytes     int64  `json:"bytes"`
+	Exhausted bool   `json:"exhausted,omitempty"`
+}
+
+// AccountRotator calls the Drive API as the accounts of the pool in turn,
+// moving on to the next account when one hits its rate limit or its daily
+// budget.
+type AccountRotator struct {
+	// Budget is the bytes each account may copy per day.
+	Budget int64
+
+	clients []*DriveClient
+	mu      sync.Mutex
+	next    int
+	usage   map[string]*accountUsage
+}
+
+// NewAccountRotator returns a rotator over accounts, resuming today's usage
+// from TransferQuotaFile.
+func NewAccountRotator(accounts []*Account, budget int64) (r *AccountRotator, err error) {
+	r = &AccountRotator{Budget: budget, usage: map[string]*accountUsage{}}
+	for _, account := range accounts {
+		r.clients = append(r.clients, NewDriveClient(account))
+	}
+	var b []byte
+	if b, err = ioutil.ReadFile(TransferQuotaFile); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(b, &r.usage); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", TransferQuotaFile, err)
+	}
+	return
+}
+
+// today returns the usage of client today, with r.mu held.
+func (r *AccountRotator) today(client *DriveClient) *accountUsage {
+	day := time.Now().UTC().Format("2006-01-02")
+	u := r.usage[client.Account.Key()]
+	if u == nil || u.Day != day {
+		u = &accountUsage{Day: day}
+		r.usage[client.Account.Key()] = u
+	}
+	return u
+}
+
+// save writes the usage of the accounts, with r.mu held.
+func (r *AccountRotator) save() {
+	b, err := json.MarshalIndent(r.usage, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(TransferQuotaFile, b, 0644)
+	}
+	if err != nil {
+		fmt.Printf("Failed to save %s: %v\n", TransferQuotaFile, err)
+	}
+}
+
+// pick returns the next account with size bytes of budget left.
+func (r *AccountRotator) pick(size int64) (client *DriveClient, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for n := 0; n < len(r.clients); n++ {
+		client = r.clients[(r.next+n)%len(r.clients)]
+		if u := r.today(client); !u.Exhausted && u.Bytes+size <= r.Budget {
+			r.next = (r.next + n) % len(r.clients)
+			return
+		}
+	}
+	return nil, ErrBudgetExhausted
+}
+
+// rotate moves on from client, marking it exhausted for today when
+// exhausted is set.
+func (r *AccountRotator) rotate(client *DriveClient, exhausted bool, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clients[r.next] == client {
+		r.next = (r.next + 1) % len(r.clients)
+		fmt.Printf("    %s hit %s, rotating to the next account\n", client.Account.Label(), reason)
+	}
+	if exhausted {
+		r.today(client).Exhausted = true
+		r.save()
+	}
+}
+
+// Used returns the bytes copied today by each account, by label.
+func (r *AccountRotator) Used() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	used := map[string]int64{}
+	for _, client := range r.clients {
+		used[client.Account.Label()] = r.today(client).Bytes
+	}
+	return used
+}
+
+// Do calls fn as an account with size bytes of budget left, rotating
+// accounts on userRateLimitExceeded and dailyLimitExceeded, and backing off
+// when every account is rate limited. The size is charged to the account fn
+// succeeded with.
+func (r *AccountRotator) Do(size int64, fn func(client *DriveClient) error) (err error) {
+	var client *DriveClient
+	if client, err = r.try(size, fn); err == nil {
+		r.charge(client.Account.Key(), size)
+	}
+	return
+}
+
+// charge adds size bytes to today's usage of the account with key.
+func (r *AccountRotator) charge(key string, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, client := range r.clients {
+		if client.Account.Key() == key {
+			r.today(client).Bytes += size
+			r.save()
+			return
+		}
+	}
+}
+
+// try calls fn like Do without charging the size, for work that is only
+// done once later calls succeed, and returns the account fn succeeded with.
+func (r *AccountRotator) try(size int64, fn func(client *DriveClient) error) (client *DriveClient, err error) {
+	if len(r.clients) == 0 {
+		return nil, fmt.Errorf("no accounts in the pool")
+	}
+	delay := time.Second
+	limited := 0
+	for attempt := 0; attempt < 3*len(r.clients)+6; attempt++ {
+		if client, err = r.pick(size); err != nil {
+			return
+		}
+		if err = fn(client); err == nil {
+			return
+		}
+		e, ok := err.(*DriveError)
+		if !ok || !(e.RateLimited() || e.Reason() == "dailyLimitExceeded") {
+			return
+		}
+		switch e.Reason() {
+		case "dailyLimitExceeded":
+			r.rotate(client, true, e.Reason())
+			continue
+		case "userRateLimitExceeded":
+			r.rotate(client, false, e.Reason())
+			if limited++; limited < len(r.clients) {
+				continue
+			}
+		}
+		// every account is rate limited, or the API is overloaded
+		limited = 0
+		time.Sleep(delay)
+		if delay < time.Minute {
+			delay *= 2
+		}
+	}
+	return
+}
+
+// Transfer copies or moves files and folder trees between shared drives with
+// the Drive API directly, as the accounts of the pool.
+type Transfer struct {
+	Rotator *AccountRotator
+	// Move moves the files instead of copying them. Source folders are left
+	// behind, empty.
+	Move bool
+	// DryRun only prints what would be done.
+	DryRun bool
+	// Checksum skips the files already in the destination by MD5 checksum
+	// instead of by size.
+	Checksum bool
+	// Parallel is the number of files transferred at once.
+	Parallel int
+
+	mu     sync.Mutex
+	result TransferResult
+}
+
+// TransferResult sums up a transfer.
+type TransferResult struct {
+	Transferred int
+	Skipped     int
+	Failed      int
+	Folders     int
+	// Bytes is the size of the files transferred.
+	Bytes int64
+}
+
+// transferTask is a file to transfer into the folder dst.
+type transferTask struct {
+	file DriveFile
+	dst  string
+	path string
+}
+
+func (t *Transfer) verb() string {
+	if t.Move {
+		return "move"
+	}
+	return "copy"
+}
+
+// Run transfers the content of the folder src into the folder dst, or the
+// file src into dst. Folders already in dst are reused and files already
+// there are skipped. It returns an error summing up the files that failed.
+func (t *Transfer) Run(src string, dst string) (result TransferResult, err error) {
+	var file DriveFile
+	if err = t.Rotator.Do(0, func(client *DriveClient) (err error) {
+		file, err = client.GetFile(src)
+		return
+	}); err != nil {
+		return
+	}
+
+	parallel := t.Parallel
+	if parallel <= 0 {
+		parallel = 1
+	}
+	tasks := make(chan transferTask)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				t.transfer(task)
+			}
+		}()
+	}
+
+	if file.IsFolder() {
+		err = t.walk(src, dst, "", false, tasks)
+	} else {
+		var existing []DriveFile
+		if existing, err = t.list(dst); err == nil {
+			t.plan(file, dst, file.Name, existing, tasks)
+		}
+	}
+	close(tasks)
+	wg.Wait()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result = t.result
+	if err == nil && result.Failed > 0 {
+		err = fmt.Errorf("%d of %d files failed, run the command again to retry them", result.Failed, result.Transferred+result.Skipped+result.Failed)
+	}
+	return
+}
+
+func (t *Transfer) list(folderID string) (files []DriveFile, err error) {
+	err = t.Rotator.Do(0, func(client *DriveClient) (err error) {
+		files, err = client.ListChildren(folderID)
+		return
+	})
+	return
+}
+
+// walk transfers the children of the folder src into the folder dst. fresh
+// tells that dst was just created, and so is empty.
+func (t *Transfer) walk(src string, dst string, dir string, fresh bool, tasks chan<- transferTask) (err error) {
+	var files, existing []DriveFile
+	if files, err = t.list(src); err != nil {
+		return fmt.Errorf("failed to list %s: %w", "/"+dir, err)
+	}
+	if !fresh {
+		if existing, err = t.list(dst); err != nil {
+			return fmt.Errorf("failed to list the destination of %s: %w", "/"+dir, err)
+		}
+	}
+	for _, file := range files {
+		p := path.Join(dir, file.Name)
+		if !file.IsFolder() {
+			t.plan(file, dst, p, existing, tasks)
+			continue
+		}
+		folder := ""
+		for _, f := range existing {
+			if f.IsFolder() && f.Name == file.Name {
+				folder = f.ID
+				break
+			}
+		}
+		created := folder == ""
+		if created {
+			t.mu.Lock()
+			t.result.Folders++
+			t.mu.Unlock()
+			if t.DryRun {
+				fmt.Printf("    would create folder /%s\n", p)
+			} else {
+				var f DriveFile
+				if err = t.Rotator.Do(0, func(client *DriveClient) (err error) {
+					f, err = client.CreateFolder(dst, file.Name)
+					return
+				}); err != nil {
+					return fmt.Errorf("failed to create folder /%s: %w", p, err)
+				}
+				folder = f.ID
+			}
+		}
+		if err = t.walk(file.ID, folder, p, created, tasks); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// plan queues the transfer of file into dst unless it is already there.
+func (t *Transfer) plan(file DriveFile, dst string, p string, existing []DriveFile, tasks chan<- transferTask) {
+	for _, f := range existing {
+		if f.IsFolder() || f.Name != file.Name {
+			continue
+		}
+		same := f.Size == file.Size
+		if t.Checksum && f.MD5Checksum != "" && file.MD5Checksum != "" {
+			same = f.MD5Checksum == file.MD5Checksum
+		}
+		if same {
+			t.mu.Lock()
+			t.result.Skipped++
+			t.mu.Unlock()
+			fmt.Printf("    /%s already in the destination, skipped\n", p)
+			return
+		}
+	}
+	tasks <- transferTask{file: file, dst: dst, path: p}
+}
+
+func (t *Transfer) transfer(task transferTask) {
+	var err error
+	switch {
+	case t.DryRun:
+		fmt.Printf("    would %s /%s (%d bytes)\n", t.verb(), task.path, task.file.Size)
+	case t.Move:
+		// moving does not count against the upload budget
+		err = t.Rotator.Do(0, func(client *DriveClient) (err error) {
+			_, err = client.MoveFile(task.file.ID, task.dst, task.file.Parents)
+			return
+		})
+	default:
+		err = t.Rotator.Do(task.file.Size, func(client *DriveClient) (err error) {
+			_, err = client.CopyFile(task.file.ID, task.dst)
+			return
+		})
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.result.Failed++
+		fmt.Printf("    /%s failed: %v\n", task.path, err)
+		return
+	}
+	t.result.Transferred++
+	t.result.Bytes += task.file.Size
+	switch {
+	case t.DryRun:
+	case t.Move:
+		fmt.Printf("    /%s moved\n", task.path)
+	default:
+		fmt.Printf("    /%s copied\n", task.path)
+	}
+}
@@ -0,0 +1,464 @@
+package core
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultChunkSize is the size of the chunks of a resumable upload, a
+// multiple of 256 KiB as the Drive API requires.
+const DefaultChunkSize = 8 << 20
+
+// errUploadExpired is returned when a resumable upload session is gone.
+var errUploadExpired = errors.New("upload session expired")
+
+// Uploader uploads local files and folder trees into shared drives with
+// resumable uploads, as the accounts of the pool. It keeps the upload
+// sessions in a state file so that an interrupted upload resumes where it
+// stopped.
+type Uploader struct {
+	// sent is first to be 64-bit aligned for atomic operations.
+	sent int64
+
+	Rotator *AccountRotator
+	// Parallel is the number of files uploaded at once.
+	Parallel int
+	// ChunkSize is the size of each request, DefaultChunkSize when 0.
+	ChunkSize int64
+	// StateFile is the path of the state file, none when empty.
+	StateFile string
+	// Retries is the number of attempts of each file, 5 when 0.
+	Retries int
+
+	mu     sync.Mutex
+	state  uploadState
+	result UploadResult
+}
+
+// UploadResult sums up an upload.
+type UploadResult struct {
+	Uploaded int
+	Skipped  int
+	Failed   int
+	Folders  int
+	// Bytes is the size of the files uploaded.
+	Bytes int64
+}
+
+// uploadState is the resume state of an upload, keyed by paths relative to
+// the uploaded directory.
+type uploadState struct {
+	Src     string                    `json:"src"`
+	Dst     string                    `json:"dst"`
+	Folders map[string]string         `json:"folders"`
+	Files   map[string]*uploadSession `json:"files"`
+}
+
+// uploadSession is a resumable upload of a file in the version it was
+// started with.
+type uploadSession struct {
+	URL     string    `json:"url"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// Account is the key of the account the session was created as, charged
+	// with the size once the upload completes.
+	Account string `json:"account,omitempty"`
+}
+
+// uploadTask is a local file to upload into the folder dst.
+type uploadTask struct {
+	local string
+	rel   string
+	info  os.FileInfo
+	dst   string
+}
+
+// Sent returns the number of bytes uploaded so far.
+func (u *Uploader) Sent() int64 {
+	return atomic.LoadInt64(&u.sent)
+}
+
+// Upload uploads the content of the directory localPath into the folder dst,
+// or the file localPath into dst. Folders already in dst are reused and
+// files of the same MD5 checksum are skipped. It returns an error summing up
+// the files that failed.
+func (u *Uploader) Upload(localPath string, dst string) (result UploadResult, err error) {
+	if localPath, err = filepath.Abs(localPath); err != nil {
+		return
+	}
+	if err = u.loadState(localPath, dst); err != nil {
+		return
+	}
+	var info os.FileInfo
+	if info, err = os.Stat(localPath); err != nil {
+		return
+	}
+
+	parallel := u.Parallel
+	if parallel <= 0 {
+		parallel = 1
+	}
+	tasks := make(chan uploadTask)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				u.upload(task)
+			}
+		}()
+	}
+
+	if info.IsDir() {
+		err = u.walk(localPath, "", dst, false, tasks)
+	} else {
+		var existing []DriveFile
+		if existing, err = u.list(dst); err == nil {
+			u.plan(uploadTask{local: localPath, rel: info.Name(), info: info, dst: dst}, existing, tasks)
+		}
+	}
+	close(tasks)
+	wg.Wait()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	result = u.result
+	if err != nil {
+		return
+	}
+	if result.Failed > 0 {
+		return result, fmt.Errorf("%d of %d files failed, run the command again to resume", result.Failed, result.Uploaded+result.Skipped+result.Failed)
+	}
+	if u.StateFile != "" {
+		os.Remove(u.StateFile)
+	}
+	return
+}
+
+// loadState resumes the state of an upload of src into dst, if any.
+func (u *Uploader) loadState(src string, dst string) (err error) {
+	u.state = uploadState{Src: src, Dst: dst, Folders: map[string]string{}, Files: map[string]*uploadSession{}}
+	if u.StateFile == "" {
+		return
+	}
+	var b []byte
+	if b, err = ioutil.ReadFile(u.StateFile); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	var saved uploadState
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return fmt.Errorf("invalid state file %s: %w", u.StateFile, err)
+	}
+	if saved.Src != src || saved.Dst != dst {
+		return fmt.Errorf("state file %s is of an upload of %s into %s", u.StateFile, saved.Src, saved.Dst)
+	}
+	if saved.Folders != nil {
+		u.state.Folders = saved.Folders
+	}
+	if saved.Files != nil {
+		u.state.Files = saved.Files
+	}
+	fmt.Printf("Resuming from %s: %d folders and %d partial uploads recorded\n", u.StateFile, len(u.state.Folders), len(u.state.Files))
+	return
+}
+
+// saveState writes the state file, with u.mu held.
+func (u *Uploader) saveState() {
+	if u.StateFile == "" {
+		return
+	}
+	b, err := json.Marshal(u.state)
+	if err == nil {
+		tmp := u.StateFile + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, u.StateFile)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Failed to save state file %s: %v\n", u.StateFile, err)
+	}
+}
+
+func (u *Uploader) list(folderID string) (files []DriveFile, err error) {
+	err = u.Rotator.Do(0, func(client *DriveClient) (err error) {
+		files, err = client.ListChildren(folderID)
+		return
+	})
+	return
+}
+
+// walk uploads the content of the directory dir into the folder dst. fresh
+// tells that dst was just created, and so is empty.
+func (u *Uploader) walk(dir string, rel string, dst string, fresh bool, tasks chan<- uploadTask) (err error) {
+	var fis []os.FileInfo
+	if fis, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+	var existing []DriveFile
+	if !fresh {
+		if existing, err = u.list(dst); err != nil {
+			return fmt.Errorf("failed to list the destination of %s: %w", dir, err)
+		}
+	}
+	for _, info := range fis {
+		local := filepath.Join(dir, info.Name())
+		p := path.Join(rel, info.Name())
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(local); err != nil {
+				fmt.Printf("    %s skipped: %v\n", local, err)
+				err = nil
+				continue
+			}
+		}
+		if !info.IsDir() {
+			if info.Mode().IsRegular() {
+				u.plan(uploadTask{local: local, rel: p, info: info, dst: dst}, existing, tasks)
+			}
+			continue
+		}
+		u.mu.Lock()
+		folder := u.state.Folders[p]
+		u.mu.Unlock()
+		if folder == "" {
+			for _, f := range existing {
+				if f.IsFolder() && f.Name == info.Name() {
+					folder = f.ID
+					break
+				}
+			}
+		}
+		created := folder == ""
+		if created {
+			var f DriveFile
+			if err = u.Rotator.Do(0, func(client *DriveClient) (err error) {
+				f, err = client.CreateFolder(dst, info.Name())
+				return
+			}); err != nil {
+				return fmt.Errorf("failed to create folder /%s: %w", p, err)
+			}
+			folder = f.ID
+			u.mu.Lock()
+			u.result.Folders++
+			u.mu.Unlock()
+		}
+		u.mu.Lock()
+		u.state.Folders[p] = folder
+		u.saveState()
+		u.mu.Unlock()
+		if err = u.walk(local, p, folder, created, tasks); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// plan queues the upload of a file unless a file of the same name and MD5
+// checksum is already in the destination.
+func (u *Uploader) plan(task uploadTask, existing []DriveFile, tasks chan<- uploadTask) {
+	for _, f := range existing {
+		if f.IsFolder() || f.Name != task.info.Name() || f.Size != task.info.Size() || f.MD5Checksum == "" {
+			continue
+		}
+		if sum, err := fileMD5(task.local); err == nil && sum == f.MD5Checksum {
+			u.mu.Lock()
+			u.result.Skipped++
+			u.mu.Unlock()
+			fmt.Printf("    /%s already in the destination, skipped\n", task.rel)
+			return
+		}
+	}
+	tasks <- task
+}
+
+func fileMD5(name string) (sum string, err error) {
+	var f *os.File
+	if f, err = os.Open(name); err != nil {
+		return
+	}
+	defer f.Close()
+	hash := md5.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// upload uploads a file, resuming its session from the state file when it is
+// of the same version of the file, and starting over when the session
+// expires or its account runs out of quota.
+func (u *Uploader) upload(task uploadTask) {
+	retries := u.Retries
+	if retries <= 0 {
+		retries = 5
+	}
+	size := task.info.Size()
+	var err error
+	for attempt := 0; attempt < retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<uint(attempt-1)) * time.Second)
+		}
+		u.mu.Lock()
+		session := u.state.Files[task.rel]
+		u.mu.Unlock()
+		if session != nil && (session.Size != size || !session.ModTime.Equal(task.info.ModTime())) {
+			session = nil
+		}
+		var client *DriveClient
+		var offset int64
+		var done bool
+		if session != nil {
+			if offset, done, err = u.status(session.URL, size); err == errUploadExpired {
+				session = nil
+			} else if err != nil {
+				continue
+			}
+		}
+		if session == nil {
+			session = &uploadSession{Size: size, ModTime: task.info.ModTime()}
+			mimeType := mime.TypeByExtension(filepath.Ext(task.local))
+			if mimeType == "" {
+				mimeType = "application/octet-stream"
+			}
+			// the budget is charged once the upload completes, not for every
+			// session created
+			if client, err = u.Rotator.try(size, func(c *DriveClient) (err error) {
+				session.URL, err = c.CreateUploadSession(task.dst, task.info.Name(), mimeType, size)
+				return
+			}); err != nil {
+				if err == ErrBudgetExhausted {
+					break
+				}
+				continue
+			}
+			session.Account = client.Account.Key()
+			offset = 0
+			u.mu.Lock()
+			u.state.Files[task.rel] = session
+			u.saveState()
+			u.mu.Unlock()
+		}
+		if !done {
+			err = u.send(session.URL, task.local, offset, size)
+		}
+		if err == nil {
+			if session.Account != "" {
+				u.Rotator.charge(session.Account, size)
+			}
+			u.mu.Lock()
+			delete(u.state.Files, task.rel)
+			u.saveState()
+			u.result.Uploaded++
+			u.result.Bytes += size
+			u.mu.Unlock()
+			fmt.Printf("    /%s uploaded\n", task.rel)
+			return
+		}
+		if e, ok := err.(*DriveError); err == errUploadExpired || ok && (e.Reason() == "userRateLimitExceeded" || e.Reason() == "dailyLimitExceeded") {
+			if ok && client != nil {
+				u.Rotator.rotate(client, e.Reason() == "dailyLimitExceeded", e.Reason())
+			}
+			u.mu.Lock()
+			delete(u.state.Files, task.rel)
+			u.saveState()
+			u.mu.Unlock()
+		}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.result.Failed++
+	fmt.Printf("    /%s failed: %v\n", task.rel, err)
+}
+
+// status returns the number of bytes received by an upload session.
+func (u *Uploader) status(sessionURL string, size int64) (offset int64, done bool, err error) {
+	var req *http.Request
+	if req, err = http.NewRequest("PUT", sessionURL, nil); err != nil {
+		return
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	return u.do(req)
+}
+
+// do sends a request of an upload session, and returns the number of bytes
+// received so far, or done once the upload is complete.
+func (u *Uploader) do(req *http.Request) (offset int64, done bool, err error) {
+	var resp *http.Response
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return 0, true, err
+	case http.StatusPermanentRedirect:
+		if m := uploadRangePattern.FindStringSubmatch(resp.Header.Get("Range")); m != nil {
+			offset, _ = strconv.ParseInt(m[1], 10, 64)
+			offset++
+		}
+		return
+	case http.StatusNotFound, http.StatusGone:
+		return 0, false, errUploadExpired
+	}
+	return 0, false, CheckDriveResponse(resp)
+}
+
+// send uploads the content of a file from offset in chunks.
+func (u *Uploader) send(sessionURL string, local string, offset int64, size int64) (err error) {
+	chunkSize := u.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	var f *os.File
+	if f, err = os.Open(local); err != nil {
+		return
+	}
+	defer f.Close()
+	for {
+		end := offset + chunkSize
+		if end > size {
+			end = size
+		}
+		var req *http.Request
+		if req, err = http.NewRequest("PUT", sessionURL, io.NewSectionReader(f, offset, end-offset)); err != nil {
+			return
+		}
+		req.ContentLength = end - offset
+		if size == 0 {
+			req.Header.Set("Content-Range", "bytes */0")
+		} else {
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, size))
+		}
+		var next int64
+		var done bool
+		if next, done, err = u.do(req); err != nil || done {
+			if err == nil {
+				atomic.AddInt64(&u.sent, end-offset)
+			}
+			return
+		}
+		if next <= offset {
+			return fmt.Errorf("upload made no progress at %d bytes", offset)
+		}
+		atomic.AddInt64(&u.sent, next-offset)
+		offset = next
+	}
+}
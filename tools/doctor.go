@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/workerindex/gdir/tools/client"
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func doctorCommand(args []string) (err error) {
+	fs := newFlagSet("doctor", "")
+	remote := remoteFlags(fs)
+	asJSON := fs.Bool("json", false, "print the checks as JSON")
+	offline := fs.Bool("offline", false, "only check the local files, without calling GitHub, Cloudflare and the site")
+	parallel := fs.Int("j", 8, "number of raw Gist files fetched in parallel")
+	fs.Parse(args)
+
+	d := &core.Doctor{Parallel: *parallel, Offline: *offline}
+	d.Run()
+	if !*offline && core.ValidateConfig() {
+		d.Checks = append(d.Checks, checkLogin(remote))
+	}
+
+	if *asJSON {
+		err = printJSON(d.Checks)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, check := range d.Checks {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", strings.ToUpper(check.Status), check.Name, check.Message)
+			if check.Hint != "" {
+				fmt.Fprintf(w, "\t\tfix: %s\n", check.Hint)
+			}
+		}
+		err = w.Flush()
+	}
+	if err == nil && d.Failed() {
+		err = fmt.Errorf("some checks failed")
+	}
+	return
+}
+
+// checkLogin checks that /login of the site answers, signing in when given
+// credentials. The site is the workers.dev URL of the worker unless given.
+func checkLogin(remote *remoteOptions) core.Check {
+	const logsHint = "check the logs of the worker in the Cloudflare dashboard"
+	check := core.Check{Name: "login", Status: core.CheckFail}
+	if *remote.site == "" {
+		*remote.site = os.Getenv("GDIR_REMOTE")
+	}
+	if *remote.site == "" {
+		siteURL, err := core.WorkerURL()
+		if err != nil {
+			check.Message = fmt.Sprintf("failed to find the URL of the worker: %v", err)
+			check.Hint = "pass the URL of the site with -remote"
+			return check
+		}
+		*remote.site = siteURL
+	}
+	withToken := *remote.token != "" || os.Getenv("GDIR_TOKEN") != ""
+	if withToken || *remote.name != "" || os.Getenv("GDIR_USER") != "" {
+		c, err := remote.connect()
+		if err == nil && withToken {
+			// a login token is only checked by using it
+			_, err = c.ListPage("", "", "")
+		}
+		if err != nil {
+			check.Message = fmt.Sprintf("failed to sign in to %s: %v", *remote.site, err)
+			check.Hint = "check the credentials, then " + logsHint
+			return check
+		}
+		check.Status, check.Message = core.CheckPass, fmt.Sprintf("signed in to %s", c.URL)
+		return check
+	}
+	site, err := client.New(*remote.site)
+	if err != nil {
+		check.Message = err.Error()
+		return check
+	}
+	// an unknown user still makes the worker fetch the users Gist
+	resp, err := http.PostForm(site.URL+"/login", url.Values{"name": {"gdir-doctor"}, "pass": {""}})
+	if err != nil {
+		check.Message = fmt.Sprintf("%s/login does not answer: %v", site.URL, err)
+		check.Hint = "check the URL of the site and the routes of the worker in the Cloudflare dashboard"
+		return check
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		check.Message = fmt.Sprintf("%s/login answers HTTP %d", site.URL, resp.StatusCode)
+		check.Hint = logsHint
+		return check
+	}
+	check.Status, check.Message = core.CheckPass, fmt.Sprintf("%s/login answers, pass -user and -pass to also sign in", site.URL)
+	return check
+}
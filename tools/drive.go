@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func driveCommand(args []string) error {
+	return runSubcommand("drive", map[string]func([]string) error{
+		"copy":   driveCopy,
+		"move":   driveMove,
+		"report": driveReport,
+		"upload": driveUpload,
+	}, args)
+}
+
+func driveCopy(args []string) error {
+	return driveTransfer("copy", false, args)
+}
+
+func driveMove(args []string) error {
+	return driveTransfer("move", true, args)
+}
+
+// driveTransfer copies or moves between shared drives with the Drive API
+// directly, rotating the accounts of the pool.
+func driveTransfer(name string, move bool, args []string) (err error) {
+	var accounts []*core.Account
+	var rotator *core.AccountRotator
+	var result core.TransferResult
+
+	fs := newFlagSet("drive "+name, "<source ID> <destination folder ID>")
+	parallel := fs.Int("j", 4, "number of files to "+name+" in parallel")
+	dryRun := fs.Bool("dry-run", false, "only show what would be done")
+	checksum := fs.Bool("checksum", false, "skip the files already in the destination by MD5 checksum instead of by size")
+	budget := fs.Int64("budget", core.DefaultDailyBudget>>30, "GiB each account may copy per day, tracked in "+core.TransferQuotaFile)
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected a source file or folder ID and a destination folder ID")
+	}
+	if accounts, err = core.LoadAccounts(); err != nil {
+		return
+	}
+	if rotator, err = core.NewAccountRotator(accounts, *budget<<30); err != nil {
+		return
+	}
+	t := &core.Transfer{
+		Rotator:  rotator,
+		Move:     move,
+		DryRun:   *dryRun,
+		Checksum: *checksum,
+		Parallel: *parallel,
+	}
+	if *dryRun {
+		fmt.Printf("Dry run, nothing will be changed.\n")
+	}
+	fmt.Printf("Running %s of %s into %s with %d accounts:\n", name, fs.Arg(0), fs.Arg(1), len(accounts))
+	result, err = t.Run(fs.Arg(0), fs.Arg(1))
+
+	verb, created := "copied", "created"
+	if move {
+		verb = "moved"
+	}
+	if *dryRun {
+		verb, created = "to "+name, "to create"
+	}
+	fmt.Printf("%d files %s (%s), %d skipped, %d failed, %d folders %s.\n",
+		result.Transferred, verb, formatSize(result.Bytes), result.Skipped, result.Failed, result.Folders, created)
+	if !move && !*dryRun {
+		printUsed(rotator, *budget)
+	}
+	return
+}
+
+// printUsed prints the bytes copied today by the accounts of rotator.
+func printUsed(rotator *core.AccountRotator, budget int64) {
+	used := rotator.Used()
+	var labels []string
+	for label, bytes := range used {
+		if bytes > 0 {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		fmt.Printf("    %s used %s of its %d GiB daily budget\n", label, formatSize(used[label]), budget)
+	}
+}
+
+func driveUpload(args []string) (err error) {
+	var accounts []*core.Account
+	var rotator *core.AccountRotator
+	var result core.UploadResult
+
+	fs := newFlagSet("drive upload", "<local path> <destination folder ID>")
+	parallel := fs.Int("j", 4, "number of files to upload in parallel")
+	chunk := fs.Int64("chunk", core.DefaultChunkSize>>20, "size of the upload requests in MiB")
+	state := fs.String("state", "", "state file to resume an interrupted upload from (default .gdir-upload-<destination>.json)")
+	budget := fs.Int64("budget", core.DefaultDailyBudget>>30, "GiB each account may upload per day, tracked in "+core.TransferQuotaFile)
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected a local file or directory and a destination folder ID")
+	}
+	if *chunk <= 0 {
+		return fmt.Errorf("-chunk must be a positive number of MiB")
+	}
+	if *state == "" {
+		*state = fmt.Sprintf(".gdir-upload-%s.json", fs.Arg(1))
+	}
+	if accounts, err = core.LoadAccounts(); err != nil {
+		return
+	}
+	if rotator, err = core.NewAccountRotator(accounts, *budget<<30); err != nil {
+		return
+	}
+	u := &core.Uploader{
+		Rotator:   rotator,
+		Parallel:  *parallel,
+		ChunkSize: *chunk << 20,
+		StateFile: *state,
+	}
+	fmt.Printf("Uploading %s into %s with %d accounts:\n", fs.Arg(0), fs.Arg(1), len(accounts))
+
+	done := make(chan struct{})
+	go func() {
+		start := time.Now()
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				sent := u.Sent()
+				fmt.Printf("Sent %s at %s/s\n", formatSize(sent), formatSize(int64(float64(sent)/time.Since(start).Seconds())))
+			}
+		}
+	}()
+	result, err = u.Upload(fs.Arg(0), fs.Arg(1))
+	close(done)
+
+	fmt.Printf("%d files uploaded (%s), %d skipped, %d failed, %d folders created.\n",
+		result.Uploaded, formatSize(result.Bytes), result.Skipped, result.Failed, result.Folders)
+	printUsed(rotator, *budget)
+	return
+}
+
+// driveReport crawls shared drives and reports their storage usage, largest
+// files and duplicates.
+func driveReport(args []string) (err error) {
+	var accounts []*core.Account
+	var drives []string
+	var report *core.DriveReport
+
+	fs := newFlagSet("drive report", "[drive IDs]")
+	parallel := fs.Int("j", 4, "number of drives to crawl in parallel")
+	format := fs.String("format", "table", "output format: table, csv or json")
+	depth := fs.Int("depth", 2, "folder levels below the drives in the usage tree")
+	top := fs.Int("top", 20, "number of largest files and duplicate groups to report, 0 for all")
+	state := fs.String("state", core.DefaultReportState, "state file to resume an interrupted report from")
+	output := fs.String("o", "", "file to write the report to (default standard output)")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a comma separated list of drive IDs")
+	}
+	write, ok := map[string]func(io.Writer, *core.DriveReport) error{
+		"table": writeReportTable,
+		"csv":   writeReportCSV,
+		"json":  writeReportJSON,
+	}[*format]
+	if !ok {
+		return fmt.Errorf("unknown format %q, expected table, csv or json", *format)
+	}
+	if accounts, err = core.LoadAccounts(); err != nil {
+		return
+	}
+	if fs.NArg() == 0 {
+		drives, err = core.VisibleDrives(accounts, *parallel)
+	} else {
+		drives, err = core.ParseDriveIDs(fs.Arg(0))
+	}
+	if err != nil {
+		return
+	}
+	if len(drives) == 0 {
+		return fmt.Errorf("no shared drives to report on")
+	}
+	fmt.Fprintf(os.Stderr, "Listing %d drives:\n", len(drives))
+	b := &core.ReportBuilder{
+		Accounts:  accounts,
+		Parallel:  *parallel,
+		StateFile: *state,
+		Depth:     *depth,
+		Top:       *top,
+		Logf: func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format, args...)
+		},
+	}
+	if report, err = b.Run(drives); err != nil {
+		return
+	}
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		var f *os.File
+		if f, err = os.Create(*output); err != nil {
+			return
+		}
+		defer func() {
+			if e := f.Close(); err == nil {
+				err = e
+			}
+		}()
+		out = f
+	}
+	return write(out, report)
+}
+
+func writeReportTable(out io.Writer, report *core.DriveReport) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "SIZE\tFILES\tFOLDER\n")
+	for _, folder := range report.Usage {
+		fmt.Fprintf(w, "%s\t%d\t%s%s\n", formatSize(folder.Size), folder.Files, strings.Repeat("  ", folder.Depth), folder.Path)
+	}
+	fmt.Fprintf(w, "\nSIZE\tID\tLARGEST FILE\n")
+	for _, file := range report.Largest {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", formatSize(file.Size), file.ID, file.Path)
+	}
+	fmt.Fprintf(w, "\nWASTED\tID\tDUPLICATES\n")
+	for _, group := range report.Duplicates {
+		fmt.Fprintf(w, "%s\t\t%d copies of %s, MD5 %s\n", formatSize(group.Wasted), len(group.Files), formatSize(group.Size), group.MD5)
+		for _, file := range group.Files {
+			fmt.Fprintf(w, "\t%s\t  %s\n", file.ID, file.Path)
+		}
+	}
+	return w.Flush()
+}
+
+// writeReportCSV writes a row per folder of the usage tree, largest file and
+// duplicate, told apart by the first column.
+func writeReportCSV(out io.Writer, report *core.DriveReport) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"type", "id", "path", "size", "files", "depth", "md5"})
+	for _, folder := range report.Usage {
+		w.Write([]string{"folder", folder.ID, folder.Path, strconv.FormatInt(folder.Size, 10), strconv.Itoa(folder.Files), strconv.Itoa(folder.Depth), ""})
+	}
+	for _, file := range report.Largest {
+		w.Write([]string{"largest", file.ID, file.Path, strconv.FormatInt(file.Size, 10), "", "", file.MD5})
+	}
+	for _, group := range report.Duplicates {
+		for _, file := range group.Files {
+			w.Write([]string{"duplicate", file.ID, file.Path, strconv.FormatInt(file.Size, 10), "", "", file.MD5})
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func writeReportJSON(out io.Writer, report *core.DriveReport) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
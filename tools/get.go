@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/workerindex/gdir/tools/client"
+)
+
+// idPathPatterns find the file or folder ID in the URLs of gdir sites and of
+// Google Drive.
+var idPathPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^/(?:folder|file)/([^/]+)`),
+	regexp.MustCompile(`^/drive/(?:u/\d+/)?folders/([^/]+)`),
+	regexp.MustCompile(`^/file/d/([^/]+)`),
+}
+
+// parseIDOrURL returns the ID of a file or folder given as is or as a URL,
+// and the site of a gdir URL.
+func parseIDOrURL(s string) (id string, site string, err error) {
+	if !strings.Contains(s, "://") {
+		return s, "", nil
+	}
+	var u *url.URL
+	if u, err = url.Parse(s); err != nil {
+		return
+	}
+	for _, pattern := range idPathPatterns {
+		if m := pattern.FindStringSubmatch(u.Path); m != nil {
+			id = m[1]
+			break
+		}
+	}
+	if id == "" {
+		id = u.Query().Get("id")
+	}
+	if id == "" {
+		return "", "", fmt.Errorf("no file or folder ID found in %s", s)
+	}
+	if !strings.HasSuffix(u.Hostname(), "google.com") {
+		site = u.Scheme + "://" + u.Host
+	}
+	return
+}
+
+func getCommand(args []string) (err error) {
+	var c *client.Client
+	var targets []client.Target
+	var id, site string
+
+	fs := newFlagSet("get", "<file ID|folder ID|URL>")
+	remote := remoteFlags(fs)
+	dir := fs.String("o", ".", "directory to download into")
+	parallel := fs.Int("j", 8, "number of segments to download in parallel")
+	segment := fs.Int64("segment", client.DefaultSegmentSize>>20, "size of the segments in MiB")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a file or folder ID, or the URL of a file or folder")
+	}
+	if *segment <= 0 {
+		return fmt.Errorf("-segment must be positive")
+	}
+	if id, site, err = parseIDOrURL(fs.Arg(0)); err != nil {
+		return
+	}
+	if *remote.site == "" {
+		*remote.site = site
+	}
+	if c, err = remote.connect(); err != nil {
+		return
+	}
+
+	g := &client.Getter{
+		Client:      c,
+		Parallel:    *parallel,
+		SegmentSize: *segment << 20,
+		Logf: func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format, args...)
+		},
+	}
+	if targets, err = g.Plan(id, *dir); err != nil {
+		return
+	}
+	var total int64
+	for _, target := range targets {
+		total += target.File.Size
+	}
+	fmt.Fprintf(os.Stderr, "Downloading %d files, %s in total\n", len(targets), formatSize(total))
+
+	done := make(chan struct{})
+	go func() {
+		start := time.Now()
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				received := g.Received()
+				fmt.Fprintf(os.Stderr, "Received %s at %s/s\n", formatSize(received), formatSize(int64(float64(received)/time.Since(start).Seconds())))
+			}
+		}
+	}()
+	err = g.Get(targets)
+	close(done)
+	return
+}
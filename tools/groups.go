@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func groupsCommand(args []string) error {
+	return runSubcommand("groups", map[string]func([]string) error{
+		"list":   groupsList,
+		"set":    groupsSet,
+		"remove": groupsRemove,
+	}, args)
+}
+
+func groupsList(args []string) (err error) {
+	fs := newFlagSet("groups list", "")
+	fs.Parse(args)
+
+	core.ListDriveGroups()
+	return
+}
+
+func groupsSet(args []string) (err error) {
+	var drives []string
+
+	fs := newFlagSet("groups set", "<name> <drive IDs>")
+	yes := fs.Bool("y", false, "re-save and redeploy affected users without asking")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected a group name and a comma separated list of drive IDs")
+	}
+
+	if drives, err = core.ParseDriveIDs(fs.Arg(1)); err != nil {
+		return
+	}
+	if len(drives) == 0 {
+		return fmt.Errorf("drive group %s cannot be empty, use \"gdir groups remove\" instead", fs.Arg(0))
+	}
+
+	return updateDriveGroup(fs.Arg(0), drives, !*yes)
+}
+
+func groupsRemove(args []string) (err error) {
+	var users []core.User
+
+	fs := newFlagSet("groups remove", "<name>")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a group name")
+	}
+
+	if users, err = core.UsersReferencingDriveGroup(fs.Arg(0)); err != nil {
+		return
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("drive group %s is still referenced by %d users", fs.Arg(0), len(users))
+	}
+
+	return core.SetDriveGroup(fs.Arg(0), nil)
+}
+
+func updateDriveGroup(name string, drives []string, confirm bool) (err error) {
+	var saved int
+
+	if err = core.SetDriveGroup(name, drives); err != nil {
+		return
+	}
+
+	if saved, err = core.ResaveUsersForDriveGroup(name, confirm); err != nil {
+		return
+	}
+
+	if saved == 0 {
+		return
+	}
+
+	return core.DeployGist("users")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func indexCommand(args []string) error {
+	return runSubcommand("index", map[string]func([]string) error{
+		"build":  indexBuild,
+		"deploy": indexDeploy,
+	}, args)
+}
+
+func indexBuild(args []string) (err error) {
+	var accounts []*core.Account
+	var drives []string
+	var manifest *core.IndexManifest
+
+	fs := newFlagSet("index build", "[drive IDs]")
+	parallel := fs.Int("j", 4, "number of drives to crawl in parallel")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a comma separated list of drive IDs")
+	}
+	if accounts, err = core.LoadAccounts(); err != nil {
+		return
+	}
+	// rebuilding every drive also drops the drives no longer visible
+	prune := fs.NArg() == 0
+	if prune {
+		drives, err = core.VisibleDrives(accounts, *parallel)
+	} else {
+		drives, err = core.ParseDriveIDs(fs.Arg(0))
+	}
+	if err != nil {
+		return
+	}
+	if len(drives) == 0 {
+		return fmt.Errorf("no shared drives to index")
+	}
+	fmt.Printf("Indexing %d drives into %s/:\n", len(drives), core.IndexDir)
+	b := &core.IndexBuilder{Accounts: accounts, Parallel: *parallel}
+	manifest, err = b.Build(drives, prune)
+	if manifest != nil {
+		folders, files := 0, 0
+		for _, drive := range manifest.Drives {
+			folders += drive.Folders
+			files += drive.Files
+		}
+		fmt.Printf("The index holds %d drives, %d folders and %d files. Run \"gdir index deploy\" to publish it.\n", len(manifest.Drives), folders, files)
+	}
+	return
+}
+
+func indexDeploy(args []string) (err error) {
+	fs := newFlagSet("index deploy", "")
+	noWorker := fs.Bool("no-worker", false, "only push the index gist, without redeploying the worker")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+	if _, err = os.Stat(filepath.Join(core.IndexDir, core.IndexFileName(""))); os.IsNotExist(err) {
+		return fmt.Errorf("no index built yet, run \"gdir index build\" first")
+	} else if err != nil {
+		return
+	}
+	if core.Config.GistID.Index == "" {
+		// the worker learns the URL of a new gist on redeploy
+		*noWorker = false
+		if err = core.InitGitHubAPI(); err != nil {
+			return
+		}
+		if err = core.CreateNewGist("Index", &core.Config.GistID.Index); err != nil {
+			return
+		}
+	}
+	if err = core.ConfigureGistGit(core.IndexDir, core.Config.GistID.Index, core.Config.GistUser, core.Config.GistToken); err != nil {
+		return
+	}
+	if err = core.DeployGist(core.IndexDir); err != nil {
+		return
+	}
+	if *noWorker {
+		return
+	}
+	return deployWorker()
+}
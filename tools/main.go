@@ -23,12 +23,23 @@ func init() {
 	flag.StringVar(&core.Config.AccountRotationStr, "account-rotation", "", "number of seconds to rotate the next list of account candidates (default 60)")
 	flag.StringVar(&core.Config.AccountCandidatesStr, "account-candidates", "", "number of accounts to be selected as candidates at each rotation (default 10)")
 	flag.StringVar(&core.Config.AccountsJSONDir, "accounts-json-dir", "", "AutoRclone generated accounts directory with JSON files")
+	flag.StringVar(&core.Config.DriveAPIURL, "drive-api", "", "Google APIs base URL (default "+core.DefaultDriveAPIURL+")")
+	flag.StringVar(&core.Config.TokenURL, "token-url", "", "OAuth2 token endpoint overriding the accounts' token_uri")
+	flag.StringVar(&core.Config.AuthURL, "auth-url", "", "OAuth2 consent endpoint (default "+core.DefaultAuthURL+")")
 	flag.BoolVar(&core.Config.Debug, "debug", false, "log debug messages")
 }
 
 func run() (err error) {
+	flag.Usage = usage
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		if err = core.LoadConfigFile(); err != nil {
+			return
+		}
+		return runCommand(flag.Args())
+	}
+
 	fmt.Println("                                                                   ")
 	fmt.Println("                                  _ _                              ")
 	fmt.Println("                          __ _ __| (_)_ _                          ")
@@ -68,7 +79,7 @@ func menu() (err error) {
 			fmt.Scanln(&line)
 			line = strings.ToLower(line)
 			if line == "1" {
-				err = editUser()
+				err = editUser(core.User{}, false)
 				break
 			} else if line == "2" {
 				err = removeUser()
@@ -94,8 +105,8 @@ bail:
 	return
 }
 
-func editUser() (err error) {
-	var oldUser, newUser core.User
+func editUser(newUser core.User, totp bool) (err error) {
+	var oldUser core.User
 
 	if err = core.EnterUsername(&newUser.Name); err != nil {
 		return
@@ -113,6 +124,12 @@ func editUser() (err error) {
 		return
 	}
 
+	if totp {
+		if err = core.ResetUserTOTP(&newUser); err != nil {
+			return
+		}
+	}
+
 	if err = core.SaveUser(&newUser); err != nil {
 		return
 	}
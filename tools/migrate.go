@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func migrateCommand(args []string) (err error) {
+	var index *core.LegacyIndex
+	var seen map[string]string
+	var accountsAdded, usersAdded int
+
+	fs := newFlagSet("migrate", "<worker.js>")
+	from := fs.String("from", "", "kind of the deployment to migrate from, only gdindex (also covering GoIndex) is supported")
+	dryRun := fs.Bool("dry-run", false, "only show what would be imported")
+	noDeploy := fs.Bool("no-deploy", false, "do not deploy the gists and the worker")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected the path to the worker script")
+	}
+	if *from != "gdindex" && *from != "goindex" {
+		return fmt.Errorf("unsupported -from %q, expected gdindex", *from)
+	}
+
+	if index, err = core.ParseGDIndexScript(fs.Arg(0)); err != nil {
+		return
+	}
+	if len(index.Accounts) == 0 && len(index.Roots) == 0 {
+		return fmt.Errorf("found neither OAuth clients nor roots in %s", fs.Arg(0))
+	}
+
+	if seen, err = core.PoolKeys(); err != nil {
+		return
+	}
+	for i, account := range index.Accounts {
+		var b []byte
+		var name string
+		if dup, ok := seen[account.Key()]; ok {
+			fmt.Printf("Skipping client %s: same refresh token as %s\n", account.ClientID, dup)
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("Would import %s\n", account.Label())
+			accountsAdded++
+			continue
+		}
+		if b, err = json.MarshalIndent(account, "", "  "); err != nil {
+			return
+		}
+		if name, err = core.ImportAccountJSON(fmt.Sprintf("%s-%d.json", *from, i), b); err != nil {
+			return
+		}
+		fmt.Printf("Imported %s as account %s\n", account.Label(), name)
+		accountsAdded++
+	}
+
+	users, skipped := core.LegacyRootUsers(index.Roots)
+	for _, reason := range skipped {
+		fmt.Printf("Skipping %s\n", reason)
+	}
+	for _, user := range users {
+		var existing core.User
+		var userPath string
+		if userPath, err = core.ComputeUserPath(user.Name); err != nil {
+			return
+		}
+		if err = core.ReadUserByPath(userPath, &existing); err != core.ErrUserNotExists {
+			if err != nil {
+				return
+			}
+			fmt.Printf("Skipping user %s: already exists\n", user.Name)
+			continue
+		}
+		err = nil
+		if *dryRun {
+			fmt.Printf("Would create user %s with drives %v and folders %v\n", user.Name, user.DrivesAllowList, user.FoldersAllowList)
+			usersAdded++
+			continue
+		}
+		if err = core.SaveUser(user); err != nil {
+			return
+		}
+		usersAdded++
+	}
+
+	if *dryRun {
+		fmt.Printf("%d accounts and %d users would be imported.\n", accountsAdded, usersAdded)
+		return
+	}
+	fmt.Printf("%d accounts and %d users imported.\n", accountsAdded, usersAdded)
+	if *noDeploy {
+		return
+	}
+	if accountsAdded > 0 {
+		if err = deployAccounts(); err != nil {
+			return
+		}
+	}
+	if usersAdded > 0 {
+		err = core.DeployGist("users")
+	}
+	return
+}
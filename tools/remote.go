@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/workerindex/gdir/tools/client"
+)
+
+func remoteCommand(args []string) error {
+	return runSubcommand("remote", map[string]func([]string) error{
+		"cp":     remoteCp,
+		"export": remoteExport,
+		"get":    remoteGet,
+		"ls":     remoteLs,
+		"search": remoteSearch,
+		"stat":   remoteStat,
+	}, args)
+}
+
+// remoteOptions are the flags selecting and signing in to a deployed site.
+// Unset flags fall back to the GDIR_* environment variables, keeping
+// passwords and tokens out of the command line.
+type remoteOptions struct {
+	site  *string
+	token *string
+	name  *string
+	pass  *string
+	code  *string
+}
+
+func remoteFlags(fs *flag.FlagSet) *remoteOptions {
+	return &remoteOptions{
+		site:  fs.String("remote", "", "URL of the gdir site (default $GDIR_REMOTE)"),
+		token: fs.String("token", "", "login token, the t cookie of a signed in browser (default $GDIR_TOKEN)"),
+		name:  fs.String("user", "", "user name to sign in with (default $GDIR_USER)"),
+		pass:  fs.String("pass", "", "password to sign in with (default $GDIR_PASS)"),
+		code:  fs.String("code", "", "two-factor code or backup code of the user"),
+	}
+}
+
+// connect signs in to the site once the flags are parsed.
+func (o *remoteOptions) connect() (c *client.Client, err error) {
+	env := func(val *string, key string) string {
+		if *val != "" {
+			return *val
+		}
+		return os.Getenv(key)
+	}
+	if env(o.site, "GDIR_REMOTE") == "" {
+		return nil, fmt.Errorf("no site given, use -remote or set GDIR_REMOTE")
+	}
+	if c, err = client.NewWithToken(env(o.site, "GDIR_REMOTE"), env(o.token, "GDIR_TOKEN")); err != nil {
+		return
+	}
+	if c.Token == "" {
+		if env(o.name, "GDIR_USER") == "" {
+			return nil, fmt.Errorf("either -token or -user and -pass are required")
+		}
+		err = c.Login(env(o.name, "GDIR_USER"), env(o.pass, "GDIR_PASS"), *o.code)
+	}
+	return
+}
+
+// formatSize formats a number of bytes with a binary unit.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printFiles prints a listing, folders with a trailing slash.
+func printFiles(drives []client.Drive, files []client.File) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tSIZE\tMODIFIED\tNAME\n")
+	for _, drive := range drives {
+		fmt.Fprintf(w, "%s\t-\t-\t%s/\n", drive.ID, drive.Name)
+	}
+	for _, file := range files {
+		size, modified, name := "-", "-", file.Name
+		if file.IsFolder() {
+			name += "/"
+		} else {
+			size = formatSize(file.Size)
+		}
+		if !file.ModifiedTime.IsZero() {
+			modified = file.ModifiedTime.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", file.ID, size, modified, name)
+	}
+	w.Flush()
+}
+
+func remoteLs(args []string) (err error) {
+	var c *client.Client
+	var list *client.FileList
+
+	fs := newFlagSet("remote ls", "[folder ID]")
+	remote := remoteFlags(fs)
+	orderBy := fs.String("order", "", "Drive API orderBy of the listing, such as \"name desc\" (default folders first, then by name)")
+	asJSON := fs.Bool("json", false, "print the listing as JSON")
+	fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return fmt.Errorf("expected at most one folder ID")
+	}
+	if c, err = remote.connect(); err != nil {
+		return
+	}
+	if list, err = c.List(fs.Arg(0), *orderBy); err != nil {
+		return
+	}
+	if *asJSON {
+		return printJSON(list)
+	}
+	printFiles(list.Drives, list.Files)
+	return
+}
+
+func remoteSearch(args []string) (err error) {
+	var c *client.Client
+	var files []client.File
+
+	fs := newFlagSet("remote search", "<query>")
+	remote := remoteFlags(fs)
+	asJSON := fs.Bool("json", false, "print the results as JSON")
+	index := fs.Bool("index", false, "search the names in the deployed search index instead of the Drive API, printing paths")
+	limit := fs.Int("limit", 100, "with -index, maximum number of results, at most 1000")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("expected a query")
+	}
+	if c, err = remote.connect(); err != nil {
+		return
+	}
+	if *index {
+		files, err = c.IndexSearch(strings.Join(fs.Args(), " "), *limit)
+	} else {
+		files, err = c.Search(strings.Join(fs.Args(), " "))
+	}
+	if err != nil {
+		return
+	}
+	if *asJSON {
+		return printJSON(files)
+	}
+	if *index {
+		for i := range files {
+			files[i].Name = files[i].Path
+		}
+	}
+	printFiles(nil, files)
+	return
+}
+
+func remoteStat(args []string) (err error) {
+	var c *client.Client
+	var file *client.File
+
+	fs := newFlagSet("remote stat", "<file ID>")
+	remote := remoteFlags(fs)
+	asJSON := fs.Bool("json", false, "print the metadata as JSON")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a file ID")
+	}
+	if c, err = remote.connect(); err != nil {
+		return
+	}
+	if file, err = c.File(fs.Arg(0)); err != nil {
+		return
+	}
+	if *asJSON {
+		return printJSON(file)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", file.ID)
+	fmt.Fprintf(w, "Name:\t%s\n", file.Name)
+	fmt.Fprintf(w, "Type:\t%s\n", file.MimeType)
+	if !file.IsFolder() {
+		fmt.Fprintf(w, "Size:\t%s (%d bytes)\n", formatSize(file.Size), file.Size)
+		fmt.Fprintf(w, "MD5:\t%s\n", file.MD5Checksum)
+	}
+	if !file.ModifiedTime.IsZero() {
+		fmt.Fprintf(w, "Modified:\t%s\n", file.ModifiedTime.Local().Format("2006-01-02 15:04:05"))
+	}
+	if len(file.Parents) > 0 {
+		fmt.Fprintf(w, "Parents:\t%s\n", strings.Join(file.Parents, ", "))
+	}
+	if file.DriveID != "" {
+		fmt.Fprintf(w, "Drive:\t%s\n", file.DriveID)
+	}
+	return w.Flush()
+}
+
+// parseRange parses a byte range as start-end, start- or -length.
+func parseRange(s string) (r *client.Range, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid range %q, expected start-end", s)
+	}
+	r = &client.Range{End: -1}
+	if parts[0] != "" {
+		if r.Start, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid range %q: %w", s, err)
+		}
+	}
+	if parts[1] != "" {
+		if r.End, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid range %q: %w", s, err)
+		}
+	}
+	if r.End >= 0 && r.End < r.Start {
+		return nil, fmt.Errorf("invalid range %q, end before start", s)
+	}
+	return
+}
+
+func remoteGet(args []string) (err error) {
+	var c *client.Client
+	var file *client.File
+	var r *client.Range
+	var body io.ReadCloser
+
+	fs := newFlagSet("remote get", "<file ID>")
+	remote := remoteFlags(fs)
+	output := fs.String("o", "", "file to write to, - for stdout (default the file name in the current directory)")
+	byteRange := fs.String("range", "", "only download the bytes start-end, inclusive")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a file ID")
+	}
+	if *byteRange != "" {
+		if r, err = parseRange(*byteRange); err != nil {
+			return
+		}
+	}
+	if c, err = remote.connect(); err != nil {
+		return
+	}
+	if file, err = c.File(fs.Arg(0)); err != nil {
+		return
+	}
+	if file.IsFolder() {
+		return fmt.Errorf("%s is a folder", file.Name)
+	}
+	path := *output
+	if path == "" {
+		path = filepath.Base(filepath.Clean("/" + file.Name))
+	}
+	if body, err = c.Download(file.ID, r); err != nil {
+		return
+	}
+	defer body.Close()
+	out := os.Stdout
+	if path != "-" {
+		if out, err = os.Create(path); err != nil {
+			return
+		}
+		defer out.Close()
+	}
+	var n int64
+	if n, err = io.Copy(out, body); err != nil {
+		return
+	}
+	if path != "-" {
+		fmt.Fprintf(os.Stderr, "Downloaded %s (%s) to %s\n", file.Name, formatSize(n), path)
+		return out.Close()
+	}
+	return
+}
+
+func remoteCp(args []string) (err error) {
+	var c *client.Client
+	var result client.CopyResult
+
+	fs := newFlagSet("remote cp", "<source folder ID> <destination folder ID>")
+	remote := remoteFlags(fs)
+	parallel := fs.Int("j", 4, "number of files to copy in parallel")
+	journal := fs.String("journal", "", "journal file to resume an interrupted copy from (default .gdir-cp-<source>-<destination>.json)")
+	poll := fs.Duration("poll", client.DefaultPollInterval, "time between two checks of a copy in progress")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected a source and a destination folder ID")
+	}
+	if *journal == "" {
+		*journal = fmt.Sprintf(".gdir-cp-%s-%s.json", fs.Arg(0), fs.Arg(1))
+	}
+	if c, err = remote.connect(); err != nil {
+		return
+	}
+	copier := &client.Copier{
+		Client:       c,
+		Parallel:     *parallel,
+		Journal:      *journal,
+		PollInterval: *poll,
+		Logf: func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format, args...)
+		},
+	}
+	start := time.Now()
+	result, err = copier.Copy(fs.Arg(0), fs.Arg(1))
+	fmt.Fprintf(os.Stderr, "Copied %d files (%s), skipped %d, failed %d in %s\n",
+		result.Copied, formatSize(result.Bytes), result.Skipped, result.Failed, time.Since(start).Round(time.Second))
+	return
+}
+
+func remoteExport(args []string) (err error) {
+	var c *client.Client
+	var entries []client.ExportEntry
+	var expires time.Time
+
+	fs := newFlagSet("remote export", "<folder ID>")
+	remote := remoteFlags(fs)
+	format := fs.String("format", "m3u", "output format: m3u (audio and video files only), aria2, wget or json")
+	recursive := fs.Bool("recursive", false, "also export the files of the subfolders")
+	ttl := fs.Duration("ttl", 0, "lifetime of the links, at most 720h (default 168h)")
+	output := fs.String("o", "", "file to write the export to (default standard output)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a folder ID")
+	}
+	write, ok := map[string]func(io.Writer, []client.ExportEntry) error{
+		"m3u":   writeExportM3U,
+		"aria2": writeExportAria2,
+		"wget":  writeExportWget,
+		"json":  writeExportJSON,
+	}[*format]
+	if !ok {
+		return fmt.Errorf("unknown format %q, expected m3u, aria2, wget or json", *format)
+	}
+	if c, err = remote.connect(); err != nil {
+		return
+	}
+	if entries, expires, err = c.Export(fs.Arg(0), *recursive, *ttl); err != nil {
+		return
+	}
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		var f *os.File
+		if f, err = os.Create(*output); err != nil {
+			return
+		}
+		defer func() {
+			if e := f.Close(); err == nil {
+				err = e
+			}
+		}()
+		out = f
+	}
+	if err = write(out, entries); err != nil {
+		return
+	}
+	// anyone holding the export can download the folder until then
+	fmt.Fprintf(os.Stderr, "Exported %d files, the links expire on %s\n", len(entries), expires.Local().Format("2006-01-02 15:04"))
+	return
+}
+
+func writeExportM3U(out io.Writer, entries []client.ExportEntry) (err error) {
+	if _, err = fmt.Fprintf(out, "#EXTM3U\n"); err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.MimeType, "audio/") && !strings.HasPrefix(entry.MimeType, "video/") {
+			continue
+		}
+		if _, err = fmt.Fprintf(out, "#EXTINF:-1,%s\n%s\n", entry.Name, entry.URL); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// writeExportAria2 writes an input file for aria2c -i, saving each file
+// under its path and checking it against its MD5 checksum.
+func writeExportAria2(out io.Writer, entries []client.ExportEntry) (err error) {
+	for _, entry := range entries {
+		if _, err = fmt.Fprintf(out, "%s\n  out=%s\n", entry.URL, entry.Path); err != nil {
+			return
+		}
+		if entry.MD5Checksum != "" {
+			if _, err = fmt.Fprintf(out, "  checksum=md5=%s\n", entry.MD5Checksum); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// writeExportWget writes a shell script downloading each file to its path,
+// continuing partial downloads when run again.
+func writeExportWget(out io.Writer, entries []client.ExportEntry) (err error) {
+	quote := func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+	if _, err = fmt.Fprintf(out, "#!/bin/sh\nset -e\n"); err != nil {
+		return
+	}
+	dirs := map[string]bool{}
+	for _, entry := range entries {
+		if dir := path.Dir(entry.Path); !dirs[dir] {
+			dirs[dir] = true
+			if _, err = fmt.Fprintf(out, "mkdir -p %s\n", quote(dir)); err != nil {
+				return
+			}
+		}
+		if _, err = fmt.Fprintf(out, "wget -c -O %s %s\n", quote(entry.Path), quote(entry.URL)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func writeExportJSON(out io.Writer, entries []client.ExportEntry) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func rotationCommand(args []string) error {
+	return runSubcommand("rotation", map[string]func([]string) error{
+		"simulate": rotationSimulate,
+		"check":    rotationCheck,
+		"strategy": rotationStrategy,
+		"preview":  rotationPreview,
+	}, args)
+}
+
+// rotationFlags adds the flags overriding the configured rotation settings.
+func rotationFlags(fs *flag.FlagSet) (accounts *int, rotation *uint64, candidates *uint64) {
+	accounts = fs.Int("accounts", 0, "number of accounts in the pool (default from config)")
+	rotation = fs.Uint64("rotation", 0, "account candidates rotation interval in seconds (default from config)")
+	candidates = fs.Uint64("candidates", 0, "account candidates size (default from config)")
+	return
+}
+
+func rotationParams(accounts int, rotation uint64, candidates uint64) (params core.RotationParams, err error) {
+	params = core.RotationParams{Accounts: int(core.Config.AccountsCount), Rotation: core.Config.AccountRotation, Candidates: core.Config.AccountCandidates}
+	if accounts > 0 {
+		params.Accounts = accounts
+	}
+	if rotation > 0 {
+		params.Rotation = rotation
+	}
+	if candidates > 0 {
+		params.Candidates = candidates
+	}
+	if params.Accounts == 0 || params.Rotation == 0 || params.Candidates == 0 {
+		err = fmt.Errorf("accounts, rotation and candidates must all be positive")
+	}
+	return
+}
+
+// newAccountPicker returns the Go port of the worker's account picker for
+// strategy, loading the account weights from the pool when needed.
+func newAccountPicker(strategy string, params core.RotationParams) (picker *core.AccountPicker, err error) {
+	picker = &core.AccountPicker{Secret: core.Config.SecretKey, Params: params, Strategy: strategy}
+	if strategy != core.StrategyWeighted {
+		return
+	}
+	if err = core.ValidateAccountStrategy(strategy, core.Config.AccountWeights); err != nil {
+		return
+	}
+	if picker.Weights, err = core.WorkerAccountWeights(); err != nil {
+		return
+	}
+	if len(picker.Weights) != params.Accounts {
+		err = fmt.Errorf("the %s strategy can only be simulated with the %d accounts of the pool", strategy, len(picker.Weights))
+	}
+	return
+}
+
+// parseWorkerTime parses an RFC 3339 time or Unix milliseconds as returned by
+// Date.now() in the worker, defaulting to now.
+func parseWorkerTime(s string) (ms int64, err error) {
+	if s == "" {
+		return time.Now().UnixNano() / int64(time.Millisecond), nil
+	}
+	if ms, err = strconv.ParseInt(s, 10, 64); err == nil {
+		return
+	}
+	var t time.Time
+	if t, err = time.Parse(time.RFC3339Nano, s); err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected RFC 3339 or Unix milliseconds", s)
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+func parseUintList(s string) (values []uint64, err error) {
+	for _, field := range strings.Split(s, ",") {
+		var v uint64
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		if v, err = strconv.ParseUint(field, 10, 64); err != nil || v == 0 {
+			return nil, fmt.Errorf("invalid value %q, expected a positive integer", field)
+		}
+		values = append(values, v)
+	}
+	return
+}
+
+// neighbours returns v/2, v and 2v, used as default comparison points.
+func neighbours(v uint64) (values []uint64) {
+	if v/2 > 0 {
+		values = append(values, v/2)
+	}
+	return append(values, v, v*2)
+}
+
+func rotationSimulate(args []string) (err error) {
+	var params core.RotationParams
+	var picker *core.AccountPicker
+	var startMs int64
+	var rotations, candidatesList []uint64
+
+	fs := newFlagSet("rotation simulate", "")
+	perMinute := fs.Float64("requests-per-min", 60, "requests per minute sent to the worker")
+	hours := fs.Float64("hours", 24, "simulated duration in hours")
+	start := fs.String("start", "", "simulation start as RFC 3339 time or Unix milliseconds (default now)")
+	seed := fs.Int64("seed", 1, "seed replacing the worker's Math.random when picking among candidates")
+	top := fs.Int("top", 10, "number of busiest accounts to show, 0 for all")
+	compareRotations := fs.String("compare-rotations", "", "comma separated rotation intervals to compare (default half, same and double)")
+	compareCandidates := fs.String("compare-candidates", "", "comma separated candidates sizes to compare (default half, same and double)")
+	strategy := fs.String("strategy", "", "account strategy to simulate (default from config)")
+	users := fs.Int("users", 0, "number of signed in users sending the requests, 0 for anonymous requests")
+	accounts, rotation, candidates := rotationFlags(fs)
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+	if params, err = rotationParams(*accounts, *rotation, *candidates); err != nil {
+		return
+	}
+	if *strategy == "" {
+		*strategy = core.AccountStrategy()
+	}
+	if picker, err = newAccountPicker(*strategy, params); err != nil {
+		return
+	}
+	if startMs, err = parseWorkerTime(*start); err != nil {
+		return
+	}
+	if rotations, err = parseUintList(*compareRotations); err != nil {
+		return
+	}
+	if candidatesList, err = parseUintList(*compareCandidates); err != nil {
+		return
+	}
+	if len(rotations) == 0 {
+		rotations = neighbours(params.Rotation)
+	}
+	if len(candidatesList) == 0 {
+		candidatesList = neighbours(params.Candidates)
+	}
+
+	from := time.Unix(0, startMs*int64(time.Millisecond))
+	duration := time.Duration(*hours * float64(time.Hour))
+	load := core.SimulateRotation(picker, from, *perMinute, duration, *users, rand.New(rand.NewSource(*seed)))
+
+	fmt.Printf("Simulated %d requests over %v at %g requests/min with %d accounts, %s strategy, %d candidates, rotation every %ds.\n\n",
+		load.Requests, duration, *perMinute, params.Accounts, *strategy, params.Candidates, params.Rotation)
+
+	order := make([]int, params.Accounts)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return load.Counts[order[a]] > load.Counts[order[b]] })
+	if *top > 0 && *top < len(order) {
+		order = order[:*top]
+		fmt.Printf("Busiest %d accounts:\n", *top)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "Account\tFile\tRequests\tShare\t\n")
+	for _, i := range order {
+		fmt.Fprintf(w, "%d\taccounts/%s\t%d\t%.2f%%\t\n", i, core.WorkerAccountFile(i), load.Counts[i], 100*float64(load.Counts[i])/float64(load.Requests))
+	}
+	w.Flush()
+	fmt.Println()
+	fmt.Printf("Idle accounts: %d of %d\n", load.Idle(), params.Accounts)
+	fmt.Printf("Peak load: %d requests in one minute on account %d at %s\n", load.PeakPerMinute, load.PeakAccount, load.PeakMinute.Format(time.RFC3339))
+
+	if *strategy != core.StrategyWindow && *strategy != core.StrategySticky {
+		return
+	}
+	fmt.Println()
+	fmt.Println("Load by rotation interval and candidates size:")
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "Rotation\tCandidates\tMax requests\tIdle accounts\tPeak/min\t\t\n")
+	for _, r := range rotations {
+		for _, c := range candidatesList {
+			p := &core.AccountPicker{Secret: core.Config.SecretKey, Params: core.RotationParams{Accounts: params.Accounts, Rotation: r, Candidates: c}, Strategy: *strategy}
+			l := core.SimulateRotation(p, from, *perMinute, duration, *users, rand.New(rand.NewSource(*seed)))
+			mark := ""
+			if r == params.Rotation && c == params.Candidates {
+				mark = "(current)"
+			}
+			fmt.Fprintf(w, "%ds\t%d\t%d\t%d\t%d\t%s\t\n", r, c, l.Max(), l.Idle(), l.PeakPerMinute, mark)
+		}
+	}
+	w.Flush()
+	return
+}
+
+func rotationPreview(args []string) (err error) {
+	var params core.RotationParams
+	var startMs int64
+
+	fs := newFlagSet("rotation preview", "")
+	perMinute := fs.Float64("requests-per-min", 60, "requests per minute sent to the worker")
+	hours := fs.Float64("hours", 24, "simulated duration in hours")
+	users := fs.Int("users", 20, "number of signed in users sending the requests")
+	seed := fs.Int64("seed", 1, "seed replacing the worker's Math.random")
+	accounts, rotation, candidates := rotationFlags(fs)
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+	if params, err = rotationParams(*accounts, *rotation, *candidates); err != nil {
+		return
+	}
+	if startMs, err = parseWorkerTime(""); err != nil {
+		return
+	}
+	from := time.Unix(0, startMs*int64(time.Millisecond))
+	duration := time.Duration(*hours * float64(time.Hour))
+
+	var names []string
+	for name := range core.AccountStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("Load of %g requests/min over %v from %d users on %d accounts:\n", *perMinute, duration, *users, params.Accounts)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "Strategy\tMax requests\tMax share\tIdle accounts\tPeak/min\t\t\n")
+	for _, name := range names {
+		picker, e := newAccountPicker(name, params)
+		if e != nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t(%v)\t\n", name, e)
+			continue
+		}
+		load := core.SimulateRotation(picker, from, *perMinute, duration, *users, rand.New(rand.NewSource(*seed)))
+		mark := ""
+		if name == core.AccountStrategy() {
+			mark = "(current)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.2f%%\t%d\t%d\t%s\t\n", name, load.Max(), 100*float64(load.Max())/float64(load.Requests), load.Idle(), load.PeakPerMinute, mark)
+	}
+	w.Flush()
+	return
+}
+
+func rotationStrategy(args []string) (err error) {
+	var weights map[string]float64
+
+	fs := newFlagSet("rotation strategy", "[window|shuffle|weighted|sticky]")
+	weightsStr := fs.String("weights", "", "weights of the weighted strategy as comma separated key=weight, key being authorized_user, service_account or tag:<name>")
+	noDeploy := fs.Bool("no-deploy", false, "do not redeploy the worker")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	if fs.NArg() == 0 {
+		var names []string
+		for name := range core.AccountStrategies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			mark := " "
+			if name == core.AccountStrategy() {
+				mark = "*"
+			}
+			fmt.Printf("%s %-8s  %s\n", mark, name, core.AccountStrategies[name])
+		}
+		if len(core.Config.AccountWeights) > 0 {
+			fmt.Printf("\nWeights: %s\n", core.FormatAccountWeights(core.Config.AccountWeights))
+		}
+		return
+	}
+
+	if *weightsStr != "" {
+		if weights, err = core.ParseAccountWeights(*weightsStr); err != nil {
+			return
+		}
+	} else if fs.Arg(0) == core.StrategyWeighted {
+		weights = core.Config.AccountWeights
+	}
+	if err = core.SetAccountStrategy(fs.Arg(0), weights); err != nil {
+		return
+	}
+	fmt.Printf("Account strategy set to %s.\n", fs.Arg(0))
+
+	if *noDeploy {
+		return
+	}
+	return deployWorker()
+}
+
+func rotationCheck(args []string) (err error) {
+	var params core.RotationParams
+	var now int64
+	var picked []int
+
+	fs := newFlagSet("rotation check", "")
+	at := fs.String("at", "", "time to check as RFC 3339 time or Unix milliseconds (default now)")
+	accounts, rotation, candidates := rotationFlags(fs)
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+	if params, err = rotationParams(*accounts, *rotation, *candidates); err != nil {
+		return
+	}
+	if now, err = parseWorkerTime(*at); err != nil {
+		return
+	}
+
+	window := core.PickWindow(core.Config.SecretKey, params, now)
+	fmt.Printf("Time:       %d (%s)\n", now, time.Unix(0, now*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano))
+	if window.Seed != "" {
+		fmt.Printf("Seed:       secret + %s\n", strings.TrimPrefix(window.Seed, core.Config.SecretKey))
+		fmt.Printf("SHA-256:    %s\n", window.Digest)
+		fmt.Printf("Rand:       %d (start at %d)\n", window.Rand, window.Rand%uint32(params.Accounts))
+	}
+	fmt.Printf("Go port:    %v\n", window.Candidates)
+
+	if picked, err = core.CrossCheckWindow(core.Config.SecretKey, params, now); err != nil {
+		return
+	}
+	fmt.Printf("Worker:     %v\n", picked)
+	if fmt.Sprint(picked) != fmt.Sprint(window.Candidates) {
+		return fmt.Errorf("the Go port does not match the worker")
+	}
+	fmt.Println("The Go port matches the worker.")
+	return
+}
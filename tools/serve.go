@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func serveCommand(args []string) (err error) {
+	var server *core.Server
+
+	fs := newFlagSet("serve", "")
+	listen := fs.String("listen", ":8080", "address to serve the index on")
+	fs.Parse(args)
+
+	if core.Config.SecretKey == "" {
+		return fmt.Errorf("no secret key configured, run %s without a command to start the setup wizard", os.Args[0])
+	}
+
+	if server, err = core.NewServer(); err != nil {
+		return
+	}
+
+	log.Printf("serving %d accounts with the %s strategy on %s", len(server.Accounts), core.AccountStrategy(), *listen)
+	// no write timeout, as downloads stream for as long as they take
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           server,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/workerindex/gdir/tools/core"
+)
+
+func userCommand(args []string) error {
+	return runSubcommand("user", map[string]func([]string) error{
+		"add":          userAdd,
+		"totp-reset":   userTOTPReset,
+		"backup-codes": userBackupCodes,
+	}, args)
+}
+
+func userAdd(args []string) (err error) {
+	var user core.User
+
+	fs := newFlagSet("user add", "[name]")
+	totp := fs.Bool("totp", false, "enable TOTP two-factor authentication for the user")
+	fs.StringVar(&user.ExpiresAtStr, "expires", "", "expiry as YYYY-MM-DD, RFC 3339 time, duration like 30d, or \"never\"")
+	fs.StringVar(&user.DisabledStr, "disabled", "", "whether the user is disabled (true or false)")
+	fs.StringVar(&user.FoldersAllowListStr, "folders", "", "comma separated folder IDs the user is restricted to")
+	fs.StringVar(&user.CapabilitiesStr, "caps", "", "capability preset (full, download, browse) or comma separated list of list, search, download, copy")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	user.Name = fs.Arg(0)
+	return editUser(user, *totp)
+}
+
+func userTOTPReset(args []string) (err error) {
+	var user core.User
+
+	fs := newFlagSet("user totp-reset", "<name>")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	user.Name = fs.Arg(0)
+	if err = core.EnterUsername(&user.Name); err != nil {
+		return
+	}
+
+	if err = core.ReadUser(user.Name, &user); err != nil {
+		return
+	}
+
+	if err = core.ResetUserTOTP(&user); err != nil {
+		return
+	}
+
+	return saveAndDeployUser(&user)
+}
+
+func userBackupCodes(args []string) (err error) {
+	var user core.User
+
+	fs := newFlagSet("user backup-codes", "<name>")
+	count := fs.Int("n", 10, "number of backup codes to generate")
+	usage := fs.Usage
+	fs.Usage = func() {
+		usage()
+		fmt.Fprintln(fs.Output(), "\nThe worker cannot write the users Gist, so it only enforces the single use of")
+		fmt.Fprintln(fs.Output(), "backup codes in the cache of each data center, and for a year at most. Generate")
+		fmt.Fprintln(fs.Output(), "a new set, revoking the previous one, once some codes have been used.")
+	}
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	user.Name = fs.Arg(0)
+	if err = core.EnterUsername(&user.Name); err != nil {
+		return
+	}
+
+	if err = core.ReadUser(user.Name, &user); err != nil {
+		return
+	}
+
+	if err = core.ResetUserBackupCodes(&user, *count); err != nil {
+		return
+	}
+
+	return saveAndDeployUser(&user)
+}
+
+func saveAndDeployUser(user *core.User) (err error) {
+	if err = core.SaveUser(user); err != nil {
+		return
+	}
+
+	return core.DeployGist("users")
+}
+
+func usersCommand(args []string) error {
+	return runSubcommand("users", map[string]func([]string) error{
+		"list":  usersList,
+		"prune": usersPrune,
+	}, args)
+}
+
+func usersList(args []string) (err error) {
+	fs := newFlagSet("users list", "")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	return core.ListUsers()
+}
+
+func usersPrune(args []string) (err error) {
+	var pruned int
+
+	fs := newFlagSet("users prune", "")
+	dryRun := fs.Bool("dry-run", false, "only print the expired users")
+	fs.Parse(args)
+
+	if err = requireConfig(); err != nil {
+		return
+	}
+
+	if pruned, err = core.PruneUsers(*dryRun); err != nil {
+		return
+	}
+
+	if pruned == 0 || *dryRun {
+		return
+	}
+
+	return core.DeployGist("users")
+}
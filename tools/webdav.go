@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/workerindex/gdir/tools/client"
+)
+
+func webdavCommand(args []string) (err error) {
+	fs := newFlagSet("webdav", "")
+	listen := fs.String("listen", ":8080", "address to serve WebDAV on")
+	site := fs.String("remote", "", "URL of the gdir site (default $GDIR_REMOTE)")
+	ttl := fs.Duration("ttl", client.DefaultListingTTL, "how long to cache folder listings")
+	fs.Parse(args)
+
+	if *site == "" {
+		*site = os.Getenv("GDIR_REMOTE")
+	}
+	if *site == "" {
+		fs.Usage()
+		return fmt.Errorf("no site given, use -remote or set GDIR_REMOTE")
+	}
+	if _, err = client.New(*site); err != nil {
+		return
+	}
+
+	dav := &client.WebDAV{
+		Site: *site,
+		TTL:  *ttl,
+		Logf: log.Printf,
+	}
+	log.Printf("serving %s as read-only WebDAV on %s, sign in with gdir user names and passwords", *site, *listen)
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           dav,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,126 @@
+import { GoogleDrive, GoogleDriveAccount, User } from './drive';
+
+// give up walking parents beyond this depth
+const MAX_FOLDER_DEPTH = 64;
+
+// stop walking the parents of search results after this many lookups, to stay
+// within the subrequest limit of workers
+const MAX_SEARCH_LOOKUPS = 25;
+
+// FolderACL restricts a user with a folders_allow_list to the subtrees of those
+// folders, plus the drives in its drives_white_list, by walking up parents.
+export class FolderACL {
+    private cache: Record<string, Promise<boolean>> = {};
+    private accounts: Record<string, Promise<GoogleDriveAccount>> = {};
+    private folders?: Promise<any[]>;
+    private lookups = 0;
+
+    constructor(private gd: GoogleDrive, private user?: User) {}
+
+    get enabled(): boolean {
+        return !!this.user && !!this.user.folders_allow_list && this.user.folders_allow_list.length > 0;
+    }
+
+    isRoot(id: string): boolean {
+        if (!this.enabled) {
+            return false;
+        }
+        const { folders_allow_list, drives_white_list } = this.user as User;
+        return (
+            (folders_allow_list as string[]).indexOf(id) >= 0 ||
+            (drives_white_list != null && drives_white_list.indexOf(id) >= 0)
+        );
+    }
+
+    // allowed walks up the parents of id with an account of the pool of its
+    // drive, found from id unless parents are given.
+    async allowed(id: string, parents?: string[], depth = 0, drive?: string): Promise<boolean> {
+        if (!this.enabled || this.isRoot(id)) {
+            return true;
+        }
+        if (depth >= MAX_FOLDER_DEPTH) {
+            return false;
+        }
+        if (!(id in this.cache)) {
+            this.cache[id] = (async () => {
+                if (parents == null) {
+                    if (depth === 0) {
+                        drive = await this.gd.poolDriveOf(id);
+                    }
+                    this.lookups++;
+                    parents = await this.gd.parents(await this.pickAccount(drive), id);
+                }
+                for (const parent of parents) {
+                    if (await this.allowed(parent, undefined, depth + 1, drive)) {
+                        return true;
+                    }
+                }
+                return false;
+            })();
+        }
+        return this.cache[id];
+    }
+
+    // filter keeps the search results allowed to the user. It walks them one at
+    // a time, so that siblings find their parents cached, and drops the rest of
+    // the results once MAX_SEARCH_LOOKUPS parents were looked up.
+    async filter(files: any[]): Promise<any[]> {
+        if (!this.enabled) {
+            return files;
+        }
+        const allowed: any[] = [];
+        for (const file of files) {
+            if (this.lookups >= MAX_SEARCH_LOOKUPS) {
+                break;
+            }
+            if (await this.allowed(file.id, file.parents || [])) {
+                allowed.push(file);
+            }
+        }
+        return allowed;
+    }
+
+    // rootFolders returns the metadata of the allowed folders, detached from
+    // their parents so that the breadcrumbs stop there.
+    async rootFolders(): Promise<any[]> {
+        if (!this.folders) {
+            this.folders = (async () => {
+                const files = await Promise.all(
+                    ((this.user as User).folders_allow_list as string[]).map(async (id) =>
+                        this.gd.file(await this.pickAccount(await this.gd.poolDriveOf(id)), id),
+                    ),
+                );
+                return files
+                    .filter((file) => file && !file.error)
+                    .map((file) => {
+                        delete file.parents;
+                        return file;
+                    });
+            })();
+        }
+        return this.folders;
+    }
+
+    // searchDrives returns the drives to search in: the drives_white_list and
+    // the shared drives of the allowed folders, as folders outside of shared
+    // drives are not served.
+    async searchDrives(): Promise<string[]> {
+        const drives = [...((this.user as User).drives_white_list || [])];
+        for (const folder of await this.rootFolders()) {
+            if (folder.driveId && drives.indexOf(folder.driveId) < 0) {
+                drives.push(folder.driveId);
+            }
+        }
+        return drives;
+    }
+
+    // pickAccount picks an account of the pool of drive, or of the current pool
+    // when the drive is unknown, once per request
+    private pickAccount(drive?: string): Promise<GoogleDriveAccount> {
+        const key = drive || '';
+        if (!(key in this.accounts)) {
+            this.accounts[key] = this.gd.pickAccount(this.gd.poolOf(drive));
+        }
+        return this.accounts[key];
+    }
+}
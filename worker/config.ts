@@ -1,18 +1,26 @@
-import { GoogleDriveConfig } from './drive';
+import { AccountStrategy, GoogleDriveConfig } from './drive';
 import { buf2hex, str2buf } from './utils';
 
 declare const __ACCOUNTS_COUNT__: number;
 declare const __ACCOUNT_ROTATION__: number;
 declare const __ACCOUNT_CANDIDATES__: number;
+declare const __ACCOUNT_WEIGHTS__: number[];
+declare const __ACCOUNT_DRIVES__: Record<string, number[]>;
 
 const config: GoogleDriveConfig = {
     secret: '__SECRET__',
     accounts: Array.from({ length: __ACCOUNTS_COUNT__ }, (_, i: number) => `__ACCOUNTS_URL__${i + 1}`),
     accountRotation: __ACCOUNT_ROTATION__,
     accountCandidates: __ACCOUNT_CANDIDATES__,
+    accountStrategy: '__ACCOUNT_STRATEGY__' as AccountStrategy,
+    accountWeights: __ACCOUNT_WEIGHTS__,
+    accountDrives: __ACCOUNT_DRIVES__,
     userURL: async (user: string) =>
         '__USERS_URL__' + buf2hex(await crypto.subtle.digest('SHA-256', str2buf(config.secret + user))),
     static: async (pathname: string) => '__STATIC_URL__' + pathname,
+    indexURL: async (drive: string) =>
+        '__INDEX_URL__' &&
+        '__INDEX_URL__' + buf2hex(await crypto.subtle.digest('SHA-256', str2buf(config.secret + ':index:' + drive))),
 };
 
 export default config;
@@ -28,14 +28,27 @@ export interface GoogleDriveServiceAccount extends AccessToken {
 
 export type GoogleDriveAccount = GoogleDriveUserAccount | GoogleDriveServiceAccount;
 
+// window: seeded window of consecutive candidates rotating over time, then a random pick
+// shuffle: uniform random pick over the whole pool
+// weighted: random pick with per-account weights
+// sticky: seeded window of consecutive candidates per user, then a random pick
+export type AccountStrategy = 'window' | 'shuffle' | 'weighted' | 'sticky';
+
 export interface GoogleDriveConfig {
     // secure random string that provides app-level security
     secret: string;
     accountRotation: number;
     accountCandidates: number;
+    accountStrategy: AccountStrategy;
+    accountWeights: number[];
+    // indexes of the accounts serving each shared drive, drives not listed are served by all accounts
+    accountDrives: Record<string, number[]>;
     accounts: (GoogleDriveAccount | string)[];
     userURL: (user: string) => Promise<string>;
     static: (pathname: string) => Promise<string>;
+    // URL of the search index file of a drive, of the manifest for an empty
+    // drive, or empty when no index is deployed
+    indexURL: (drive: string) => Promise<string>;
 }
 
 interface TokenResponse {
@@ -62,15 +75,38 @@ export interface User {
     pass: string;
     drives_white_list?: string[];
     drives_black_list?: string[];
+    totp_secret?: string;
+    totp_backup_codes?: string[];
+    expires_at?: number;
+    disabled?: boolean;
+    capabilities?: Capability[];
+    folders_allow_list?: string[];
 }
 
+export type Capability = 'list' | 'search' | 'download' | 'copy';
+
+// shared drives of files and folders, null outside shared drives, kept for
+// the lifetime of the isolate
+const driveCache: Record<string, string | null> = {};
+let driveCacheSize = 0;
+const DRIVE_CACHE_SIZE = 10000;
+
 export class GoogleDrive {
+    // name of the signed in user, used by the sticky account strategy
+    userName?: string;
+
+    // indexes of the accounts to pick from, all accounts if undefined
+    accountPool?: number[];
+
     constructor(private config: GoogleDriveConfig) {}
 
-    async getUser(user: string): Promise<User> {
-        return JSON.parse(
-            buf2str(await this.decrypt('user', await (await fetch(await this.config.userURL(user))).arrayBuffer())),
-        );
+    // getUser returns undefined for users missing from the users Gist
+    async getUser(user: string): Promise<User | undefined> {
+        const resp = await fetch(await this.config.userURL(user));
+        if (!resp.ok) {
+            return undefined;
+        }
+        return JSON.parse(buf2str(await this.decrypt('user', await resp.arrayBuffer())));
     }
 
     async download(account: GoogleDriveAccount | null, id: string, range = ''): Promise<Response> {
@@ -97,7 +133,7 @@ export class GoogleDrive {
             (async () => {
                 const url = new URL(`https://www.googleapis.com/drive/v3/files/${id}`);
                 url.searchParams.set('supportsAllDrives', 'true');
-                url.searchParams.set('fields', 'id,name,kind,mimeType,size,modifiedTime,parents,md5Checksum');
+                url.searchParams.set('fields', 'id,name,kind,mimeType,size,modifiedTime,parents,md5Checksum,driveId');
                 return (
                     await fetch(url.toString(), {
                         headers: {
@@ -127,6 +163,23 @@ export class GoogleDrive {
         return file;
     }
 
+    async parents(account: GoogleDriveAccount | null, id: string): Promise<string[]> {
+        if (account == null) {
+            account = await this.pickAccount();
+        }
+        const url = new URL(`https://www.googleapis.com/drive/v3/files/${id}`);
+        url.searchParams.set('supportsAllDrives', 'true');
+        url.searchParams.set('fields', 'id,parents');
+        const file = await (
+            await fetch(url.toString(), {
+                headers: {
+                    Authorization: `Bearer ${await this.accessToken(account)}`,
+                },
+            })
+        ).json();
+        return file.parents || [];
+    }
+
     async search(account: GoogleDriveAccount | null, options: SearchOptions): Promise<GDFileList | null> {
         let pageTokenMap: Record<string, string> = {};
         let { query, drives, encrypted_page_token } = options;
@@ -146,7 +199,7 @@ export class GoogleDrive {
         const url = new URL('https://www.googleapis.com/drive/v3/files');
         url.searchParams.set('includeItemsFromAllDrives', 'true');
         url.searchParams.set('supportsAllDrives', 'true');
-        url.searchParams.set('fields', 'nextPageToken,files(id,name,mimeType,size,modifiedTime,parents)');
+        url.searchParams.set('fields', 'nextPageToken,files(id,name,mimeType,size,modifiedTime,parents,md5Checksum)');
         url.searchParams.set('pageSize', '100');
 
         const clauses: string[] = [];
@@ -265,7 +318,7 @@ export class GoogleDrive {
             url.searchParams.set('includeItemsFromAllDrives', 'true');
             url.searchParams.set('supportsAllDrives', 'true');
             url.searchParams.set('q', `'${parent}' in parents and trashed = false`);
-            url.searchParams.set('fields', 'nextPageToken,files(id,name,mimeType,size,modifiedTime,parents)');
+            url.searchParams.set('fields', 'nextPageToken,files(id,name,mimeType,size,modifiedTime,parents,md5Checksum)');
             url.searchParams.set('pageSize', '100');
             if (orderBy) {
                 url.searchParams.set('orderBy', orderBy);
@@ -381,6 +434,31 @@ export class GoogleDrive {
         );
     }
 
+    async mkdir(account: GoogleDriveAccount | null, parent: string, name: string): Promise<Response> {
+        if (account == null) {
+            account = await this.pickAccount();
+        }
+        const url = new URL('https://www.googleapis.com/drive/v3/files');
+        url.searchParams.set('supportsAllDrives', 'true');
+        url.searchParams.set('fields', 'id,name,mimeType,modifiedTime,parents,driveId');
+        const response = await fetch(url.toString(), {
+            method: 'POST',
+            headers: {
+                Authorization: `Bearer ${await this.accessToken(account)}`,
+                'Content-Type': 'application/json; charset=UTF-8',
+            },
+            body: JSON.stringify({
+                name,
+                parents: [parent],
+                mimeType: 'application/vnd.google-apps.folder',
+            }),
+        });
+        return new Response(response.body, {
+            status: response.status,
+            headers: { 'Content-Type': 'application/json' },
+        });
+    }
+
     async secretKey(namespace: string): Promise<CryptoKey> {
         const {
             config: { secret },
@@ -421,25 +499,76 @@ export class GoogleDrive {
         return crypto.subtle.decrypt({ name: 'AES-GCM', iv }, await this.secretKey(namespace), ciphertext);
     }
 
-    async pickAccount(): Promise<GoogleDriveAccount> {
-        const {
-            config: { secret, accounts, accountRotation, accountCandidates },
-        } = this;
-        const candidates: typeof accounts = [];
-        if (accounts.length <= accountCandidates) {
-            candidates.push(...accounts);
-        } else {
-            // new seed for every accountRotation seconds
-            const seed = secret + Math.floor(Date.now() / 1000 / accountRotation).toString();
-            // generate a random value from seed
-            const rand = new Uint32Array(await crypto.subtle.digest('SHA-256', str2buf(seed)))[0];
-            // use the seeded random value as starting point, select accountCandidates consecutive accounts
-            for (let i = rand % accounts.length, j = 0; j < accountCandidates; i = (i + 1) % accounts.length, ++j) {
-                candidates.push(accounts[i]);
+    // restricts the accounts picked afterwards to those serving all the given drives
+    usePoolOf(drives: (string | undefined)[]): void {
+        let pool: number[] | undefined;
+        for (const drive of drives) {
+            const accounts = drive !== undefined ? this.config.accountDrives[drive] : undefined;
+            if (accounts) {
+                pool = pool === undefined ? accounts : pool.filter((i) => accounts.indexOf(i) >= 0);
             }
         }
-        // choose randomly without seed, an item from the candidates
-        const account = candidates[Math.floor(Math.random() * candidates.length)];
+        this.accountPool = pool && pool.length > 0 ? pool : undefined;
+    }
+
+    // poolOf returns the indexes of the accounts serving drive, undefined when
+    // every account does
+    poolOf(drive?: string): number[] | undefined {
+        return drive !== undefined ? this.config.accountDrives[drive] : undefined;
+    }
+
+    // poolDriveOf returns the drive of a file or folder when accounts are pooled
+    // by drive, to pick accounts from its pool
+    async poolDriveOf(id: string): Promise<string | undefined> {
+        return Object.keys(this.config.accountDrives).length > 0 ? this.driveOf(id) : undefined;
+    }
+
+    // driveOf finds the shared drive of a file or folder, usually with a single
+    // request, remembering it for the next requests.
+    async driveOf(id: string): Promise<string | undefined> {
+        const { accountDrives } = this.config;
+        if (id in accountDrives) {
+            return id;
+        }
+        if (!(id in driveCache)) {
+            const url = new URL(`https://www.googleapis.com/drive/v3/files/${id}`);
+            url.searchParams.set('supportsAllDrives', 'true');
+            url.searchParams.set('fields', 'driveId');
+            // accounts outside the pool of the drive cannot see the file, so
+            // an account of each pool is asked in turn until one can
+            const pools: (number[] | undefined)[] = [this.accountPool];
+            for (const drive of Object.keys(accountDrives).sort()) {
+                if (!pools.some((pool) => pool !== undefined && pool.join() === accountDrives[drive].join())) {
+                    pools.push(accountDrives[drive]);
+                }
+            }
+            let response: Response | undefined;
+            for (const pool of pools) {
+                response = await fetch(url.toString(), {
+                    headers: {
+                        Authorization: `Bearer ${await this.accessToken(await this.pickAccount(pool))}`,
+                    },
+                });
+                if (response.status !== 404) {
+                    break;
+                }
+            }
+            // failures are not remembered, as they may be transient
+            if (!response || !response.ok) {
+                return undefined;
+            }
+            if (driveCacheSize >= DRIVE_CACHE_SIZE) {
+                Object.keys(driveCache).forEach((key) => delete driveCache[key]);
+                driveCacheSize = 0;
+            }
+            driveCache[id] = (await response.json()).driveId || null;
+            driveCacheSize++;
+        }
+        return driveCache[id] || undefined;
+    }
+
+    async pickAccount(pool = this.accountPool): Promise<GoogleDriveAccount> {
+        const account = this.config.accounts[await this.pickAccountIndex(pool)];
         if (typeof account === 'string') {
             const ciphertext = await (await fetch(account)).arrayBuffer();
             const plaintext = buf2str(await this.decrypt('account', ciphertext));
@@ -449,6 +578,53 @@ export class GoogleDrive {
         }
     }
 
+    async pickAccountIndex(pool?: number[]): Promise<number> {
+        const {
+            config: { secret, accounts, accountRotation, accountCandidates, accountStrategy, accountWeights },
+        } = this;
+        if (pool === undefined) {
+            pool = [];
+            for (let i = 0; i < accounts.length; ++i) {
+                pool.push(i);
+            }
+        }
+        switch (accountStrategy) {
+            case 'shuffle':
+                return pool[Math.floor(Math.random() * pool.length)];
+            case 'weighted': {
+                const total = pool.reduce((sum, i) => sum + (accountWeights[i] || 0), 0);
+                if (total > 0) {
+                    let r = Math.random() * total;
+                    for (const i of pool) {
+                        r -= accountWeights[i] || 0;
+                        if (r < 0) {
+                            return i;
+                        }
+                    }
+                }
+                return pool[Math.floor(Math.random() * pool.length)];
+            }
+        }
+        const candidates: number[] = [];
+        if (pool.length <= accountCandidates) {
+            candidates.push(...pool);
+        } else {
+            // new seed for every accountRotation seconds, or a fixed seed per user when sticky
+            const seed =
+                accountStrategy === 'sticky' && this.userName !== undefined
+                    ? secret + ':sticky:' + this.userName
+                    : secret + Math.floor(Date.now() / 1000 / accountRotation).toString();
+            // generate a random value from seed
+            const rand = new Uint32Array(await crypto.subtle.digest('SHA-256', str2buf(seed)))[0];
+            // use the seeded random value as starting point, select accountCandidates consecutive accounts
+            for (let i = rand % pool.length, j = 0; j < accountCandidates; i = (i + 1) % pool.length, ++j) {
+                candidates.push(pool[i]);
+            }
+        }
+        // choose randomly without seed, an item from the candidates
+        return candidates[Math.floor(Math.random() * candidates.length)];
+    }
+
     async accessToken(account: GoogleDriveAccount): Promise<string> {
         if (account.expires == undefined || account.expires < Date.now()) {
             let token: TokenResponse;
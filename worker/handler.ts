@@ -1,8 +1,15 @@
 // import html from './index.html';
 
 import config from './config';
-import { GoogleDrive, User } from './drive';
+import { Capability, GoogleDrive, User } from './drive';
 import { parseCookie, buf2str, base64 } from './utils';
+import { verifyTOTP, verifyBackupCode } from './totp';
+import { FolderACL } from './acl';
+import { SearchIndex } from './searchindex';
+
+// lifetime of scoped tokens, by default and at most, in seconds
+const SCOPED_TOKEN_TTL = 7 * 24 * 3600;
+const SCOPED_TOKEN_MAX_TTL = 30 * 24 * 3600;
 
 export async function handleRequest(request: Request): Promise<Response> {
     try {
@@ -12,6 +19,8 @@ export async function handleRequest(request: Request): Promise<Response> {
         const { method, headers } = request;
 
         let user: User | undefined;
+        // the folder or file a scoped token is restricted to
+        let scope: string | undefined;
         let form: FormData | undefined;
         let cookie: Record<string, string> = {};
 
@@ -26,26 +35,59 @@ export async function handleRequest(request: Request): Promise<Response> {
         {
             const t = getParam('t', form, params, cookie);
             if (t) {
-                user = JSON.parse(buf2str(await gd.decrypt('userToken', base64.RAWURL.decode(t))));
+                if (t.startsWith('s.')) {
+                    // scoped tokens only download files under their scope until they expire
+                    const claims = JSON.parse(buf2str(await gd.decrypt('scopedToken', base64.RAWURL.decode(t.slice(2)))));
+                    if (
+                        claims &&
+                        typeof claims.scope === 'string' &&
+                        claims.exp > Date.now() / 1000 &&
+                        url.pathname.startsWith('/file/')
+                    ) {
+                        user = claims;
+                        scope = claims.scope;
+                    }
+                } else {
+                    user = JSON.parse(buf2str(await gd.decrypt('userToken', base64.RAWURL.decode(t))));
+                }
                 if (!user || typeof user.name !== 'string' || typeof user.pass !== 'string') {
                     user = undefined;
                 } else {
                     const userData = await gd.getUser(user.name);
-                    if (user.name !== userData.name || user.pass !== userData.pass) {
+                    if (
+                        !userData ||
+                        user.name !== userData.name ||
+                        user.pass !== userData.pass ||
+                        !activeUser(userData)
+                    ) {
                         user = undefined;
                     } else {
                         user = userData;
+                        gd.userName = user.name;
                     }
                 }
             }
         }
 
+        const acl = new FolderACL(gd, user);
+        const scopeACL =
+            user && scope !== undefined
+                ? new FolderACL(gd, { ...user, folders_allow_list: [scope], drives_white_list: [] })
+                : undefined;
+
         if (url.pathname === '/login') {
             const name = getParam('name', form, params);
             const pass = getParam('pass', form, params);
+            const code = getParam('code', form, params) || '';
             if (name && name !== '') {
                 const user = await gd.getUser(name);
-                if (user && user.name === name && user.pass === pass) {
+                if (
+                    user &&
+                    user.name === name &&
+                    user.pass === pass &&
+                    activeUser(user) &&
+                    (await validCodeForUser(code, user))
+                ) {
                     const t = base64.RAWURL.encode(
                         await gd.encrypt('userToken', JSON.stringify(user, ['name', 'pass'])),
                     );
@@ -67,76 +109,153 @@ export async function handleRequest(request: Request): Promise<Response> {
             });
         }
 
-        if (url.pathname === '/api/list' && user) {
+        if (url.pathname === '/api/list' && user && hasCapability(user, 'list')) {
             const parent = getParam('parent', form, params);
             const orderBy = getParam('orderBy', form, params);
             const pageToken = getParam('pageToken', form, params);
-            if (!parent || validDriveForUser(parent, user)) {
+            if (!parent || (validDriveForUser(parent, user) && (await acl.allowed(parent)))) {
+                if (parent) {
+                    gd.usePoolOf([await gd.poolDriveOf(parent)]);
+                }
                 const fileList = await gd.ls(null, parent, orderBy, pageToken);
                 if (fileList && fileList.drives != null) {
-                    fileList.drives = fileList.drives.filter((drive: any) =>
-                        validDriveForUser(drive.id, user as User, !parent),
+                    fileList.drives = fileList.drives.filter(
+                        (drive: any) =>
+                            validDriveForUser(drive.id, user as User, !parent) &&
+                            (!!parent || !acl.enabled || acl.isRoot(drive.id)),
                     );
                 }
+                if (fileList && !parent && !pageToken && acl.enabled) {
+                    fileList.files = await acl.rootFolders();
+                }
                 return new Response(JSON.stringify(fileList), { headers: { 'Content-Type': 'application/json' } });
             }
         }
 
-        if (url.pathname === '/api/search' && user) {
+        if (url.pathname === '/api/search' && user && hasCapability(user, 'search')) {
             const query = getParam('q', form, params) || '';
             const encrypted_page_token = getParam('pageToken', form, params);
             const drives: string[] = [];
-            if (user.drives_black_list && user.drives_black_list.length > 0) {
+            if (acl.enabled) {
+                drives.push(...(await acl.searchDrives()));
+                if (drives.length === 0) {
+                    return new Response(JSON.stringify({ files: [] }), {
+                        headers: { 'Content-Type': 'application/json' },
+                    });
+                }
+            } else if (user.drives_black_list && user.drives_black_list.length > 0) {
                 (((await gd.ls()) as any).drives || []).forEach((drive: any) => {
                     ((user as any).drives_black_list as string[]).indexOf(drive.id) < 0 && drives.push(drive.id);
                 });
             } else if (user.drives_white_list && user.drives_white_list.length > 0) {
                 drives.push(...user.drives_white_list);
             }
+            gd.usePoolOf(drives);
             const fileList = await gd.search(null, { query, drives, encrypted_page_token });
+            if (fileList && fileList.files) {
+                fileList.files = await acl.filter(fileList.files);
+            }
             return new Response(JSON.stringify(fileList), { headers: { 'Content-Type': 'application/json' } });
         }
 
-        if (url.pathname === '/api/file' && user) {
+        if (url.pathname === '/api/indexSearch' && user && hasCapability(user, 'search')) {
+            const index = new SearchIndex(gd, config.indexURL);
+            if (!(await index.enabled())) {
+                return new Response('no search index deployed', { status: 503 });
+            }
+            const query = getParam('q', form, params) || '';
+            const limit = Math.min(Number(getParam('limit', form, params)) || 100, 1000);
+            let drives = (await index.manifest()).drives
+                .map((drive) => drive.id)
+                .filter((drive) => validDriveForUser(drive, user as User, !acl.enabled));
+            if (acl.enabled) {
+                const searchDrives = await acl.searchDrives();
+                drives = drives.filter((drive) => searchDrives.indexOf(drive) >= 0);
+            }
+            const files = await index.search(query, drives, acl, limit);
+            return new Response(JSON.stringify({ files }), { headers: { 'Content-Type': 'application/json' } });
+        }
+
+        if (url.pathname === '/api/file' && user && hasCapability(user, 'list')) {
             const id = getParam('id', form, params);
-            if (!id || validDriveForUser(id, user)) {
+            if (!id || (validDriveForUser(id, user) && (await acl.allowed(id)))) {
+                if (id) {
+                    gd.usePoolOf([await gd.poolDriveOf(id)]);
+                }
                 const file = await gd.file(null, id as string);
                 if (
                     file &&
                     (file.parents == null ||
                         (file.parents as string[]).every((parent) => validDriveForUser(parent, user as User)))
                 ) {
+                    if (acl.isRoot(file.id)) {
+                        delete file.parents;
+                    }
                     return new Response(JSON.stringify(file), { headers: { 'Content-Type': 'application/json' } });
                 }
             }
         }
 
-        if (url.pathname === '/api/copyFileInit' && user) {
+        if (url.pathname === '/api/copyFileInit' && user && hasCapability(user, 'copy')) {
             const src = getParam('src', form, params);
             const dst = getParam('dst', form, params);
-            if (src && dst) {
+            if (
+                src &&
+                dst &&
+                (await acl.allowed(src)) &&
+                (await validTargetForUser(gd, acl, dst, user)) &&
+                (await acl.allowed(dst))
+            ) {
+                gd.usePoolOf([await gd.poolDriveOf(src), await gd.poolDriveOf(dst)]);
                 return gd.copyFileInit(null, src as string, dst as string);
             }
         }
 
-        if (url.pathname === '/api/copyFileExec' && user) {
+        if (url.pathname === '/api/copyFileExec' && user && hasCapability(user, 'copy')) {
             const src = getParam('src', form, params);
             const token = getParam('token', form, params);
-            if (src && token) {
+            if (src && token && (await acl.allowed(src))) {
+                gd.usePoolOf([await gd.poolDriveOf(src)]);
                 return gd.copyFileExec(null, src as string, token as string);
             }
         }
 
-        if (url.pathname === '/api/copyFileStat' && user) {
+        if (url.pathname === '/api/copyFileStat' && user && hasCapability(user, 'copy')) {
             const token = getParam('token', form, params);
             if (token) {
                 return gd.copyFileStat(null, token as string);
             }
         }
 
-        if (url.pathname.startsWith('/file/') && user) {
+        if (url.pathname === '/api/mkdir' && user && hasCapability(user, 'copy')) {
+            const parent = getParam('parent', form, params);
+            const name = getParam('name', form, params);
+            if (parent && name && (await validTargetForUser(gd, acl, parent, user)) && (await acl.allowed(parent))) {
+                gd.usePoolOf([await gd.poolDriveOf(parent)]);
+                return gd.mkdir(null, parent, name);
+            }
+        }
+
+        if (url.pathname === '/api/scopedToken' && user && hasCapability(user, 'download')) {
+            const id = getParam('scope', form, params);
+            const ttl = Math.min(Number(getParam('ttl', form, params)) || SCOPED_TOKEN_TTL, SCOPED_TOKEN_MAX_TTL);
+            if (id && (await validTargetForUser(gd, acl, id, user)) && (await acl.allowed(id))) {
+                const exp = Math.floor(Date.now() / 1000) + ttl;
+                const token =
+                    's.' +
+                    base64.RAWURL.encode(
+                        await gd.encrypt('scopedToken', JSON.stringify({ name: user.name, pass: user.pass, scope: id, exp })),
+                    );
+                return new Response(JSON.stringify({ token, expires: exp }), {
+                    headers: { 'Content-Type': 'application/json' },
+                });
+            }
+        }
+
+        if (url.pathname.startsWith('/file/') && user && hasCapability(user, 'download')) {
             const m = url.pathname.match(/^\/file\/([^\/]+)/);
-            if (m) {
+            if (m && (await acl.allowed(m[1])) && (!scopeACL || (await scopeACL.allowed(m[1])))) {
+                gd.usePoolOf([await gd.poolDriveOf(m[1])]);
                 const fileID = m[1];
                 return gd.download(null, fileID, headers.get('Range') || undefined);
             }
@@ -162,6 +281,7 @@ export async function handleRequest(request: Request): Promise<Response> {
             }
 
             return new Response(response.body, {
+                status: response.status,
                 headers,
             });
         }
@@ -180,6 +300,40 @@ function validDriveForUser(driveID: string, user: User, enforceWhileList: boolea
     return true;
 }
 
+// validTargetForUser checks the drive of a file or folder against the drive lists
+// of the user, unless folder-level access control restricts the user instead
+async function validTargetForUser(gd: GoogleDrive, acl: FolderACL, id: string, user: User): Promise<boolean> {
+    return acl.enabled || validDriveForUser((await gd.driveOf(id)) || id, user, true);
+}
+
+// users without recorded capabilities keep the full access they had before
+function hasCapability(user: User, capability: Capability): boolean {
+    return !user.capabilities || user.capabilities.length === 0 || user.capabilities.indexOf(capability) >= 0;
+}
+
+function activeUser(user: User): boolean {
+    if (user.disabled) {
+        return false;
+    }
+    if (user.expires_at && user.expires_at * 1000 <= Date.now()) {
+        return false;
+    }
+    return true;
+}
+
+async function validCodeForUser(code: string, user: User): Promise<boolean> {
+    if (!user.totp_secret) {
+        return true;
+    }
+    if (code === '') {
+        return false;
+    }
+    return (
+        (await verifyTOTP(user.totp_secret, code)) ||
+        (await verifyBackupCode(config.secret, user.totp_backup_codes || [], code))
+    );
+}
+
 function getParam(
     key: string,
     form?: FormData,
@@ -0,0 +1,164 @@
+import { GoogleDrive } from './drive';
+import { FolderACL } from './acl';
+
+const FOLDER_MIME_TYPE = 'application/vnd.google-apps.folder';
+
+// keep fetched index files this long, so that redeployed indexes show up
+const INDEX_TTL = 5 * 60 * 1000;
+
+export interface IndexManifest {
+    v: number;
+    built: number;
+    drives: { id: string; name: string; built: number; folders: number; files: number }[];
+}
+
+// folders[0] is the drive itself, folders and files refer to their parent
+// by its position in folders, -1 when unknown
+export interface IndexShard {
+    v: number;
+    drive: string;
+    name: string;
+    built: number;
+    mimeTypes: string[];
+    folders: [string, string, number][];
+    files: [string, string, number, number, number][];
+    // lower case names, computed on load
+    folderNames?: string[];
+    fileNames?: string[];
+}
+
+export interface IndexMatch {
+    id: string;
+    name: string;
+    mimeType: string;
+    size?: string;
+    parents: string[];
+    driveId: string;
+    path: string;
+}
+
+const cache: Record<string, { expires: number; data: Promise<any> }> = {};
+
+// SearchIndex searches the index built by "gdir index build", which lists the
+// names and paths of the files of each shared drive.
+export class SearchIndex {
+    constructor(private gd: GoogleDrive, private indexURL: (drive: string) => Promise<string>) {}
+
+    async enabled(): Promise<boolean> {
+        return !!(await this.indexURL(''));
+    }
+
+    private async fetch(drive: string): Promise<any> {
+        const url = await this.indexURL(drive);
+        const now = Date.now();
+        if (!cache[url] || cache[url].expires < now) {
+            cache[url] = {
+                expires: now + INDEX_TTL,
+                data: (async () => {
+                    const resp = await fetch(url);
+                    if (!resp.ok) {
+                        throw new Error(`index of ${drive || 'drives'} unavailable: ${resp.status}`);
+                    }
+                    const data = JSON.parse(
+                        new TextDecoder().decode(await this.gd.decrypt('index', await resp.arrayBuffer())),
+                    );
+                    if (data.v !== 1) {
+                        throw new Error(`unsupported index version ${data.v}`);
+                    }
+                    return data;
+                })(),
+            };
+            // failures are retried on the next request
+            cache[url].data.catch(() => delete cache[url]);
+        }
+        return cache[url].data;
+    }
+
+    async manifest(): Promise<IndexManifest> {
+        return this.fetch('');
+    }
+
+    async shard(drive: string): Promise<IndexShard> {
+        const shard: IndexShard = await this.fetch(drive);
+        if (!shard.folderNames) {
+            shard.folderNames = shard.folders.map((folder) => folder[1].toLowerCase());
+            shard.fileNames = shard.files.map((file) => file[1].toLowerCase());
+        }
+        return shard;
+    }
+
+    // search returns up to limit folders and files of drives with every term
+    // of query in their names, leaving out those the ACL does not allow.
+    async search(query: string, drives: string[], acl: FolderACL, limit: number): Promise<IndexMatch[]> {
+        const terms = query
+            .toLowerCase()
+            .split(/\s+/)
+            .filter((term) => term);
+        const matches: IndexMatch[] = [];
+        if (terms.length === 0) {
+            return matches;
+        }
+        // shards are loaded one at a time, until enough matches are found
+        for (const drive of drives) {
+            if (matches.length >= limit) {
+                break;
+            }
+            const shard = await this.shard(drive);
+            const paths: Record<number, string> = {};
+            const path = (i: number): string => {
+                if (!(i in paths)) {
+                    const names: string[] = [];
+                    // bounded by the number of folders, in case of cycles
+                    for (let j = i, n = 0; j >= 0 && j < shard.folders.length && n <= shard.folders.length; n++) {
+                        names.unshift(shard.folders[j][1]);
+                        j = shard.folders[j][2];
+                    }
+                    paths[i] = names.length > 0 ? '/' + names.join('/') : '';
+                }
+                return paths[i];
+            };
+            const allowed = (id: string, i: number): boolean => {
+                if (!acl.enabled || acl.isRoot(id)) {
+                    return true;
+                }
+                for (let n = 0; i >= 0 && i < shard.folders.length && n <= shard.folders.length; n++) {
+                    if (acl.isRoot(shard.folders[i][0])) {
+                        return true;
+                    }
+                    i = shard.folders[i][2];
+                }
+                return false;
+            };
+            const parents = (i: number): string[] => (i >= 0 ? [shard.folders[i][0]] : []);
+            const match = (name: string) => terms.every((term) => name.indexOf(term) >= 0);
+            for (let i = 1; i < shard.folders.length && matches.length < limit; i++) {
+                const [id, name, parent] = shard.folders[i];
+                if (match((shard.folderNames as string[])[i]) && allowed(id, parent)) {
+                    matches.push({
+                        id,
+                        name,
+                        mimeType: FOLDER_MIME_TYPE,
+                        parents: parents(parent),
+                        driveId: shard.drive,
+                        path: path(i),
+                    });
+                }
+            }
+            for (let i = 0; i < shard.files.length && matches.length < limit; i++) {
+                const [id, name, folder, size, mimeType] = shard.files[i];
+                if (match((shard.fileNames as string[])[i]) && allowed(id, folder)) {
+                    matches.push({
+                        id,
+                        name,
+                        mimeType: shard.mimeTypes[mimeType],
+                        size: String(size),
+                        parents: parents(folder),
+                        driveId: shard.drive,
+                        path: path(folder) + '/' + name,
+                    });
+                }
+            }
+        }
+        return matches;
+    }
+}
@@ -0,0 +1,62 @@
+import { base32, buf2hex, str2buf } from './utils';
+
+const TOTP_DIGITS = 6;
+const TOTP_PERIOD = 30;
+const TOTP_SKEW = 1;
+
+export async function totpCode(secret: string, counter: number): Promise<string> {
+    const key = await crypto.subtle.importKey(
+        'raw',
+        base32.decode(secret),
+        { name: 'HMAC', hash: 'SHA-1' },
+        false,
+        ['sign'],
+    );
+    const msg = new DataView(new ArrayBuffer(8));
+    msg.setUint32(0, Math.floor(counter / 0x100000000));
+    msg.setUint32(4, counter >>> 0);
+    const sum = new DataView(await crypto.subtle.sign('HMAC', key, msg.buffer));
+    const offset = sum.getUint8(sum.byteLength - 1) & 0xf;
+    const value = (sum.getUint32(offset) & 0x7fffffff) % 10 ** TOTP_DIGITS;
+    return value.toString().padStart(TOTP_DIGITS, '0');
+}
+
+// verifyTOTP checks a one-time code, allowing TOTP_SKEW steps of clock drift.
+export async function verifyTOTP(secret: string, code: string): Promise<boolean> {
+    const counter = Math.floor(Date.now() / 1000 / TOTP_PERIOD);
+    for (let i = -TOTP_SKEW; i <= TOTP_SKEW; ++i) {
+        if ((await totpCode(secret, counter + i)) === code) {
+            return true;
+        }
+    }
+    return false;
+}
+
+// the worker cannot write the users Gist, so the backup codes it accepts are
+// remembered in the isolate and in the cache of the data center instead
+const spentBackupCodes = new Set<string>();
+const SPENT_BACKUP_CODE_TTL = 365 * 24 * 3600;
+
+function spentBackupCodeRequest(hash: string): Request {
+    return new Request('https://gdir.invalid/spent-backup-codes/' + hash);
+}
+
+// verifyBackupCode checks code against the hashed backup codes generated by gdir,
+// accepting each code once.
+export async function verifyBackupCode(appSecret: string, hashes: string[], code: string): Promise<boolean> {
+    const hash = buf2hex(
+        await crypto.subtle.digest('SHA-256', str2buf(appSecret + ':totp-backup:' + code.trim().toLowerCase())),
+    );
+    if (hashes.indexOf(hash) < 0 || spentBackupCodes.has(hash)) {
+        return false;
+    }
+    spentBackupCodes.add(hash);
+    if (await caches.default.match(spentBackupCodeRequest(hash))) {
+        return false;
+    }
+    await caches.default.put(
+        spentBackupCodeRequest(hash),
+        new Response('', { headers: { 'Cache-Control': `max-age=${SPENT_BACKUP_CODE_TTL}` } }),
+    );
+    return true;
+}
@@ -26,6 +26,24 @@ export const base64 = {
     },
 };
 
+export const base32 = {
+    decode: (s: string) => {
+        const alphabet = 'ABCDEFGHIJKLMNOPQRSTUVWXYZ234567';
+        const out: number[] = [];
+        let bits = 0;
+        let value = 0;
+        for (const c of s.toUpperCase().replace(/=+$/, '')) {
+            value = (value << 5) | alphabet.indexOf(c);
+            bits += 5;
+            if (bits >= 8) {
+                out.push((value >>> (bits - 8)) & 0xff);
+                bits -= 8;
+            }
+        }
+        return new Uint8Array(out);
+    },
+};
+
 export const parseCookie = (str: string) =>
     str
         .split(';')